@@ -0,0 +1,189 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// AdminPathPrefix is path prefix for toyhose specific control API.
+const AdminPathPrefix = "/_toyhose/"
+
+// destinationOf returns destination of streamName after it receives records accepted so far,
+// so that commands to the destination take those records into account.
+func (d *Dispatcher) destinationOf(ctx context.Context, streamName string) (Destination, error) {
+	ds, err := d.svc.find(&streamName)
+	if err != nil {
+		return nil, err
+	}
+	if ds.destination == nil {
+		return nil, &types.InvalidArgumentException{Message: aws.String(fmt.Sprintf("DeliveryStreamName: %s has no destination", streamName))}
+	}
+	if err := ds.sync(ctx); err != nil {
+		return nil, err
+	}
+	return ds.destination, nil
+}
+
+func errNotSupported(streamName, op string) error {
+	return &types.InvalidArgumentException{Message: aws.String(fmt.Sprintf("destination of %s does not support %s", streamName, op))}
+}
+
+// Flush delivers buffered records of supplied deliveryStreamName immediately.
+func (d *Dispatcher) Flush(ctx context.Context, streamName string) error {
+	dest, err := d.destinationOf(ctx, streamName)
+	if err != nil {
+		return err
+	}
+	f, ok := dest.(Flusher)
+	if !ok {
+		return errNotSupported(streamName, "flush")
+	}
+	return f.Flush(ctx)
+}
+
+// FlushAll delivers buffered records of every deliveryStream immediately.
+func (d *Dispatcher) FlushAll(ctx context.Context) error {
+	for _, ds := range d.pool.All() {
+		f, ok := ds.destination.(Flusher)
+		if !ok {
+			continue
+		}
+		if err := ds.sync(ctx); err != nil {
+			return err
+		}
+		var notFound *types.ResourceNotFoundException
+		if err := f.Flush(ctx); err != nil && !errors.As(err, &notFound) {
+			// streams deleted in the meantime have nothing to flush.
+			return fmt.Errorf("failed to flush %s: %w", ds.deliveryStreamName, err)
+		}
+	}
+	return nil
+}
+
+// Pause holds delivery of supplied deliveryStreamName. Records keep buffering.
+func (d *Dispatcher) Pause(ctx context.Context, streamName string) error {
+	dest, err := d.destinationOf(ctx, streamName)
+	if err != nil {
+		return err
+	}
+	p, ok := dest.(Pauser)
+	if !ok {
+		return errNotSupported(streamName, "pause")
+	}
+	return p.Pause(ctx)
+}
+
+// Resume restarts delivery of supplied deliveryStreamName held by Pause.
+func (d *Dispatcher) Resume(ctx context.Context, streamName string) error {
+	dest, err := d.destinationOf(ctx, streamName)
+	if err != nil {
+		return err
+	}
+	p, ok := dest.(Pauser)
+	if !ok {
+		return errNotSupported(streamName, "resume")
+	}
+	return p.Resume(ctx)
+}
+
+// BufferStatus returns current buffer state of supplied deliveryStreamName.
+func (d *Dispatcher) BufferStatus(ctx context.Context, streamName string) (BufferStatus, error) {
+	dest, err := d.destinationOf(ctx, streamName)
+	if err != nil {
+		return BufferStatus{}, err
+	}
+	bi, ok := dest.(BufferInspector)
+	if !ok {
+		return BufferStatus{}, errNotSupported(streamName, "buffer inspection")
+	}
+	return bi.BufferStatus(ctx)
+}
+
+// Reset deletes every deliveryStream, in-memory delivered objects and record ledger.
+// It waits for destinations to finish before clearing deliveries.
+// Like DeleteDeliveryStream, Kinesis checkpoints and enhanced fan-out consumers of deleted streams are removed.
+func (d *Dispatcher) Reset(ctx context.Context) error {
+	var streams []*deliveryStream
+	for _, ds := range d.pool.All() {
+		if d.pool.Delete(ds.arn) != nil {
+			ds.Close()
+			streams = append(streams, ds)
+		}
+	}
+	var err error
+waiting:
+	for _, ds := range streams {
+		select {
+		case <-ds.done:
+		case <-ctx.Done():
+			for _, ds := range streams {
+				ds.abort()
+			}
+			err = ctx.Err()
+			break waiting
+		}
+	}
+	for _, ds := range streams {
+		d.svc.teardown(ctx, ds)
+	}
+	if err != nil {
+		return err
+	}
+	d.memory.ClearAll()
+	d.ledger.Clear()
+	return nil
+}
+
+// AdminHandler returns http.Handler for toyhose specific control API under AdminPathPrefix.
+func (d *Dispatcher) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+AdminPathPrefix+"flush", func(w http.ResponseWriter, r *http.Request) {
+		outputForJSON(w, struct{}{}, d.FlushAll(r.Context()))
+	})
+	mux.HandleFunc("POST "+AdminPathPrefix+"reset", func(w http.ResponseWriter, r *http.Request) {
+		outputForJSON(w, struct{}{}, d.Reset(r.Context()))
+	})
+	mux.HandleFunc("POST "+AdminPathPrefix+"streams/{name}/flush", func(w http.ResponseWriter, r *http.Request) {
+		outputForJSON(w, struct{}{}, d.Flush(r.Context(), r.PathValue("name")))
+	})
+	mux.HandleFunc("POST "+AdminPathPrefix+"streams/{name}/pause", func(w http.ResponseWriter, r *http.Request) {
+		outputForJSON(w, struct{}{}, d.Pause(r.Context(), r.PathValue("name")))
+	})
+	mux.HandleFunc("POST "+AdminPathPrefix+"streams/{name}/resume", func(w http.ResponseWriter, r *http.Request) {
+		outputForJSON(w, struct{}{}, d.Resume(r.Context(), r.PathValue("name")))
+	})
+	mux.HandleFunc("GET "+AdminPathPrefix+"streams/{name}/buffer", func(w http.ResponseWriter, r *http.Request) {
+		st, err := d.BufferStatus(r.Context(), r.PathValue("name"))
+		outputForJSON(w, st, err)
+	})
+	mux.HandleFunc("GET "+AdminPathPrefix+"records/{id}", func(w http.ResponseWriter, r *http.Request) {
+		e, err := d.LookupRecord(r.PathValue("id"))
+		outputForJSON(w, e, err)
+	})
+	mux.HandleFunc("GET "+AdminPathPrefix+"streams/{name}/records", func(w http.ResponseWriter, r *http.Request) {
+		from, err := parseTimeParam(r, "from")
+		if err != nil {
+			outputForJSON(w, nil, err)
+			return
+		}
+		to, err := parseTimeParam(r, "to")
+		if err != nil {
+			outputForJSON(w, nil, err)
+			return
+		}
+		outputForJSON(w, d.Records(r.PathValue("name"), from, to), nil)
+	})
+	mux.HandleFunc("GET "+AdminPathPrefix+"tail", d.serveTail)
+	d.registerDashboard(mux)
+	d.registerWebhookHandlers(mux)
+	d.registerClockHandlers(mux)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,143 @@
+package toyhose
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestAdminAPI(t *testing.T) {
+	ctx := context.Background()
+	awsConf := awsConfig(t)
+	checkpointDir := t.TempDir()
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConf,
+		S3InjectedConf: S3InjectedConf{
+			InMemory: true,
+		},
+		KinesisInjectedConf: KinesisInjectedConf{
+			CheckpointDir: checkpointDir,
+		},
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.Dispatch)
+	mux.Handle(AdminPathPrefix, d.AdminHandler())
+	testserver := httptest.NewServer(mux)
+	defer testserver.Close()
+
+	fh := firehose.NewFromConfig(awsConf, func(o *firehose.Options) {
+		o.BaseEndpoint = aws.String(testserver.URL)
+	})
+	streamName := "admin-stream"
+	if _, err := fh.CreateDeliveryStream(ctx, &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+			BucketARN: aws.String("arn:aws:s3:::admin-bucket"),
+			BufferingHints: &fhtypes.BufferingHints{
+				SizeInMBs:         aws.Int32(1),
+				IntervalInSeconds: aws.Int32(300),
+			},
+			RoleARN: aws.String("foo"),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	put := func(t *testing.T, data string) {
+		t.Helper()
+		if _, err := fh.PutRecord(ctx, &firehose.PutRecordInput{
+			DeliveryStreamName: &streamName,
+			Record:             &fhtypes.Record{Data: []byte(data)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	call := func(t *testing.T, method, path string, expectedStatus int) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, testserver.URL+AdminPathPrefix+path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		if res.StatusCode != expectedStatus {
+			t.Fatalf("unexpected status for %s %s: %d", method, path, res.StatusCode)
+		}
+		return res
+	}
+	bufferStatus := func(t *testing.T) BufferStatus {
+		t.Helper()
+		var st BufferStatus
+		res := call(t, http.MethodGet, "streams/"+streamName+"/buffer", http.StatusOK)
+		if err := json.NewDecoder(res.Body).Decode(&st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	t.Run("unknown stream", func(t *testing.T) {
+		call(t, http.MethodPost, "streams/unknown/flush", http.StatusNotFound)
+	})
+
+	t.Run("buffer and flush", func(t *testing.T) {
+		put(t, "aaa\n")
+		put(t, "bbb\n")
+		if st := bufferStatus(t); st.Records != 2 || st.SizeInBytes != 8 || st.Paused {
+			t.Errorf("unexpected buffer status: %#v", st)
+		}
+		call(t, http.MethodPost, "streams/"+streamName+"/flush", http.StatusOK)
+		list := d.Deliveries(streamName)
+		if len(list) != 1 || string(list[0].Body) != "aaa\nbbb\n" {
+			t.Errorf("unexpected deliveries: %#v", list)
+		}
+		if st := bufferStatus(t); st.Records != 0 {
+			t.Errorf("buffer remains after flush: %#v", st)
+		}
+	})
+
+	t.Run("pause and resume", func(t *testing.T) {
+		d.ClearDeliveries(streamName)
+		call(t, http.MethodPost, "streams/"+streamName+"/pause", http.StatusOK)
+		put(t, "ccc\n")
+		if st := bufferStatus(t); st.Records != 1 || !st.Paused {
+			t.Errorf("unexpected buffer status: %#v", st)
+		}
+		call(t, http.MethodPost, "streams/"+streamName+"/resume", http.StatusOK)
+		if st := bufferStatus(t); st.Records != 1 || st.Paused {
+			t.Errorf("unexpected buffer status: %#v", st)
+		}
+		call(t, http.MethodPost, "flush", http.StatusOK)
+		if list := d.Deliveries(streamName); len(list) != 1 || string(list[0].Body) != "ccc\n" {
+			t.Errorf("unexpected deliveries: %#v", list)
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		checkpoints := newCheckpointStore(checkpointDir)
+		if err := checkpoints.save(streamName, &kinesisCheckpoint{Shards: map[string]string{"shard-0": "1"}}); err != nil {
+			t.Fatal(err)
+		}
+		put(t, "ddd\n")
+		call(t, http.MethodPost, "reset", http.StatusOK)
+		if cp, err := checkpoints.load(streamName); err != nil || cp != nil {
+			t.Errorf("checkpoint remains after reset: %#v, %v", cp, err)
+		}
+		if l := len(d.Deliveries(streamName)); l != 0 {
+			t.Errorf("deliveries remain after reset: %d", l)
+		}
+		out, err := fh.ListDeliveryStreams(ctx, &firehose.ListDeliveryStreamsInput{
+			DeliveryStreamType: fhtypes.DeliveryStreamTypeDirectPut,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out.DeliveryStreamNames) != 0 {
+			t.Errorf("delivery streams remain after reset: %v", out.DeliveryStreamNames)
+		}
+	})
+}
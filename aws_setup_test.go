@@ -14,7 +14,7 @@ import (
 var s3EndpointURL = "http://localhost:9000"
 var kinesisEndpointURL = "http://localhost:4567"
 
-func awsConfig(t *testing.T) aws.Config {
+func awsConfig(t testing.TB) aws.Config {
 	t.Helper()
 	cfg, err := config.LoadDefaultConfig(context.Background(),
 		config.WithRegion("us-east-1"),
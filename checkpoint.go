@@ -0,0 +1,235 @@
+package toyhose
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// kinesisCheckpoint is progress of a Kinesis source, kept as a file so that restarted toyhose resumes from it.
+type kinesisCheckpoint struct {
+	KinesisStreamARN       string    `json:"kinesisStreamARN"`
+	DeliveryStartTimestamp time.Time `json:"deliveryStartTimestamp"`
+	// Shards maps shard ID to the sequence number of the last record delivered from the shard.
+	Shards map[string]string `json:"shards"`
+}
+
+// checkpointStore keeps a JSON file per delivery stream under dir.
+type checkpointStore struct {
+	dir string
+}
+
+// newCheckpointStore returns nil when dir is empty, which means Kinesis sources start over on restart.
+func newCheckpointStore(dir string) *checkpointStore {
+	if dir == "" {
+		return nil
+	}
+	return &checkpointStore{dir: dir}
+}
+
+func (s *checkpointStore) file(deliveryName string) string {
+	return filepath.Join(s.dir, deliveryName+".json")
+}
+
+// load returns the checkpoint of deliveryName, or nil when there is none.
+func (s *checkpointStore) load(deliveryName string) (*kinesisCheckpoint, error) {
+	if s == nil {
+		return nil, nil
+	}
+	data, err := os.ReadFile(s.file(deliveryName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &kinesisCheckpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("broken checkpoint %s: %w", s.file(deliveryName), err)
+	}
+	if cp.Shards == nil {
+		cp.Shards = map[string]string{}
+	}
+	return cp, nil
+}
+
+// save writes cp atomically, so that restart never reads a partial file.
+func (s *checkpointStore) save(deliveryName string, cp *kinesisCheckpoint) error {
+	if s == nil {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	name := s.file(deliveryName)
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// remove deletes the checkpoint, so that a stream created again with the same name starts over.
+func (s *checkpointStore) remove(deliveryName string) error {
+	if s == nil {
+		return nil
+	}
+	if err := os.Remove(s.file(deliveryName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// checkpointer advances the checkpoint of a Kinesis source as its records are delivered.
+// Batches may finish out of order, so each shard commits only up to the first record not delivered yet.
+type checkpointer struct {
+	mutex        sync.Mutex
+	store        *checkpointStore
+	deliveryName string
+	checkpoint   *kinesisCheckpoint
+	shards       map[string]*shardProgress
+}
+
+// shardProgress numbers records read from a shard, and commits the sequence number of
+// the last record of the delivered prefix.
+type shardProgress struct {
+	read      uint64
+	committed uint64
+	delivered map[uint64]string
+	// dropped is the index of the first record dropped without delivery, if any.
+	// The checkpoint never passes it, so records after it are not kept.
+	dropped *uint64
+}
+
+// sourcePosition is where a record is read from, acknowledged once the record is delivered.
+type sourcePosition struct {
+	checkpointer *checkpointer
+	shardID      string
+	index        uint64
+	sequence     string
+}
+
+func newCheckpointer(store *checkpointStore, deliveryName string, cp *kinesisCheckpoint) *checkpointer {
+	return &checkpointer{
+		store:        store,
+		deliveryName: deliveryName,
+		checkpoint:   cp,
+		shards:       map[string]*shardProgress{},
+	}
+}
+
+// read returns position of the next record read from shardID.
+// sequence is empty for user records but the last of an aggregated record,
+// so that the checkpoint never skips user records not delivered yet.
+func (c *checkpointer) read(shardID, sequence string) *sourcePosition {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	p, ok := c.shards[shardID]
+	if !ok {
+		p = &shardProgress{delivered: map[uint64]string{}}
+		c.shards[shardID] = p
+	}
+	pos := &sourcePosition{checkpointer: c, shardID: shardID, index: p.read, sequence: sequence}
+	p.read++
+	return pos
+}
+
+// sequence returns the sequence number committed for shardID.
+func (c *checkpointer) sequence(shardID string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	seq, ok := c.checkpoint.Shards[shardID]
+	return seq, ok
+}
+
+// acknowledge commits positions and saves the checkpoint when it advances.
+func (c *checkpointer) acknowledge(positions []*sourcePosition) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	advanced := false
+	for _, pos := range positions {
+		p := c.shards[pos.shardID]
+		if p.dropped != nil && pos.index > *p.dropped {
+			continue
+		}
+		p.delivered[pos.index] = pos.sequence
+		for {
+			seq, ok := p.delivered[p.committed]
+			if !ok {
+				break
+			}
+			delete(p.delivered, p.committed)
+			p.committed++
+			if seq != "" {
+				c.checkpoint.Shards[pos.shardID] = seq
+				advanced = true
+			}
+		}
+	}
+	if !advanced {
+		return nil
+	}
+	return c.store.save(c.deliveryName, c.checkpoint)
+}
+
+// abandon marks positions dropped without delivery. The checkpoint of their shards stops before them
+// until restart, which reads them again.
+func (c *checkpointer) abandon(positions []*sourcePosition) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, pos := range positions {
+		p := c.shards[pos.shardID]
+		if pos.index < p.committed || (p.dropped != nil && *p.dropped <= pos.index) {
+			continue
+		}
+		if p.dropped == nil {
+			log.Warn().Str("delivery_stream", c.deliveryName).Str("shard_id", pos.shardID).
+				Msg("records are dropped. checkpoint of the shard stops before them until restart")
+		}
+		index := pos.index
+		p.dropped = &index
+		for i := range p.delivered {
+			if i > index {
+				delete(p.delivered, i)
+			}
+		}
+	}
+}
+
+// sourcePositions groups positions of records by checkpointer.
+func sourcePositions(records []*DeliveryRecord) map[*checkpointer][]*sourcePosition {
+	var positions map[*checkpointer][]*sourcePosition
+	for _, rec := range records {
+		if rec.source == nil {
+			continue
+		}
+		if positions == nil {
+			positions = map[*checkpointer][]*sourcePosition{}
+		}
+		positions[rec.source.checkpointer] = append(positions[rec.source.checkpointer], rec.source)
+	}
+	return positions
+}
+
+// acknowledge tells sources of records that they are delivered, or kept for redelivery.
+func acknowledge(records []*DeliveryRecord) {
+	for c, pos := range sourcePositions(records) {
+		if err := c.acknowledge(pos); err != nil {
+			log.Error().Err(err).Str("delivery_stream", c.deliveryName).Msg("failed to save checkpoint")
+		}
+	}
+}
+
+// abandon tells sources of records that they are dropped.
+func abandon(records []*DeliveryRecord) {
+	for c, pos := range sourcePositions(records) {
+		c.abandon(pos)
+	}
+}
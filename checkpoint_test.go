@@ -0,0 +1,207 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// shardSource sends records read from a shard once, like kinesisConsumer does.
+type shardSource struct {
+	checkpoints *checkpointer
+	sequences   []string
+}
+
+func (s *shardSource) Run(ctx context.Context, recordCh chan<- *DeliveryRecord) {
+	for _, seq := range s.sequences {
+		rec := NewDeliveryRecord([]byte(seq + "\n"))
+		rec.source = s.checkpoints.read("shardId-000000000000", seq)
+		select {
+		case recordCh <- rec:
+		case <-ctx.Done():
+			return
+		}
+	}
+	<-ctx.Done()
+}
+
+func (s *shardSource) Description() fhtypes.SourceDescription {
+	return fhtypes.SourceDescription{}
+}
+
+func TestCheckpoint(t *testing.T) {
+	startedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	newCheckpoint := func() *kinesisCheckpoint {
+		return &kinesisCheckpoint{
+			KinesisStreamARN:       "arn:aws:kinesis:us-east-1:XXXXXXXX:stream/checkpoint",
+			DeliveryStartTimestamp: startedAt,
+			Shards:                 map[string]string{},
+		}
+	}
+
+	t.Run("commits delivered prefix", func(t *testing.T) {
+		store := newCheckpointStore(t.TempDir())
+		c := newCheckpointer(store, "checkpoint-prefix", newCheckpoint())
+		first, second, third := c.read("shard-0", "1"), c.read("shard-0", "2"), c.read("shard-0", "3")
+		other := c.read("shard-1", "100")
+
+		if err := c.acknowledge([]*sourcePosition{second, other}); err != nil {
+			t.Fatal(err)
+		}
+		cp, err := store.load("checkpoint-prefix")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := cp.Shards["shard-0"]; ok || cp.Shards["shard-1"] != "100" {
+			t.Errorf("shard is committed past undelivered record: %#v", cp.Shards)
+		}
+		if err := c.acknowledge([]*sourcePosition{first}); err != nil {
+			t.Fatal(err)
+		}
+		if cp, _ := store.load("checkpoint-prefix"); cp.Shards["shard-0"] != "2" {
+			t.Errorf("unexpected sequence number: %#v", cp.Shards)
+		}
+		if err := c.acknowledge([]*sourcePosition{third}); err != nil {
+			t.Fatal(err)
+		}
+		cp, _ = store.load("checkpoint-prefix")
+		if cp.Shards["shard-0"] != "3" || !cp.DeliveryStartTimestamp.Equal(startedAt) {
+			t.Errorf("unexpected checkpoint: %#v", cp)
+		}
+
+		if err := store.remove("checkpoint-prefix"); err != nil {
+			t.Fatal(err)
+		}
+		if cp, err := store.load("checkpoint-prefix"); cp != nil || err != nil {
+			t.Errorf("checkpoint is not removed: %#v, %v", cp, err)
+		}
+	})
+
+	t.Run("aggregated record", func(t *testing.T) {
+		store := newCheckpointStore(t.TempDir())
+		c := newCheckpointer(store, "checkpoint-aggregated", newCheckpoint())
+		// user records but the last of an aggregated record carry no sequence number.
+		first, last := c.read("shard-0", ""), c.read("shard-0", "1")
+		if err := c.acknowledge([]*sourcePosition{first}); err != nil {
+			t.Fatal(err)
+		}
+		if cp, _ := store.load("checkpoint-aggregated"); cp != nil {
+			t.Errorf("checkpoint is saved before the aggregated record is delivered: %#v", cp)
+		}
+		if err := c.acknowledge([]*sourcePosition{last}); err != nil {
+			t.Fatal(err)
+		}
+		if cp, _ := store.load("checkpoint-aggregated"); cp == nil || cp.Shards["shard-0"] != "1" {
+			t.Errorf("unexpected checkpoint: %#v", cp)
+		}
+	})
+
+	t.Run("dropped batch", func(t *testing.T) {
+		store := newCheckpointStore(t.TempDir())
+		c := newCheckpointer(store, "checkpoint-dropped", newCheckpoint())
+		first, second, third, fourth := c.read("shard-0", "1"), c.read("shard-0", "2"), c.read("shard-0", "3"), c.read("shard-0", "4")
+		c.abandon([]*sourcePosition{second, third})
+		if err := c.acknowledge([]*sourcePosition{fourth, first}); err != nil {
+			t.Fatal(err)
+		}
+		if cp, _ := store.load("checkpoint-dropped"); cp == nil || cp.Shards["shard-0"] != "1" {
+			t.Errorf("checkpoint should stop before dropped record: %#v", cp)
+		}
+		if p := c.shards["shard-0"]; len(p.delivered) != 0 {
+			t.Errorf("records after dropped one are kept: %v", p.delivered)
+		}
+	})
+
+	t.Run("without directory", func(t *testing.T) {
+		store := newCheckpointStore("")
+		c := newCheckpointer(store, "checkpoint-none", newCheckpoint())
+		if err := c.acknowledge([]*sourcePosition{c.read("shard-0", "1")}); err != nil {
+			t.Error(err)
+		}
+		if cp, err := store.load("checkpoint-none"); cp != nil || err != nil {
+			t.Errorf("unexpected checkpoint: %#v, %v", cp, err)
+		}
+	})
+
+	t.Run("advances when destination delivers", func(t *testing.T) {
+		ctx := context.Background()
+		store := newCheckpointStore(t.TempDir())
+		src := &shardSource{
+			checkpoints: newCheckpointer(store, "checkpoint-delivery", newCheckpoint()),
+			sequences:   []string{"10", "20", "30"},
+		}
+		d := NewDispatcher(&DispatcherConfig{
+			AWSConf: awsConfig(t),
+			S3InjectedConf: S3InjectedConf{
+				InMemory: true,
+			},
+			Sources: map[fhtypes.DeliveryStreamType]SourceFactory{
+				fhtypes.DeliveryStreamTypeMSKAsSource: func(ctx context.Context, i *firehose.CreateDeliveryStreamInput) (Source, error) {
+					return src, nil
+				},
+			},
+		})
+		if _, err := d.Service().Create(ctx, &firehose.CreateDeliveryStreamInput{
+			DeliveryStreamName: aws.String("checkpoint-delivery"),
+			DeliveryStreamType: fhtypes.DeliveryStreamTypeMSKAsSource,
+			S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+				BucketARN: aws.String("arn:aws:s3:::checkpoint-bucket"),
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 50; i++ {
+			if st, _ := d.BufferStatus(ctx, "checkpoint-delivery"); st.Records == len(src.sequences) {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if cp, _ := store.load("checkpoint-delivery"); cp != nil {
+			t.Errorf("checkpoint is saved before delivery: %#v", cp)
+		}
+		if err := d.Flush(ctx, "checkpoint-delivery"); err != nil {
+			t.Fatal(err)
+		}
+		cp, err := store.load("checkpoint-delivery")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cp == nil || cp.Shards["shardId-000000000000"] != "30" {
+			t.Errorf("unexpected checkpoint: %#v", cp)
+		}
+	})
+	t.Run("stream name can not escape directory", func(t *testing.T) {
+		parent := t.TempDir()
+		checkpointDir := filepath.Join(parent, "checkpoints")
+		d := NewDispatcher(&DispatcherConfig{
+			AWSConf:             awsConfig(t),
+			S3InjectedConf:      S3InjectedConf{InMemory: true},
+			KinesisInjectedConf: KinesisInjectedConf{CheckpointDir: checkpointDir},
+		})
+		_, err := d.Service().Create(context.Background(), &firehose.CreateDeliveryStreamInput{
+			DeliveryStreamName: aws.String("../escaped"),
+			DeliveryStreamType: fhtypes.DeliveryStreamTypeKinesisStreamAsSource,
+			KinesisStreamSourceConfiguration: &fhtypes.KinesisStreamSourceConfiguration{
+				KinesisStreamARN: aws.String("arn:aws:kinesis:us-east-1:XXXXXXXX:stream/checkpoint"),
+				RoleARN:          aws.String("foo"),
+			},
+			S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+				BucketARN: aws.String("arn:aws:s3:::checkpoint-bucket"),
+			},
+		})
+		var invalidArg *fhtypes.InvalidArgumentException
+		if !errors.As(err, &invalidArg) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if entries, _ := os.ReadDir(parent); len(entries) != 0 {
+			t.Errorf("checkpoint is written outside of directory: %v", entries)
+		}
+	})
+}
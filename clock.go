@@ -0,0 +1,298 @@
+package toyhose
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/google/uuid"
+)
+
+// Clock provides current time and tickers to toyhose components.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the subset of time.Ticker used by toyhose.
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// IDGenerator provides record IDs and object key suffixes.
+type IDGenerator interface {
+	NewID() string
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+type randomIDGenerator struct{}
+
+func (randomIDGenerator) NewID() string {
+	return uuid.New().String()
+}
+
+// randomString returns the value of !{firehose:random-string}.
+func randomString(ids IDGenerator) string {
+	return strings.ReplaceAll(newID(ids), "-", "")[:11]
+}
+
+// VirtualClock is Clock which moves only by Advance.
+// Tickers fire synchronously inside Advance, so that intervals elapse instantly.
+type VirtualClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers map[*virtualTicker]struct{}
+	// advancing serializes Advance, which releases mutex while firing tickers.
+	advancing sync.Mutex
+}
+
+// NewVirtualClock returns VirtualClock starting at start.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{
+		now:     start,
+		tickers: map[*virtualTicker]struct{}{},
+	}
+}
+
+// Now returns current virtual time.
+func (c *VirtualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// NewTicker returns Ticker which fires when Advance passes its period.
+func (c *VirtualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for VirtualClock.NewTicker")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &virtualTicker{
+		clock:  c,
+		ch:     make(chan time.Time),
+		period: d,
+		next:   c.now.Add(d),
+		done:   make(chan struct{}),
+	}
+	c.tickers[t] = struct{}{}
+	return t
+}
+
+// earliest returns the ticker which fires first until target.
+func (c *VirtualClock) earliest(target time.Time) *virtualTicker {
+	var found *virtualTicker
+	for t := range c.tickers {
+		if t.next.After(target) {
+			continue
+		}
+		if found == nil || t.next.Before(found.next) {
+			found = t
+		}
+	}
+	return found
+}
+
+// Advance moves the clock forward by d, firing tickers in chronological order.
+// Each tick is handed to its receiver before Advance moves further.
+func (c *VirtualClock) Advance(ctx context.Context, d time.Duration) error {
+	c.advancing.Lock()
+	defer c.advancing.Unlock()
+	c.mutex.Lock()
+	target := c.now.Add(d)
+	for {
+		t := c.earliest(target)
+		if t == nil {
+			break
+		}
+		c.now = t.next
+		t.next = t.next.Add(t.period)
+		now := c.now
+		c.mutex.Unlock()
+		select {
+		case t.ch <- now:
+		case <-t.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		c.mutex.Lock()
+	}
+	c.now = target
+	c.mutex.Unlock()
+	return nil
+}
+
+type virtualTicker struct {
+	clock    *VirtualClock
+	ch       chan time.Time
+	period   time.Duration
+	next     time.Time
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (t *virtualTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *virtualTicker) Reset(d time.Duration) {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	t.period = d
+	t.next = t.clock.now.Add(d)
+}
+
+func (t *virtualTicker) Stop() {
+	t.stopOnce.Do(func() {
+		t.clock.mutex.Lock()
+		delete(t.clock.tickers, t)
+		t.clock.mutex.Unlock()
+		close(t.done)
+	})
+}
+
+// seededIDGenerator generates reproducible UUIDs from seed.
+type seededIDGenerator struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+// NewSeededIDGenerator returns IDGenerator which yields the same sequence of UUIDs for the same seed.
+func NewSeededIDGenerator(seed int64) IDGenerator {
+	return &seededIDGenerator{
+		rand: rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (g *seededIDGenerator) NewID() string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	id, err := uuid.NewRandomFromReader(g.rand)
+	if err != nil {
+		// math/rand never fails to read.
+		panic(err)
+	}
+	return id.String()
+}
+
+// ClockStatus represents current time of Dispatcher clock.
+type ClockStatus struct {
+	Now     time.Time `json:"now"`
+	Virtual bool      `json:"virtual"`
+}
+
+// Clock returns current time of Dispatcher clock.
+func (d *Dispatcher) Clock() ClockStatus {
+	_, virtual := d.clock.(*VirtualClock)
+	return ClockStatus{
+		Now:     d.clock.Now(),
+		Virtual: virtual,
+	}
+}
+
+// AdvanceClock moves VirtualClock forward by duration and waits for destinations to handle fired intervals.
+func (d *Dispatcher) AdvanceClock(ctx context.Context, duration time.Duration) (ClockStatus, error) {
+	vc, ok := d.clock.(*VirtualClock)
+	if !ok {
+		return ClockStatus{}, &types.InvalidArgumentException{Message: aws.String("clock is not virtual")}
+	}
+	if duration < 0 {
+		return ClockStatus{}, &types.InvalidArgumentException{Message: aws.String("duration must not be negative")}
+	}
+	// records accepted so far should be buffered before intervals elapse.
+	for _, ds := range d.pool.All() {
+		if err := ds.sync(ctx); err != nil {
+			return ClockStatus{}, err
+		}
+	}
+	if err := vc.Advance(ctx, duration); err != nil {
+		return ClockStatus{}, err
+	}
+	// Run loop of destination handles commands one by one,
+	// so a round trip of BufferStatus ensures the last tick has been handled.
+	for _, ds := range d.pool.All() {
+		if bi, ok := ds.destination.(BufferInspector); ok {
+			if _, err := bi.BufferStatus(ctx); err != nil {
+				return ClockStatus{}, fmt.Errorf("failed to wait %s: %w", ds.deliveryStreamName, err)
+			}
+		}
+		if w, ok := ds.destination.(deliveryWaiter); ok {
+			if err := w.waitDeliveries(ctx); err != nil {
+				return ClockStatus{}, fmt.Errorf("failed to wait %s: %w", ds.deliveryStreamName, err)
+			}
+		}
+	}
+	return d.Clock(), nil
+}
+
+func (d *Dispatcher) registerClockHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET "+AdminPathPrefix+"clock", func(w http.ResponseWriter, r *http.Request) {
+		outputForJSON(w, d.Clock(), nil)
+	})
+	mux.HandleFunc("POST "+AdminPathPrefix+"clock/advance", func(w http.ResponseWriter, r *http.Request) {
+		duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+		if err != nil {
+			outputForJSON(w, nil, &types.InvalidArgumentException{Message: aws.String("duration must be Go duration such as 30s")})
+			return
+		}
+		st, err := d.AdvanceClock(r.Context(), duration)
+		outputForJSON(w, st, err)
+	})
+}
+
+// clockNow is nil-safe Clock.Now for components built without Clock.
+func clockNow(c Clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// newTicker is nil-safe Clock.NewTicker for components built without Clock.
+func newTicker(c Clock, d time.Duration) Ticker {
+	if c == nil {
+		c = realClock{}
+	}
+	return c.NewTicker(d)
+}
+
+// newID is nil-safe IDGenerator.NewID for components built without IDGenerator.
+func newID(g IDGenerator) string {
+	if g == nil {
+		return uuid.New().String()
+	}
+	return g.NewID()
+}
+
+func newDeliveryRecord(data []byte, c Clock, g IDGenerator) *DeliveryRecord {
+	return &DeliveryRecord{
+		ID:        newID(g),
+		Data:      data,
+		ArrivedAt: clockNow(c),
+	}
+}
@@ -0,0 +1,165 @@
+package toyhose
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestVirtualClock(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewVirtualClock(start)
+	ticker := clock.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	var ticks []time.Time
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ts := range ticker.C() {
+			ticks = append(ticks, ts)
+			if len(ticks) == 3 {
+				return
+			}
+		}
+	}()
+	if err := clock.Advance(ctx, 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := clock.Advance(ctx, 150*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	expected := []time.Time{start.Add(time.Minute), start.Add(2 * time.Minute), start.Add(3 * time.Minute)}
+	for i, ts := range ticks {
+		if !ts.Equal(expected[i]) {
+			t.Errorf("unexpected tick %d: %s", i, ts)
+		}
+	}
+	if now := clock.Now(); !now.Equal(start.Add(3 * time.Minute)) {
+		t.Errorf("unexpected now: %s", now)
+	}
+}
+
+func TestSeededIDGenerator(t *testing.T) {
+	a, b := NewSeededIDGenerator(42), NewSeededIDGenerator(42)
+	for i := 0; i < 3; i++ {
+		if x, y := a.NewID(), b.NewID(); x != y {
+			t.Errorf("IDs differ with the same seed: %s, %s", x, y)
+		}
+	}
+	if x, y := NewSeededIDGenerator(1).NewID(), NewSeededIDGenerator(2).NewID(); x == y {
+		t.Errorf("IDs are the same with different seeds: %s", x)
+	}
+}
+
+func TestDeterministicMode(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// requests is the number of extra API requests served before records are put.
+	run := func(t *testing.T, requests int) (string, []string) {
+		t.Helper()
+		d := NewDispatcher(&DispatcherConfig{
+			AWSConf: awsConfig(t),
+			S3InjectedConf: S3InjectedConf{
+				InMemory: true,
+			},
+			Clock:       NewVirtualClock(start),
+			IDGenerator: NewSeededIDGenerator(42),
+		})
+		testserver := httptest.NewServer(d.AdminHandler())
+		defer testserver.Close()
+
+		svc := d.Service()
+		streamName := "deterministic-stream"
+		if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+			DeliveryStreamName: &streamName,
+			S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+				BucketARN: aws.String("arn:aws:s3:::deterministic-bucket"),
+				Prefix:    aws.String("data/!{firehose:random-string}/"),
+				BufferingHints: &fhtypes.BufferingHints{
+					SizeInMBs:         aws.Int32(1),
+					IntervalInSeconds: aws.Int32(60),
+				},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// make sure that Run loop has started its ticker.
+		if _, err := d.BufferStatus(ctx, streamName); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < requests; i++ {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+			req.Header.Set("X-Amz-Target", "Firehose_20150804.ListDeliveryStreams")
+			rec := httptest.NewRecorder()
+			d.Dispatch(rec, req)
+			if rec.Header().Get("x-amzn-RequestId") == "" {
+				t.Fatal("request ID is not returned")
+			}
+		}
+		out, err := svc.PutBatch(ctx, &firehose.PutRecordBatchInput{
+			DeliveryStreamName: &streamName,
+			Records: []fhtypes.Record{
+				{Data: []byte("hello!\n")},
+				{Data: []byte("world!\n")},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recordIDs := []string{*out.RequestResponses[0].RecordId, *out.RequestResponses[1].RecordId}
+
+		res, err := http.Post(testserver.URL+AdminPathPrefix+"clock/advance?duration=59s", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if l := len(d.Deliveries(streamName)); l != 0 {
+			t.Fatalf("delivered before interval: %d", l)
+		}
+		res, err = http.Post(testserver.URL+AdminPathPrefix+"clock/advance?duration=1s", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status: %d", res.StatusCode)
+		}
+		deliveries := d.Deliveries(streamName)
+		if len(deliveries) != 1 {
+			t.Fatalf("not delivered after interval: %d", len(deliveries))
+		}
+		if !deliveries[0].DeliveredAt.Equal(start.Add(time.Minute)) {
+			t.Errorf("unexpected DeliveredAt: %s", deliveries[0].DeliveredAt)
+		}
+		return deliveries[0].Key, recordIDs
+	}
+
+	key1, ids1 := run(t, 0)
+	key2, ids2 := run(t, 3)
+	if key1 != key2 {
+		t.Errorf("keys are not reproducible: %s, %s", key1, key2)
+	}
+	if !strings.Contains(key1, "deterministic-stream-1-2020-01-01-00-01-00-") {
+		t.Errorf("key does not follow virtual clock: %s", key1)
+	}
+	if ids1[0] != ids2[0] || ids1[1] != ids2[1] {
+		t.Errorf("record IDs are not reproducible: %v, %v", ids1, ids2)
+	}
+
+	t.Run("real clock can not be advanced", func(t *testing.T) {
+		d := NewDispatcher(&DispatcherConfig{AWSConf: awsConfig(t)})
+		if _, err := d.AdvanceClock(ctx, time.Second); err == nil {
+			t.Error("real clock is advanced")
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package toyhose
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwltypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/smithy-go"
+)
+
+type cloudWatchLogsAPI interface {
+	CreateLogGroup(ctx context.Context, params *cloudwatchlogs.CreateLogGroupInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogGroupOutput, error)
+	CreateLogStream(ctx context.Context, params *cloudwatchlogs.CreateLogStreamInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogStreamOutput, error)
+	PutLogEvents(ctx context.Context, params *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error)
+}
+
+// deliveryErrorEvent is error log event in the format Firehose writes to CloudWatch Logs.
+type deliveryErrorEvent struct {
+	DeliveryStreamARN       string `json:"deliveryStreamARN"`
+	Destination             string `json:"destination"`
+	DeliveryStreamVersionID int    `json:"deliveryStreamVersionId"`
+	Message                 string `json:"message"`
+	ErrorCode               string `json:"errorCode"`
+}
+
+// fallbackLogLine is a line of fallback JSONL file, written when CloudWatch Logs is not available.
+type fallbackLogLine struct {
+	LogGroupName  string `json:"logGroupName"`
+	LogStreamName string `json:"logStreamName"`
+	Timestamp     int64  `json:"timestamp"`
+	Message       string `json:"message"`
+}
+
+// errorLogger writes error log events to CloudWatch Logs, or to fallback file when it fails.
+type errorLogger struct {
+	cli          cloudWatchLogsAPI
+	fallbackPath string
+	clock        Clock
+	// mu guards streams and appends to fallback file.
+	mu sync.Mutex
+	// streams serializes events per log stream, so that a slow log stream does not hold others.
+	streams map[[2]string]*sync.Mutex
+}
+
+func newErrorLogger(conf aws.Config, cwConf CloudWatchConf, clock Clock) *errorLogger {
+	l := &errorLogger{
+		fallbackPath: cwConf.LogsFallbackPath,
+		clock:        clock,
+	}
+	if cwConf.LogsEndpoint != nil {
+		l.cli = cloudwatchlogs.NewFromConfig(conf, func(o *cloudwatchlogs.Options) {
+			o.BaseEndpoint = cwConf.LogsEndpoint
+		})
+	}
+	return l
+}
+
+func (l *errorLogger) put(ctx context.Context, group, stream string, event cwltypes.InputLogEvent) error {
+	input := &cloudwatchlogs.PutLogEventsInput{
+		LogGroupName:  &group,
+		LogStreamName: &stream,
+		LogEvents:     []cwltypes.InputLogEvent{event},
+	}
+	_, err := l.cli.PutLogEvents(ctx, input)
+	var notFound *cwltypes.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return err
+	}
+	// local endpoints start empty, so log group and stream are created on demand.
+	var exists *cwltypes.ResourceAlreadyExistsException
+	if _, err := l.cli.CreateLogGroup(ctx, &cloudwatchlogs.CreateLogGroupInput{LogGroupName: &group}); err != nil && !errors.As(err, &exists) {
+		return err
+	}
+	if _, err := l.cli.CreateLogStream(ctx, &cloudwatchlogs.CreateLogStreamInput{LogGroupName: &group, LogStreamName: &stream}); err != nil && !errors.As(err, &exists) {
+		return err
+	}
+	_, err = l.cli.PutLogEvents(ctx, input)
+	return err
+}
+
+func (l *errorLogger) streamLock(group, stream string) *sync.Mutex {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.streams == nil {
+		l.streams = map[[2]string]*sync.Mutex{}
+	}
+	key := [2]string{group, stream}
+	mu, ok := l.streams[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		l.streams[key] = mu
+	}
+	return mu
+}
+
+func (l *errorLogger) writeFallback(line fallbackLogLine) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.fallbackPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+func (l *errorLogger) emit(ctx context.Context, opts *types.CloudWatchLoggingOptions, ts time.Time, ev deliveryErrorEvent) {
+	if l == nil || opts == nil || !aws.ToBool(opts.Enabled) {
+		return
+	}
+	group, stream := aws.ToString(opts.LogGroupName), aws.ToString(opts.LogStreamName)
+	b, _ := json.Marshal(ev)
+	msg := string(b)
+	if l.cli != nil {
+		mu := l.streamLock(group, stream)
+		mu.Lock()
+		err := l.put(ctx, group, stream, cwltypes.InputLogEvent{
+			Message:   &msg,
+			Timestamp: aws.Int64(ts.UnixMilli()),
+		})
+		mu.Unlock()
+		if err == nil {
+			return
+		}
+		log.Debug().Err(err).Str("log_group", group).Msg("PutLogEvents failed")
+	}
+	if l.fallbackPath == "" {
+		log.Debug().Str("log_group", group).Str("log_stream", stream).Msg(msg)
+		return
+	}
+	if err := l.writeFallback(fallbackLogLine{
+		LogGroupName:  group,
+		LogStreamName: stream,
+		Timestamp:     ts.UnixMilli(),
+		Message:       msg,
+	}); err != nil {
+		log.Debug().Err(err).Str("path", l.fallbackPath).Msg("failed to write fallback log")
+	}
+}
+
+// streamErrorLogger binds errorLogger to CloudWatchLoggingOptions of a destination.
+type streamErrorLogger struct {
+	logger      *errorLogger
+	opts        *types.CloudWatchLoggingOptions
+	streamARN   string
+	destination string
+}
+
+// deliveryFailed emits error log event of failed delivery. nil receiver does nothing.
+func (s *streamErrorLogger) deliveryFailed(ctx context.Context, codePrefix string, err error) {
+	if s == nil {
+		return
+	}
+	code := "InternalError"
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code = apiErr.ErrorCode()
+	}
+	s.logger.emit(ctx, s.opts, clockNow(s.logger.clock), deliveryErrorEvent{
+		DeliveryStreamARN:       s.streamARN,
+		Destination:             s.destination,
+		DeliveryStreamVersionID: 1,
+		Message:                 err.Error(),
+		ErrorCode:               codePrefix + "." + code,
+	})
+}
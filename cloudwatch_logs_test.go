@@ -0,0 +1,171 @@
+package toyhose
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwltypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/smithy-go"
+)
+
+type fakeCloudWatchLogs struct {
+	streams map[string][]string
+	err     error
+}
+
+func (f *fakeCloudWatchLogs) CreateLogGroup(ctx context.Context, params *cloudwatchlogs.CreateLogGroupInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	return &cloudwatchlogs.CreateLogGroupOutput{}, nil
+}
+
+func (f *fakeCloudWatchLogs) CreateLogStream(ctx context.Context, params *cloudwatchlogs.CreateLogStreamInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	f.streams[*params.LogGroupName+"/"+*params.LogStreamName] = []string{}
+	return &cloudwatchlogs.CreateLogStreamOutput{}, nil
+}
+
+func (f *fakeCloudWatchLogs) PutLogEvents(ctx context.Context, params *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	key := *params.LogGroupName + "/" + *params.LogStreamName
+	events, ok := f.streams[key]
+	if !ok {
+		return nil, &cwltypes.ResourceNotFoundException{Message: aws.String("not found")}
+	}
+	for _, ev := range params.LogEvents {
+		events = append(events, *ev.Message)
+	}
+	f.streams[key] = events
+	return &cloudwatchlogs.PutLogEventsOutput{}, nil
+}
+
+func TestErrorLogger(t *testing.T) {
+	ctx := context.Background()
+	opts := &fhtypes.CloudWatchLoggingOptions{
+		Enabled:       aws.Bool(true),
+		LogGroupName:  aws.String("/aws/kinesisfirehose/log-stream"),
+		LogStreamName: aws.String("DestinationDelivery"),
+	}
+	failure := &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}
+	streamLogger := func(l *errorLogger, opts *fhtypes.CloudWatchLoggingOptions) *streamErrorLogger {
+		return &streamErrorLogger{
+			logger:      l,
+			opts:        opts,
+			streamARN:   "arn:aws:firehose:us-east-1::deliverystream/log-stream",
+			destination: "arn:aws:s3:::log-bucket",
+		}
+	}
+
+	t.Run("put to CloudWatch Logs", func(t *testing.T) {
+		cwl := &fakeCloudWatchLogs{streams: map[string][]string{}}
+		streamLogger(&errorLogger{cli: cwl}, opts).deliveryFailed(ctx, "S3", failure)
+		events := cwl.streams["/aws/kinesisfirehose/log-stream/DestinationDelivery"]
+		if len(events) != 1 {
+			t.Fatalf("unexpected events: %v", events)
+		}
+		var ev deliveryErrorEvent
+		if err := json.Unmarshal([]byte(events[0]), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.ErrorCode != "S3.AccessDenied" || ev.Destination != "arn:aws:s3:::log-bucket" || ev.DeliveryStreamARN == "" || ev.Message == "" {
+			t.Errorf("unexpected event: %#v", ev)
+		}
+	})
+
+	t.Run("fallback to file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "errors.jsonl")
+		cwl := &fakeCloudWatchLogs{streams: map[string][]string{}, err: errors.New("unavailable")}
+		l := &errorLogger{cli: cwl, fallbackPath: path}
+		streamLogger(l, opts).deliveryFailed(ctx, "S3", failure)
+		streamLogger(&errorLogger{fallbackPath: path}, opts).deliveryFailed(ctx, "S3", errors.New("timeout"))
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var codes []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var line fallbackLogLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Fatal(err)
+			}
+			if line.LogGroupName != *opts.LogGroupName || line.LogStreamName != *opts.LogStreamName {
+				t.Errorf("unexpected line: %#v", line)
+			}
+			var ev deliveryErrorEvent
+			if err := json.Unmarshal([]byte(line.Message), &ev); err != nil {
+				t.Fatal(err)
+			}
+			codes = append(codes, ev.ErrorCode)
+		}
+		if len(codes) != 2 || codes[0] != "S3.AccessDenied" || codes[1] != "S3.InternalError" {
+			t.Errorf("unexpected error codes: %v", codes)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "errors.jsonl")
+		streamLogger(&errorLogger{fallbackPath: path}, &fhtypes.CloudWatchLoggingOptions{Enabled: aws.Bool(false)}).deliveryFailed(ctx, "S3", failure)
+		streamLogger(&errorLogger{fallbackPath: path}, nil).deliveryFailed(ctx, "S3", failure)
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("log is written though logging is disabled: %v", err)
+		}
+	})
+}
+
+// gatedCloudWatchLogs holds PutLogEvents of slowGroup until gate is closed.
+type gatedCloudWatchLogs struct {
+	fakeCloudWatchLogs
+	slowGroup string
+	entered   chan struct{}
+	gate      chan struct{}
+}
+
+func (f *gatedCloudWatchLogs) PutLogEvents(ctx context.Context, params *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	if *params.LogGroupName == f.slowGroup {
+		close(f.entered)
+		<-f.gate
+	}
+	return &cloudwatchlogs.PutLogEventsOutput{}, nil
+}
+
+func TestErrorLoggerSlowLogStream(t *testing.T) {
+	ctx := context.Background()
+	cwl := &gatedCloudWatchLogs{slowGroup: "slow-group", entered: make(chan struct{}), gate: make(chan struct{})}
+	l := &errorLogger{cli: cwl}
+	emit := func(group string) {
+		l.emit(ctx, &fhtypes.CloudWatchLoggingOptions{
+			Enabled:       aws.Bool(true),
+			LogGroupName:  aws.String(group),
+			LogStreamName: aws.String("DestinationDelivery"),
+		}, time.Now(), deliveryErrorEvent{Message: "failed"})
+	}
+	slowDone := make(chan struct{})
+	go func() {
+		defer close(slowDone)
+		emit("slow-group")
+	}()
+	<-cwl.entered
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		emit("other-group")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("error log of other stream waits for slow log stream")
+	}
+	close(cwl.gate)
+	<-slowDone
+}
@@ -0,0 +1,268 @@
+package toyhose
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// CloudWatchConf represents configuration of publishing metrics and error logs to CloudWatch compatible endpoints.
+type CloudWatchConf struct {
+	// MetricsEndpoint enables publishing metrics by PutMetricData when supplied.
+	MetricsEndpoint *string
+	// PublishInterval is the period of PutMetricData. The default is 60 seconds.
+	PublishInterval time.Duration
+	// LogsEndpoint is CloudWatch Logs compatible endpoint which receives error logs
+	// of delivery streams enabling CloudWatchLoggingOptions.
+	LogsEndpoint *string
+	// LogsFallbackPath is JSONL file which receives error logs when LogsEndpoint is not supplied or fails.
+	LogsFallbackPath string
+}
+
+const (
+	cloudWatchNamespace = "AWS/Firehose"
+	// PutMetricData accepts up to 1000 metrics per request.
+	cloudWatchMaxDatums = 1000
+)
+
+type cloudWatchAPI interface {
+	PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+type cloudWatchMetric struct {
+	name string
+	unit cwtypes.StandardUnit
+}
+
+// cloudWatchMetrics maps Prometheus metric family to Firehose CloudWatch metric.
+var cloudWatchMetrics = map[string]cloudWatchMetric{
+	metricsNamespace + "_incoming_records_total":                      {"IncomingRecords", cwtypes.StandardUnitCount},
+	metricsNamespace + "_incoming_bytes_total":                        {"IncomingBytes", cwtypes.StandardUnitBytes},
+	metricsNamespace + "_incoming_put_requests_total":                 {"IncomingPutRequests", cwtypes.StandardUnitCount},
+	metricsNamespace + "_throttled_records_total":                     {"ThrottledRecords", cwtypes.StandardUnitCount},
+	metricsNamespace + "_delivery_to_s3_records_total":                {"DeliveryToS3.Records", cwtypes.StandardUnitCount},
+	metricsNamespace + "_delivery_to_s3_bytes_total":                  {"DeliveryToS3.Bytes", cwtypes.StandardUnitBytes},
+	metricsNamespace + "_delivery_to_s3_data_freshness_seconds":       {"DeliveryToS3.DataFreshness", cwtypes.StandardUnitSeconds},
+	metricsNamespace + "_data_read_from_kinesis_stream_records_total": {"DataReadFromKinesisStream.Records", cwtypes.StandardUnitCount},
+	metricsNamespace + "_data_read_from_kinesis_stream_bytes_total":   {"DataReadFromKinesisStream.Bytes", cwtypes.StandardUnitBytes},
+	metricsNamespace + "_kinesis_millis_behind_latest":                {"KinesisMillisBehindLatest", cwtypes.StandardUnitMilliseconds},
+}
+
+const (
+	deliveryToS3SuccessFamily       = metricsNamespace + "_delivery_to_s3_success_total"
+	deliveryToS3AttemptsFamily      = metricsNamespace + "_delivery_to_s3_attempts_total"
+	deliveryToS3DataFreshnessFamily = metricsNamespace + "_delivery_to_s3_data_freshness_seconds"
+)
+
+// metricsPublisher converts cumulative Prometheus metrics to per period CloudWatch metrics.
+type metricsPublisher struct {
+	cli     cloudWatchAPI
+	metrics *metrics
+	// last holds cumulative values published previously, keyed by family and stream name.
+	last map[[2]string]float64
+}
+
+func newMetricsPublisher(cli cloudWatchAPI, m *metrics) *metricsPublisher {
+	return &metricsPublisher{
+		cli:     cli,
+		metrics: m,
+		last:    map[[2]string]float64{},
+	}
+}
+
+// collectedDatum is a datum with what it is computed from, which is kept by publisher
+// only once the datum is published.
+type collectedDatum struct {
+	streamName string
+	datum      cwtypes.MetricDatum
+	// values are cumulative values, which become last.
+	values map[[2]string]float64
+	// freshness is the range taken from metrics, which is given back when publishing fails.
+	freshness *valueRange
+}
+
+func streamNameOf(m *dto.Metric) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == streamLabel[0] {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// delta returns the change of current since the last publish, and keeps current in values.
+func (p *metricsPublisher) delta(values map[[2]string]float64, family, streamName string, current float64) float64 {
+	key := [2]string{family, streamName}
+	values[key] = current
+	return current - p.last[key]
+}
+
+func newDatum(name, streamName string, unit cwtypes.StandardUnit, ts time.Time) cwtypes.MetricDatum {
+	return cwtypes.MetricDatum{
+		MetricName: aws.String(name),
+		Dimensions: []cwtypes.Dimension{
+			{Name: aws.String("DeliveryStreamName"), Value: aws.String(streamName)},
+		},
+		Timestamp: aws.Time(ts),
+		Unit:      unit,
+	}
+}
+
+func (p *metricsPublisher) collect(ts time.Time) ([]collectedDatum, error) {
+	families, err := p.metrics.registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	ranges := p.metrics.takeFreshnessRanges()
+	var datums []collectedDatum
+	type ratio struct {
+		success, attempts float64
+		values            map[[2]string]float64
+	}
+	ratios := map[string]*ratio{}
+	ratioOf := func(streamName string) *ratio {
+		r, ok := ratios[streamName]
+		if !ok {
+			r = &ratio{values: map[[2]string]float64{}}
+			ratios[streamName] = r
+		}
+		return r
+	}
+	for _, mf := range families {
+		family := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			streamName := streamNameOf(m)
+			switch family {
+			case deliveryToS3SuccessFamily:
+				r := ratioOf(streamName)
+				r.success = p.delta(r.values, family, streamName, m.GetCounter().GetValue())
+				continue
+			case deliveryToS3AttemptsFamily:
+				r := ratioOf(streamName)
+				r.attempts = p.delta(r.values, family, streamName, m.GetCounter().GetValue())
+				continue
+			}
+			cwm, ok := cloudWatchMetrics[family]
+			if !ok {
+				continue
+			}
+			c := collectedDatum{
+				streamName: streamName,
+				datum:      newDatum(cwm.name, streamName, cwm.unit, ts),
+				values:     map[[2]string]float64{},
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				c.datum.Value = aws.Float64(p.delta(c.values, family, streamName, m.GetCounter().GetValue()))
+			case dto.MetricType_GAUGE:
+				c.datum.Value = aws.Float64(m.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				count := p.delta(c.values, family+"_count", streamName, float64(h.GetSampleCount()))
+				sum := p.delta(c.values, family+"_sum", streamName, h.GetSampleSum())
+				if count == 0 {
+					continue
+				}
+				// histogram does not keep min and max, so they are approximated by average
+				// unless their range is tracked apart.
+				avg := sum / count
+				r := valueRange{min: avg, max: avg}
+				if family == deliveryToS3DataFreshnessFamily {
+					if taken, ok := ranges[streamName]; ok {
+						r = taken
+						c.freshness = &taken
+					}
+				}
+				c.datum.StatisticValues = &cwtypes.StatisticSet{
+					SampleCount: aws.Float64(count),
+					Sum:         aws.Float64(sum),
+					Minimum:     aws.Float64(r.min),
+					Maximum:     aws.Float64(r.max),
+				}
+			default:
+				continue
+			}
+			datums = append(datums, c)
+		}
+	}
+	for streamName, r := range ratios {
+		if r.attempts == 0 {
+			continue
+		}
+		c := collectedDatum{
+			streamName: streamName,
+			datum:      newDatum("DeliveryToS3.Success", streamName, cwtypes.StandardUnitNone, ts),
+			values:     r.values,
+		}
+		c.datum.Value = aws.Float64(r.success / r.attempts)
+		datums = append(datums, c)
+	}
+	return datums, nil
+}
+
+// publish sends datums by chunks. Values of each chunk are kept as last once it succeeds,
+// so that a failed chunk is carried over to the next publish and succeeded ones are not sent again.
+func (p *metricsPublisher) publish(ctx context.Context, ts time.Time) error {
+	collected, err := p.collect(ts)
+	if err != nil {
+		return err
+	}
+	for len(collected) > 0 {
+		chunk := collected[:min(len(collected), cloudWatchMaxDatums)]
+		collected = collected[len(chunk):]
+		datums := make([]cwtypes.MetricDatum, 0, len(chunk))
+		for _, c := range chunk {
+			datums = append(datums, c.datum)
+		}
+		if _, err := p.cli.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(cloudWatchNamespace),
+			MetricData: datums,
+		}); err != nil {
+			for _, c := range append(chunk, collected...) {
+				if c.freshness != nil {
+					p.metrics.restoreFreshnessRange(c.streamName, *c.freshness)
+				}
+			}
+			return err
+		}
+		for _, c := range chunk {
+			for key, v := range c.values {
+				p.last[key] = v
+			}
+		}
+	}
+	return nil
+}
+
+// PublishMetrics pushes metrics to CloudWatchConf.MetricsEndpoint periodically until ctx is done.
+// It returns immediately when the endpoint is not configured.
+func (d *Dispatcher) PublishMetrics(ctx context.Context) {
+	endpoint := d.cloudWatchConf.MetricsEndpoint
+	if endpoint == nil {
+		return
+	}
+	interval := d.cloudWatchConf.PublishInterval
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
+	cli := cloudwatch.NewFromConfig(d.conf, func(o *cloudwatch.Options) {
+		o.BaseEndpoint = endpoint
+	})
+	p := newMetricsPublisher(cli, d.metrics)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ts := <-ticker.C:
+			if err := p.publish(ctx, ts); err != nil {
+				log.Warn().Err(err).Msg("PutMetricData failed")
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+)
+
+type fakeCloudWatch struct {
+	inputs []*cloudwatch.PutMetricDataInput
+	err    error
+	calls  int
+	// failAt makes only the call of the number, counted from 1, fail with err.
+	failAt int
+}
+
+func (f *fakeCloudWatch) PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error) {
+	f.calls++
+	if f.err != nil && (f.failAt == 0 || f.failAt == f.calls) {
+		return nil, f.err
+	}
+	f.inputs = append(f.inputs, params)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func (f *fakeCloudWatch) values() map[string]float64 {
+	values := map[string]float64{}
+	for _, in := range f.inputs {
+		for _, d := range in.MetricData {
+			if d.Value != nil {
+				values[*d.MetricName] = *d.Value
+			}
+			if d.StatisticValues != nil {
+				values[*d.MetricName] = *d.StatisticValues.SampleCount
+			}
+		}
+	}
+	return values
+}
+
+func TestMetricsPublisher(t *testing.T) {
+	ctx := context.Background()
+	m := newMetrics()
+	cw := &fakeCloudWatch{}
+	p := newMetricsPublisher(cw, m)
+
+	now := time.Now()
+	m.observeIncoming("cw-stream", 2, 14)
+	m.observeDeliveryToS3("cw-stream", []*DeliveryRecord{{ID: "a", ArrivedAt: now}, {ID: "b", ArrivedAt: now}}, 14, now, false)
+	m.observeDeliveryToS3("cw-stream", []*DeliveryRecord{{ID: "a", ArrivedAt: now}, {ID: "b", ArrivedAt: now}}, 14, now, true)
+	if err := p.publish(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(cw.inputs) != 1 {
+		t.Fatalf("unexpected PutMetricData calls: %d", len(cw.inputs))
+	}
+	in := cw.inputs[0]
+	if aws.ToString(in.Namespace) != "AWS/Firehose" {
+		t.Errorf("unexpected namespace: %s", aws.ToString(in.Namespace))
+	}
+	for _, d := range in.MetricData {
+		if len(d.Dimensions) != 1 || aws.ToString(d.Dimensions[0].Name) != "DeliveryStreamName" || aws.ToString(d.Dimensions[0].Value) != "cw-stream" {
+			t.Errorf("unexpected dimensions for %s: %#v", aws.ToString(d.MetricName), d.Dimensions)
+		}
+	}
+	values := cw.values()
+	for name, expected := range map[string]float64{
+		"IncomingRecords":            2,
+		"IncomingBytes":              14,
+		"IncomingPutRequests":        1,
+		"DeliveryToS3.Records":       2,
+		"DeliveryToS3.Bytes":         14,
+		"DeliveryToS3.Success":       0.5,
+		"DeliveryToS3.DataFreshness": 1,
+	} {
+		if v, ok := values[name]; !ok || v != expected {
+			t.Errorf("unexpected %s: %v (found: %v)", name, v, ok)
+		}
+	}
+
+	t.Run("publishes deltas", func(t *testing.T) {
+		cw.inputs = nil
+		m.observeIncoming("cw-stream", 3, 10)
+		if err := p.publish(ctx, now.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		values := cw.values()
+		if v := values["IncomingRecords"]; v != 3 {
+			t.Errorf("unexpected IncomingRecords: %v", v)
+		}
+		if v := values["DeliveryToS3.Records"]; v != 0 {
+			t.Errorf("unexpected DeliveryToS3.Records: %v", v)
+		}
+		if _, ok := values["DeliveryToS3.Success"]; ok {
+			t.Error("DeliveryToS3.Success published without attempts")
+		}
+	})
+
+	t.Run("failed publish is carried over", func(t *testing.T) {
+		cw.inputs = nil
+		cw.err = errors.New("unavailable")
+		m.observeIncoming("cw-stream", 4, 10)
+		if err := p.publish(ctx, now.Add(2*time.Minute)); err == nil {
+			t.Fatal("error is not returned")
+		}
+		cw.err = nil
+		m.observeIncoming("cw-stream", 1, 10)
+		if err := p.publish(ctx, now.Add(3*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if v := cw.values()["IncomingRecords"]; v != 5 {
+			t.Errorf("unexpected IncomingRecords: %v", v)
+		}
+	})
+
+	t.Run("freshness range", func(t *testing.T) {
+		cw.inputs = nil
+		m.observeDeliveryToS3("cw-stream", []*DeliveryRecord{{ID: "c", ArrivedAt: now.Add(-2 * time.Second)}}, 7, now, true)
+		m.observeDeliveryToS3("cw-stream", []*DeliveryRecord{{ID: "d", ArrivedAt: now.Add(-5 * time.Second)}}, 7, now, true)
+		if err := p.publish(ctx, now.Add(4*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range cw.inputs[0].MetricData {
+			if aws.ToString(d.MetricName) != "DeliveryToS3.DataFreshness" {
+				continue
+			}
+			if st := d.StatisticValues; *st.SampleCount != 2 || *st.Minimum != 2 || *st.Maximum != 5 {
+				t.Errorf("unexpected statistic: count=%v, min=%v, max=%v", *st.SampleCount, *st.Minimum, *st.Maximum)
+			}
+			return
+		}
+		t.Error("DataFreshness is not published")
+	})
+}
+
+func TestMetricsPublisherChunks(t *testing.T) {
+	ctx := context.Background()
+	m := newMetrics()
+	cw := &fakeCloudWatch{err: errors.New("unavailable"), failAt: 2}
+	p := newMetricsPublisher(cw, m)
+	// 3 datums per stream, which take two chunks.
+	const streams = 400
+	for i := 0; i < streams; i++ {
+		m.observeIncoming(fmt.Sprintf("chunk-stream-%d", i), 1, 10)
+	}
+	now := time.Now()
+	if err := p.publish(ctx, now); err == nil {
+		t.Fatal("error is not returned")
+	}
+	cw.err = nil
+	if err := p.publish(ctx, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	total := 0.0
+	for _, in := range cw.inputs {
+		for _, d := range in.MetricData {
+			if aws.ToString(d.MetricName) == "IncomingRecords" {
+				total += *d.Value
+			}
+		}
+	}
+	if total != streams {
+		t.Errorf("IncomingRecords are published %v times for %d records", total, streams)
+	}
+}
@@ -13,6 +13,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/caarlos0/env/v6"
 	"github.com/taiyoh/toyhose"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -41,26 +44,86 @@ func main() {
 		log.Fatal().Err(err).Msg("failed to load aws config")
 	}
 
+	var tp trace.TracerProvider
+	if conf.OTLPEndpoint != nil {
+		sdktp, err := toyhose.NewOTLPTracerProvider(context.Background(), *conf.OTLPEndpoint)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to setup tracing")
+		}
+		defer func() {
+			sdCtx, sdCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer sdCancel()
+			if err := sdktp.Shutdown(sdCtx); err != nil {
+				log.Error().Err(err).Msg("failed to flush spans")
+			}
+		}()
+		tp = sdktp
+		// W3C trace context lets producers join their traces.
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	}
+
+	var (
+		clock toyhose.Clock
+		ids   toyhose.IDGenerator
+	)
+	if conf.Deterministic {
+		clock = toyhose.NewVirtualClock(conf.DeterministicStartTime)
+		ids = toyhose.NewSeededIDGenerator(conf.DeterministicSeed)
+	}
+
 	d := toyhose.NewDispatcher(&toyhose.DispatcherConfig{
 		AWSConf: awsConf,
 		S3InjectedConf: toyhose.S3InjectedConf{
-			SizeInMBs:         conf.S3SizeInMBs,
-			IntervalInSeconds: conf.S3IntervalInSeconds,
-			EndPoint:          conf.S3EndPoint,
-			DisableBuffering:  conf.S3DisableBuffering,
+			SizeInMBs:              conf.S3SizeInMBs,
+			IntervalInSeconds:      conf.S3IntervalInSeconds,
+			EndPoint:               conf.S3EndPoint,
+			DisableBuffering:       conf.S3DisableBuffering,
+			InMemory:               conf.S3InMemory,
+			UploadConcurrency:      conf.S3UploadConcurrency,
+			MultipartPartSizeInMBs: conf.S3MultipartPartSizeInMBs,
 		},
 		KinesisInjectedConf: toyhose.KinesisInjectedConf{
-			Endpoint: conf.KinesisEndpoint,
+			Endpoint:               conf.KinesisEndpoint,
+			CheckpointDir:          conf.KinesisCheckpointDir,
+			ShardDiscoveryInterval: conf.KinesisShardDiscoveryInterval,
+			EnhancedFanOut:         conf.KinesisEnhancedFanOut,
+		},
+		CloudWatchConf: toyhose.CloudWatchConf{
+			MetricsEndpoint:  conf.CloudWatchEndpoint,
+			PublishInterval:  time.Duration(conf.CloudWatchPublishIntervalSeconds) * time.Second,
+			LogsEndpoint:     conf.CloudWatchLogsEndpoint,
+			LogsFallbackPath: conf.CloudWatchLogsFallbackPath,
+		},
+		IngestConf: toyhose.IngestConf{
+			MaxBufferedBytesPerStream:   conf.IngestMaxBufferedBytesPerStream,
+			MaxBufferedRecordsPerStream: conf.IngestMaxBufferedRecordsPerStream,
+			MaxBufferedBytesTotal:       conf.IngestMaxBufferedBytesTotal,
 		},
+		RetryConf: toyhose.RetryConf{
+			Duration:           conf.S3RetryDuration,
+			InitialBackoff:     conf.S3RetryInitialBackoff,
+			MaxBackoff:         conf.S3RetryMaxBackoff,
+			SpillDir:           conf.S3SpillDir,
+			RedeliveryInterval: conf.S3RedeliveryInterval,
+		},
+		TracerProvider:   tp,
+		WebhookURLs:      conf.WebhookURLs,
+		Clock:            clock,
+		IDGenerator:      ids,
+		LedgerMaxRecords: conf.LedgerMaxRecords,
 	})
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", d.Dispatch)
+	mux.Handle(toyhose.AdminPathPrefix, d.AdminHandler())
+	mux.Handle("/metrics", d.MetricsHandler())
 
 	srv := &http.Server{
 		Handler: mux,
 		Addr:    fmt.Sprintf(":%d", conf.Port),
 	}
+	// tail streams never become idle, so they are ended for srv.Shutdown to finish.
+	srv.RegisterOnShutdown(d.CloseTail)
 
 	ctx, cancel := signal.NotifyContext(context.Background(),
 		syscall.SIGTERM,
@@ -69,14 +132,29 @@ func main() {
 
 	defer cancel()
 
+	go d.PublishMetrics(ctx)
+
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		<-ctx.Done()
-		sdCtx, sdCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		sdCtx, sdCancel := context.WithTimeout(context.Background(), conf.ShutdownGracePeriod)
 		defer sdCancel()
 		log.Info().Msgf("shutdown process...")
 		if err := srv.Shutdown(sdCtx); err != nil {
 			log.Error().Err(err).Msg("Shutdown process failed")
 		}
+		// buffered records are delivered before exit, within a grace period of their own.
+		dsCtx, dsCancel := context.WithTimeout(context.Background(), conf.ShutdownGracePeriod)
+		defer dsCancel()
+		results, _ := d.Shutdown(dsCtx)
+		for _, r := range results {
+			if r.Err != nil {
+				log.Error().Err(r.Err).Str("delivery_stream", r.DeliveryStreamName).Msg("records may be lost")
+				continue
+			}
+			log.Info().Str("delivery_stream", r.DeliveryStreamName).Msg("delivery stream is flushed")
+		}
 	}()
 
 	log.Info().Int("port", conf.Port).
@@ -85,7 +163,9 @@ func main() {
 
 	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		log.Error().Err(err).Msg("ListenAndServe failed")
+		return
 	}
+	<-shutdownDone
 }
 
 type toyhoseConfig struct {
@@ -94,8 +174,41 @@ type toyhoseConfig struct {
 	Region              string  `env:"AWS_REGION"            envDefault:"us-east-1"`
 	Port                int     `env:"PORT"                  envDefault:"4573"` // inspired by localstack
 	S3DisableBuffering  bool    `env:"S3_DISABLE_BUFFERING"  envDefault:"false"`
+	S3InMemory          bool    `env:"S3_IN_MEMORY"          envDefault:"false"`
 	S3SizeInMBs         *int    `env:"S3_BUFFERING_HINTS_SIZE_IN_MBS"`
 	S3IntervalInSeconds *int    `env:"S3_BUFFERING_HINTS_INTERVAL_IN_SECONDS"`
 	S3EndPoint          *string `env:"S3_ENDPOINT_URL"`
 	KinesisEndpoint     *string `env:"KINESIS_STREAM_ENDPOINT_URL"`
+
+	ShutdownGracePeriod time.Duration `env:"SHUTDOWN_GRACE_PERIOD" envDefault:"30s"`
+	LedgerMaxRecords    int           `env:"LEDGER_MAX_RECORDS"`
+
+	KinesisCheckpointDir          string        `env:"KINESIS_CHECKPOINT_DIR"`
+	KinesisShardDiscoveryInterval time.Duration `env:"KINESIS_SHARD_DISCOVERY_INTERVAL"`
+	KinesisEnhancedFanOut         bool          `env:"KINESIS_ENHANCED_FAN_OUT"`
+
+	S3UploadConcurrency      int `env:"S3_UPLOAD_CONCURRENCY"`
+	S3MultipartPartSizeInMBs int `env:"S3_MULTIPART_PART_SIZE_IN_MBS"`
+
+	S3RetryDuration       time.Duration `env:"S3_RETRY_DURATION"`
+	S3RetryInitialBackoff time.Duration `env:"S3_RETRY_INITIAL_BACKOFF"`
+	S3RetryMaxBackoff     time.Duration `env:"S3_RETRY_MAX_BACKOFF"`
+	S3SpillDir            string        `env:"S3_SPILL_DIR"`
+	S3RedeliveryInterval  time.Duration `env:"S3_REDELIVERY_INTERVAL"`
+
+	IngestMaxBufferedBytesPerStream   int `env:"INGEST_MAX_BUFFERED_BYTES_PER_STREAM"`
+	IngestMaxBufferedRecordsPerStream int `env:"INGEST_MAX_BUFFERED_RECORDS_PER_STREAM"`
+	IngestMaxBufferedBytesTotal       int `env:"INGEST_MAX_BUFFERED_BYTES_TOTAL"`
+
+	CloudWatchEndpoint               *string `env:"CLOUDWATCH_ENDPOINT_URL"`
+	CloudWatchPublishIntervalSeconds int     `env:"CLOUDWATCH_PUBLISH_INTERVAL_SECONDS" envDefault:"60"`
+	CloudWatchLogsEndpoint           *string `env:"CLOUDWATCH_LOGS_ENDPOINT_URL"`
+	CloudWatchLogsFallbackPath       string  `env:"CLOUDWATCH_LOGS_FALLBACK_PATH"`
+
+	OTLPEndpoint *string  `env:"OTLP_ENDPOINT_URL"`
+	WebhookURLs  []string `env:"WEBHOOK_URLS" envSeparator:","`
+
+	Deterministic          bool      `env:"DETERMINISTIC_MODE"       envDefault:"false"`
+	DeterministicSeed      int64     `env:"DETERMINISTIC_SEED"       envDefault:"0"`
+	DeterministicStartTime time.Time `env:"DETERMINISTIC_START_TIME" envDefault:"2020-01-01T00:00:00Z"`
 }
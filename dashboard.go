@@ -0,0 +1,230 @@
+package toyhose
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+//go:embed dashboard
+var dashboardFS embed.FS
+
+const (
+	// defaultRecentDeliveries is the number of deliveries returned by RecentDeliveries by default.
+	defaultRecentDeliveries = 20
+	// previewLimit is the max bytes of decompressed object returned by PreviewObject.
+	previewLimit = 64 * 1024
+)
+
+// StreamSummary represents configuration and current state of a deliveryStream.
+type StreamSummary struct {
+	DeliveryStreamDescriptionForJSON
+	// Buffer is nil when destination does not support buffer inspection.
+	Buffer *BufferStatus `json:"Buffer,omitempty"`
+}
+
+// DeliverySummary represents an object written by destination, built from record ledger.
+type DeliverySummary struct {
+	Bucket      string    `json:"bucket"`
+	Key         string    `json:"key"`
+	DeliveredAt time.Time `json:"deliveredAt"`
+	Records     int       `json:"records"`
+	// SizeInBytes is the size before compression.
+	SizeInBytes int `json:"sizeInBytes"`
+}
+
+// ObjectPreview represents the head of decompressed delivered object.
+type ObjectPreview struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	Data      string `json:"data"`
+	Encoding  string `json:"encoding"`
+	Truncated bool   `json:"truncated"`
+}
+
+// Streams returns summaries of every deliveryStream ordered by name.
+func (d *Dispatcher) Streams(ctx context.Context) ([]StreamSummary, error) {
+	streams := d.pool.All()
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].deliveryStreamName < streams[j].deliveryStreamName
+	})
+	summaries := make([]StreamSummary, 0, len(streams))
+	for _, ds := range streams {
+		out, err := d.svc.Describe(ctx, &firehose.DescribeDeliveryStreamInput{
+			DeliveryStreamName: aws.String(ds.deliveryStreamName),
+		})
+		if err != nil {
+			// deleted after listing.
+			continue
+		}
+		summary := StreamSummary{
+			DeliveryStreamDescriptionForJSON: describeOutputForJSON(out).DeliveryStreamDescription,
+		}
+		if bi, ok := ds.destination.(BufferInspector); ok {
+			var (
+				st       BufferStatus
+				notFound *types.ResourceNotFoundException
+			)
+			err := ds.sync(ctx)
+			if err == nil {
+				st, err = bi.BufferStatus(ctx)
+			}
+			if errors.As(err, &notFound) {
+				// deleted after describing.
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			summary.Buffer = &st
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// deliveries returns every delivery of streamName recorded in ledger, newest first.
+func (d *Dispatcher) deliveries(streamName string) []DeliverySummary {
+	byKey := map[string]*DeliverySummary{}
+	for _, e := range d.ledger.List(streamName, time.Time{}, time.Time{}) {
+		if e.State != RecordStateDelivered {
+			continue
+		}
+		s, ok := byKey[e.Key]
+		if !ok {
+			s = &DeliverySummary{
+				Bucket:      e.Bucket,
+				Key:         e.Key,
+				DeliveredAt: e.UpdatedAt,
+			}
+			byKey[e.Key] = s
+		}
+		s.Records++
+		s.SizeInBytes += e.Size
+	}
+	list := make([]DeliverySummary, 0, len(byKey))
+	for _, s := range byKey {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DeliveredAt.After(list[j].DeliveredAt)
+	})
+	return list
+}
+
+// RecentDeliveries returns up to limit latest deliveries of supplied deliveryStreamName, newest first.
+func (d *Dispatcher) RecentDeliveries(streamName string, limit int) []DeliverySummary {
+	list := d.deliveries(streamName)
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// PreviewObject returns the head of delivered object of supplied deliveryStreamName, decompressing gzip.
+func (d *Dispatcher) PreviewObject(ctx context.Context, streamName, key string) (ObjectPreview, error) {
+	var bucket string
+	for _, s := range d.deliveries(streamName) {
+		if s.Key == key {
+			bucket = s.Bucket
+			break
+		}
+	}
+	if bucket == "" {
+		return ObjectPreview{}, &types.ResourceNotFoundException{Message: aws.String(fmt.Sprintf("object: %s not found", key))}
+	}
+	body, err := d.fetchObject(ctx, streamName, bucket, key)
+	if err != nil {
+		return ObjectPreview{}, err
+	}
+	var r io.Reader = bytes.NewReader(body)
+	if bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return ObjectPreview{}, err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	head, err := io.ReadAll(io.LimitReader(r, previewLimit+1))
+	if err != nil {
+		return ObjectPreview{}, err
+	}
+	p := ObjectPreview{
+		Bucket:    bucket,
+		Key:       key,
+		Truncated: len(head) > previewLimit,
+	}
+	if p.Truncated {
+		head = head[:previewLimit]
+	}
+	p.Data, p.Encoding = encodeTailData(head)
+	return p, nil
+}
+
+func (d *Dispatcher) fetchObject(ctx context.Context, streamName, bucket, key string) ([]byte, error) {
+	if d.s3InjectedConf.InMemory {
+		delivery, ok := d.memory.Find(streamName, key)
+		if !ok {
+			return nil, &types.ResourceNotFoundException{Message: aws.String(fmt.Sprintf("object: %s not found", key))}
+		}
+		return delivery.Body, nil
+	}
+	cli := s3.NewFromConfig(d.conf, func(o *s3.Options) {
+		o.BaseEndpoint = d.s3InjectedConf.EndPoint
+		o.UsePathStyle = true
+	})
+	out, err := cli.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (d *Dispatcher) registerDashboard(mux *http.ServeMux) {
+	mux.HandleFunc("GET "+AdminPathPrefix+"streams", func(w http.ResponseWriter, r *http.Request) {
+		summaries, err := d.Streams(r.Context())
+		outputForJSON(w, summaries, err)
+	})
+	mux.HandleFunc("GET "+AdminPathPrefix+"streams/{name}/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultRecentDeliveries
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				outputForJSON(w, nil, &types.InvalidArgumentException{Message: aws.String("limit must be positive integer")})
+				return
+			}
+			limit = n
+		}
+		outputForJSON(w, d.RecentDeliveries(r.PathValue("name"), limit), nil)
+	})
+	mux.HandleFunc("GET "+AdminPathPrefix+"streams/{name}/preview", func(w http.ResponseWriter, r *http.Request) {
+		p, err := d.PreviewObject(r.Context(), r.PathValue("name"), r.URL.Query().Get("key"))
+		outputForJSON(w, p, err)
+	})
+	ui, _ := fs.Sub(dashboardFS, "dashboard")
+	files := http.StripPrefix(AdminPathPrefix+"ui/", http.FileServer(http.FS(ui)))
+	mux.Handle("GET "+AdminPathPrefix+"ui/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// let FileServer detect Content-Type of static files.
+		w.Header().Del("Content-Type")
+		files.ServeHTTP(w, r)
+	}))
+}
@@ -0,0 +1,119 @@
+package toyhose
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestDashboard(t *testing.T) {
+	ctx := context.Background()
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		S3InjectedConf: S3InjectedConf{
+			InMemory: true,
+		},
+	})
+	testserver := httptest.NewServer(d.AdminHandler())
+	defer testserver.Close()
+
+	svc := d.Service()
+	streamName := "dashboard-stream"
+	if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+			BucketARN:         aws.String("arn:aws:s3:::dashboard-bucket"),
+			CompressionFormat: fhtypes.CompressionFormatGzip,
+			BufferingHints: &fhtypes.BufferingHints{
+				SizeInMBs:         aws.Int32(1),
+				IntervalInSeconds: aws.Int32(60),
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	put := func(t *testing.T, data string) {
+		t.Helper()
+		if _, err := svc.Put(ctx, &firehose.PutRecordInput{
+			DeliveryStreamName: &streamName,
+			Record:             &fhtypes.Record{Data: []byte(data)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(t *testing.T, path string, expectedStatus int, v any) *http.Response {
+		t.Helper()
+		res, err := http.Get(testserver.URL + AdminPathPrefix + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		if res.StatusCode != expectedStatus {
+			t.Fatalf("unexpected status for %s: %d", path, res.StatusCode)
+		}
+		if v != nil {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res
+	}
+
+	t.Run("streams", func(t *testing.T) {
+		put(t, "hello!\n")
+		var summaries []StreamSummary
+		get(t, "streams", http.StatusOK, &summaries)
+		if len(summaries) != 1 {
+			t.Fatalf("unexpected summaries: %#v", summaries)
+		}
+		s := summaries[0]
+		if *s.DeliveryStreamName != streamName || s.DeliveryStreamStatus != fhtypes.DeliveryStreamStatusActive {
+			t.Errorf("unexpected summary: %#v", s)
+		}
+		if s.Buffer == nil || s.Buffer.Records != 1 || s.Buffer.SizeLimitInBytes != 1024*1024 || s.Buffer.IntervalInSeconds != 60 {
+			t.Errorf("unexpected buffer: %#v", s.Buffer)
+		}
+	})
+
+	t.Run("deliveries and preview", func(t *testing.T) {
+		put(t, "world!\n")
+		flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := d.Flush(flushCtx, streamName); err != nil {
+			t.Fatal(err)
+		}
+		var deliveries []DeliverySummary
+		get(t, "streams/"+streamName+"/deliveries", http.StatusOK, &deliveries)
+		if len(deliveries) != 1 || deliveries[0].Records != 2 || deliveries[0].SizeInBytes != 14 || deliveries[0].Bucket != "dashboard-bucket" {
+			t.Fatalf("unexpected deliveries: %#v", deliveries)
+		}
+		var p ObjectPreview
+		get(t, "streams/"+streamName+"/preview?key="+url.QueryEscape(deliveries[0].Key), http.StatusOK, &p)
+		if p.Data != "hello!\nworld!\n" || p.Encoding != "text" || p.Truncated {
+			t.Errorf("unexpected preview: %#v", p)
+		}
+		get(t, "streams/"+streamName+"/preview?key=unknown", http.StatusNotFound, nil)
+		get(t, "streams/"+streamName+"/deliveries?limit=0", http.StatusBadRequest, nil)
+	})
+
+	t.Run("ui", func(t *testing.T) {
+		res := get(t, "ui/", http.StatusOK, nil)
+		if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("unexpected Content-Type: %s", ct)
+		}
+		b, _ := io.ReadAll(res.Body)
+		if !strings.Contains(string(b), "<title>toyhose</title>") {
+			t.Error("dashboard is not served")
+		}
+	})
+}
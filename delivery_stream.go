@@ -7,46 +7,141 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
-	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type deliveryStream struct {
 	arn                string
 	deliveryStreamName string
 	deliveryStreamType types.DeliveryStreamType
-	recordCh           chan *deliveryRecord
+	recordCh           chan *DeliveryRecord
+	queue              *ingestQueue
 	closer             context.CancelFunc
-	destDesc           *types.DestinationDescription
-	sourceDesc         *types.SourceDescription
+	stopSource         context.CancelFunc
+	destination        Destination
+	source             Source
 	createdAt          time.Time
+	// done is closed when destination finishes delivering remaining records.
+	done chan struct{}
+	// pumped is closed when queue stops sending to recordCh.
+	pumped chan struct{}
+	// sourceDone is closed when source stops sending to recordCh.
+	sourceDone chan struct{}
+	closeOnce  sync.Once
 }
 
+// Close stops d at once. Records which destination has not received yet are dropped.
+// recordCh is closed after queue and source stop sending to it, so that no one sends on closed channel.
+// It is safe to call Close more than once.
 func (d *deliveryStream) Close() {
-	d.closer()
-	close(d.recordCh)
+	d.closeOnce.Do(func() {
+		d.queue.close()
+		d.stopSource()
+		d.closer()
+		<-d.pumped
+		<-d.sourceDone
+		close(d.recordCh)
+	})
+}
+
+// drain stops intake of d and waits until destination receives every record accepted so far.
+// Puts fail while d drains, since its queue is closed.
+func (d *deliveryStream) drain(ctx context.Context) error {
+	d.queue.close()
+	d.stopSource()
+	if d.destination == nil {
+		return nil
+	}
+	// queue is closed, so pump returns as soon as destination receives the rest.
+	for _, ch := range []chan struct{}{d.sourceDone, d.pumped} {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
 
-type deliveryRecord struct {
-	id   string
-	data []byte
+// shutdown drains and closes d. It returns when destination finishes delivering
+// the records accepted so far. When ctx is done first, deliveries in progress are aborted
+// and ctx error is returned.
+func (d *deliveryStream) shutdown(ctx context.Context) error {
+	err := d.drain(ctx)
+	d.Close()
+	if err == nil {
+		select {
+		case <-d.done:
+			return nil
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	d.abort()
+	return err
 }
 
-func newDeliveryRecord(data []byte) *deliveryRecord {
-	return &deliveryRecord{
-		id:   uuid.New().String(),
-		data: data,
+// abort cuts deliveries of closed d short, and waits for destination to spill or drop the rest.
+// Destination which does not support it is left running.
+func (d *deliveryStream) abort() {
+	if a, ok := d.destination.(deliveryAborter); ok {
+		a.abortDeliveries()
+		<-d.done
 	}
 }
 
+// sync waits until records accepted so far are received by destination.
+func (d *deliveryStream) sync(ctx context.Context) error {
+	return d.queue.sync(ctx)
+}
+
+// DeliveryRecord represents a single record flowing from Source to Destination.
+type DeliveryRecord struct {
+	ID        string
+	Data      []byte
+	ArrivedAt time.Time
+	// PartitionKey is set for records read from Kinesis stream. ExplicitHashKey is set for
+	// records de-aggregated from a KPL aggregated record, when the producer gave one.
+	PartitionKey    string
+	ExplicitHashKey string
+	// spanContext is ingest span of the record, linked from the span of its delivery.
+	spanContext trace.SpanContext
+	// source is where the record is read from, acknowledged once it is delivered.
+	source *sourcePosition
+}
+
+// NewDeliveryRecord returns DeliveryRecord with newly assigned record ID.
+func NewDeliveryRecord(data []byte) *DeliveryRecord {
+	return newDeliveryRecord(data, realClock{}, randomIDGenerator{})
+}
+
 type deliveryStreamPool struct {
-	mutex sync.RWMutex
-	pool  map[string]*deliveryStream
+	mutex  sync.RWMutex
+	pool   map[string]*deliveryStream
+	closed bool
 }
 
-func (p *deliveryStreamPool) Add(d *deliveryStream) {
+// Add registers d. It fails when a stream of the same ARN exists, or the pool is closed.
+func (p *deliveryStreamPool) Add(d *deliveryStream) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
+	if p.closed {
+		return errShuttingDown
+	}
+	if _, ok := p.pool[d.arn]; ok {
+		return errStreamInUse(d.deliveryStreamName)
+	}
 	p.pool[d.arn] = d
+	return nil
+}
+
+// close refuses later Add and returns every stream registered so far,
+// so that no stream escapes shutdown by being added after the snapshot.
+func (p *deliveryStreamPool) close() []*deliveryStream {
+	p.mutex.Lock()
+	p.closed = true
+	p.mutex.Unlock()
+	return p.All()
 }
 
 func (p *deliveryStreamPool) Find(arn string) *deliveryStream {
@@ -69,14 +164,27 @@ func (p *deliveryStreamPool) Delete(arn string) *deliveryStream {
 	return nil
 }
 
-func (p *deliveryStreamPool) FindAllBySource(streamType types.DeliveryStreamType, from *string, limit *int32) ([]*deliveryStream, bool) {
-	pickups := make([]*deliveryStream, 0, len(p.pool))
+func (p *deliveryStreamPool) All() []*deliveryStream {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	all := make([]*deliveryStream, 0, len(p.pool))
 	for _, ds := range p.pool {
+		all = append(all, ds)
+	}
+	return all
+}
+
+func (p *deliveryStreamPool) FindAllBySource(streamType types.DeliveryStreamType, from *string, limit *int32) ([]*deliveryStream, bool) {
+	pickups := p.All()
+	n := 0
+	for _, ds := range pickups {
 		if ds.deliveryStreamType != streamType {
 			continue
 		}
-		pickups = append(pickups, ds)
+		pickups[n] = ds
+		n++
 	}
+	pickups = pickups[:n]
 	sort.Slice(pickups, func(i, j int) bool {
 		return pickups[i].createdAt.Before(pickups[j].createdAt)
 	})
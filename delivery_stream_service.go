@@ -3,15 +3,26 @@ package toyhose
 import (
 	"context"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
+	"regexp"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/firehose"
 	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// deliveryStreamNameRE is the pattern which Firehose accepts for delivery stream names.
+var deliveryStreamNameRE = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+// validDeliveryStreamName reports whether name is accepted by Firehose and is safe as a file name.
+// Names become file names of spilled batches and Kinesis checkpoints, so "." and ".." would escape the directory.
+func validDeliveryStreamName(name string) bool {
+	return deliveryStreamNameRE.MatchString(name) && name != "." && name != ".."
+}
+
 // DeliveryStreamService represents interface for operating DeliveryStream resources.
 type DeliveryStreamService struct {
 	awsConf             aws.Config
@@ -19,179 +30,383 @@ type DeliveryStreamService struct {
 	accountID           string
 	s3InjectedConf      S3InjectedConf
 	kinesisInjectedConf KinesisInjectedConf
+	ingestConf          IngestConf
+	retryConf           RetryConf
+	budget              *memoryBudget
 	pool                *deliveryStreamPool
+	memory              *memoryStore
+	destinations        map[DestinationType]DestinationFactory
+	sources             map[types.DeliveryStreamType]SourceFactory
+	metrics             *metrics
+	errorLogs           *errorLogger
+	tracer              trace.Tracer
+	ledger              *ledger
+	tail                *tailHub
+	webhooks            *webhookNotifier
+	clock               Clock
+	ids                 IDGenerator
+	// shuttingDown refuses new streams and puts while Dispatcher.Shutdown flushes streams.
+	shuttingDown atomic.Bool
 }
 
-// Custom type for JSON marshaling
-type DeliveryStreamDescriptionForJSON struct {
-	CreateTimestamp      int64                          `json:"CreateTimestamp"`
-	DeliveryStreamARN    *string                        `json:"DeliveryStreamARN"`
-	DeliveryStreamStatus types.DeliveryStreamStatus     `json:"DeliveryStreamStatus"`
-	DeliveryStreamName   *string                        `json:"DeliveryStreamName"`
-	DeliveryStreamType   types.DeliveryStreamType       `json:"DeliveryStreamType"`
-	Destinations         []types.DestinationDescription `json:"Destinations"`
-	Source               *types.SourceDescription       `json:"Source"`
-	VersionId            *string                        `json:"VersionId"`
+// errShuttingDown is returned for requests which would add records after Dispatcher.Shutdown starts.
+var errShuttingDown = &types.ServiceUnavailableException{Message: aws.String("toyhose is shutting down")}
+
+func (s *DeliveryStreamService) arnName(streamName string) string {
+	return fmt.Sprintf("arn:aws:firehose:%s:%s:deliverystream/%s", s.region, s.accountID, streamName)
 }
 
-type DescribeDeliveryStreamOutputForJSON struct {
-	DeliveryStreamDescription DeliveryStreamDescriptionForJSON `json:"DeliveryStreamDescription"`
+func (s *DeliveryStreamService) find(streamName *string) (*deliveryStream, error) {
+	if streamName == nil {
+		return nil, &types.InvalidArgumentException{Message: aws.String("DeliveryStreamName is required")}
+	}
+	ds := s.pool.Find(s.arnName(*streamName))
+	if ds == nil {
+		return nil, errStreamNotFound(*streamName)
+	}
+	return ds, nil
 }
 
-func (s *DeliveryStreamService) arnName(streamName string) string {
-	return fmt.Sprintf("arn:aws:firehose:%s:%s:deliverystream/%s", s.region, s.accountID, streamName)
+func errStreamNotFound(streamName string) error {
+	return &types.ResourceNotFoundException{Message: aws.String(fmt.Sprintf("DeliveryStreamName: %s not found", streamName))}
+}
+
+func errStreamInUse(streamName string) error {
+	return &types.ResourceInUseException{Message: aws.String(fmt.Sprintf("DeliveryStreamName: %s already exists", streamName))}
 }
 
 // Create provides creating DeliveryStream resource operation.
-func (s *DeliveryStreamService) Create(ctx context.Context, input []byte) (*firehose.CreateDeliveryStreamOutput, error) {
-	i := &firehose.CreateDeliveryStreamInput{}
-	if err := json.Unmarshal(input, i); err != nil {
-		return nil, fmt.Errorf("unmarshal error: %w", err)
-	}
+func (s *DeliveryStreamService) Create(ctx context.Context, i *firehose.CreateDeliveryStreamInput) (*firehose.CreateDeliveryStreamOutput, error) {
 	// i.Validate() is not available in v2, perform manual validation if needed
+	if i.DeliveryStreamName == nil {
+		return nil, &types.InvalidArgumentException{Message: aws.String("DeliveryStreamName is required")}
+	}
+	if !validDeliveryStreamName(*i.DeliveryStreamName) {
+		return nil, &types.InvalidArgumentException{Message: aws.String(fmt.Sprintf("DeliveryStreamName: %s must satisfy pattern %s and not be . or ..", *i.DeliveryStreamName, deliveryStreamNameRE))}
+	}
+	if s.shuttingDown.Load() {
+		return nil, errShuttingDown
+	}
 	arn := s.arnName(*i.DeliveryStreamName)
-	dsCtx, dsCancel := context.WithCancel(context.Background())
-	recordCh := make(chan *deliveryRecord, 128)
+	if s.pool.Find(arn) != nil {
+		return nil, errStreamInUse(*i.DeliveryStreamName)
+	}
 	dsType := types.DeliveryStreamTypeDirectPut
 	if i.DeliveryStreamType != "" {
 		dsType = i.DeliveryStreamType
 	}
+	dsCtx, dsCancel := context.WithCancel(context.Background())
+	dest, err := s.newDestination(dsCtx, i)
+	if err != nil {
+		dsCancel()
+		return nil, err
+	}
+	src, err := s.newSource(ctx, dsType, i)
+	if err != nil {
+		dsCancel()
+		return nil, err
+	}
+	recordCh := make(chan *DeliveryRecord)
+	// source stops apart from the stream on shutdown, so that what it has read is still delivered.
+	srcCtx, srcCancel := context.WithCancel(dsCtx)
 	ds := &deliveryStream{
 		arn:                arn,
 		deliveryStreamName: *i.DeliveryStreamName,
 		deliveryStreamType: dsType,
 		recordCh:           recordCh,
+		queue:              newIngestQueue(s.ingestConf),
 		closer:             dsCancel,
-		destDesc:           &types.DestinationDescription{},
-		createdAt:          time.Now(),
-	}
-	if i.S3DestinationConfiguration != nil {
-		s3dest := &s3Destination{
-			deliveryName:      *i.DeliveryStreamName,
-			bucketARN:         *i.S3DestinationConfiguration.BucketARN,
-			bufferingHints:    i.S3DestinationConfiguration.BufferingHints,
-			compressionFormat: i.S3DestinationConfiguration.CompressionFormat,
-			errorOutputPrefix: i.S3DestinationConfiguration.ErrorOutputPrefix,
-			prefix:            i.S3DestinationConfiguration.Prefix,
-			injectedConf:      s.s3InjectedConf,
-			awsConf:           s.awsConf,
-		}
-		conf, err := s3dest.Setup(dsCtx)
-		if err != nil {
-			return nil, &types.ResourceNotFoundException{Message: aws.String("invalid BucketName")}
-		}
-		ds.destDesc.S3DestinationDescription = &types.S3DestinationDescription{
-			BucketARN:               i.S3DestinationConfiguration.BucketARN,
-			BufferingHints:          i.S3DestinationConfiguration.BufferingHints,
-			CompressionFormat:       i.S3DestinationConfiguration.CompressionFormat,
-			EncryptionConfiguration: i.S3DestinationConfiguration.EncryptionConfiguration,
-			ErrorOutputPrefix:       i.S3DestinationConfiguration.ErrorOutputPrefix,
-			Prefix:                  i.S3DestinationConfiguration.Prefix,
-			RoleARN:                 i.S3DestinationConfiguration.RoleARN,
-		}
-		go s3dest.Run(dsCtx, conf, recordCh)
+		stopSource:         srcCancel,
+		destination:        dest,
+		source:             src,
+		createdAt:          clockNow(s.clock),
+		done:               make(chan struct{}),
+		pumped:             make(chan struct{}),
+		sourceDone:         make(chan struct{}),
 	}
-	if ds.deliveryStreamType == types.DeliveryStreamTypeKinesisStreamAsSource && i.KinesisStreamSourceConfiguration != nil {
-		consumer, err := newKinesisConsumer(ctx, s.awsConf, i.KinesisStreamSourceConfiguration, s.kinesisInjectedConf)
-		if err != nil {
-			ds.Close()
-			return nil, err
+	go func() {
+		defer close(ds.pumped)
+		ds.queue.pump(dsCtx, recordCh)
+	}()
+	go func() {
+		defer close(ds.done)
+		if dest != nil {
+			dest.Run(dsCtx, recordCh)
 		}
-		ds.sourceDesc = &types.SourceDescription{
-			KinesisStreamSourceDescription: &types.KinesisStreamSourceDescription{
-				DeliveryStartTimestamp: &ds.createdAt,
-				KinesisStreamARN:       i.KinesisStreamSourceConfiguration.KinesisStreamARN,
-				RoleARN:                i.KinesisStreamSourceConfiguration.RoleARN,
-			},
+	}()
+	go func() {
+		defer close(ds.sourceDone)
+		if src != nil {
+			src.Run(srcCtx, recordCh)
 		}
-		go consumer.Run(dsCtx, recordCh)
+	}()
+	if err := s.pool.Add(ds); err != nil {
+		// created by another request, or shutdown started, in the meantime.
+		ds.Close()
+		return nil, err
 	}
-	s.pool.Add(ds)
 	output := &firehose.CreateDeliveryStreamOutput{
 		DeliveryStreamARN: &arn,
 	}
 	return output, nil
 }
 
+func (s *DeliveryStreamService) newDestination(ctx context.Context, i *firehose.CreateDeliveryStreamInput) (Destination, error) {
+	dts := destinationTypesOf(i)
+	switch len(dts) {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, &types.InvalidArgumentException{Message: aws.String(fmt.Sprintf("only one destination configuration is allowed: %v", dts))}
+	}
+	factory := s.destinationFactory(dts[0])
+	if factory == nil {
+		return nil, &types.InvalidArgumentException{Message: aws.String(fmt.Sprintf("%s is not supported", dts[0]))}
+	}
+	return factory(ctx, i)
+}
+
+func (s *DeliveryStreamService) destinationFactory(dt DestinationType) DestinationFactory {
+	if f, ok := s.destinations[dt]; ok {
+		return f
+	}
+	if dt == DestinationTypeS3 {
+		return s.newS3Destination
+	}
+	return nil
+}
+
+func (s *DeliveryStreamService) newSource(ctx context.Context, dsType types.DeliveryStreamType, i *firehose.CreateDeliveryStreamInput) (Source, error) {
+	if dsType == types.DeliveryStreamTypeDirectPut {
+		return nil, nil
+	}
+	factory := s.sourceFactory(dsType)
+	if factory == nil {
+		return nil, &types.InvalidArgumentException{Message: aws.String(fmt.Sprintf("DeliveryStreamType: %s is not supported", dsType))}
+	}
+	return factory(ctx, i)
+}
+
+func (s *DeliveryStreamService) sourceFactory(dsType types.DeliveryStreamType) SourceFactory {
+	if f, ok := s.sources[dsType]; ok {
+		return f
+	}
+	if dsType == types.DeliveryStreamTypeKinesisStreamAsSource {
+		return s.newKinesisSource
+	}
+	return nil
+}
+
+func (s *DeliveryStreamService) newS3Destination(ctx context.Context, i *firehose.CreateDeliveryStreamInput) (Destination, error) {
+	conf := i.S3DestinationConfiguration
+	if conf.BucketARN == nil {
+		return nil, &types.InvalidArgumentException{Message: aws.String("BucketARN is required")}
+	}
+	s3dest := &s3Destination{
+		deliveryName:             *i.DeliveryStreamName,
+		bucketARN:                *conf.BucketARN,
+		bufferingHints:           conf.BufferingHints,
+		compressionFormat:        conf.CompressionFormat,
+		encryptionConfiguration:  conf.EncryptionConfiguration,
+		errorOutputPrefix:        conf.ErrorOutputPrefix,
+		prefix:                   conf.Prefix,
+		roleARN:                  conf.RoleARN,
+		cloudWatchLoggingOptions: conf.CloudWatchLoggingOptions,
+		injectedConf:             s.s3InjectedConf,
+		retryConf:                s.retryConf,
+		budget:                   s.budget,
+		awsConf:                  s.awsConf,
+		memory:                   s.memory,
+		metrics:                  s.metrics,
+		tracer:                   s.tracer,
+		ledger:                   s.ledger,
+		tail:                     s.tail,
+		webhooks:                 s.webhooks,
+		clock:                    s.clock,
+		ids:                      s.ids,
+	}
+	if s.errorLogs != nil {
+		s3dest.errorLog = &streamErrorLogger{
+			logger:      s.errorLogs,
+			opts:        conf.CloudWatchLoggingOptions,
+			streamARN:   s.arnName(*i.DeliveryStreamName),
+			destination: *conf.BucketARN,
+		}
+	}
+	if err := s3dest.Setup(ctx); err != nil {
+		return nil, &types.ResourceNotFoundException{Message: aws.String("invalid BucketName")}
+	}
+	return s3dest, nil
+}
+
+func (s *DeliveryStreamService) newKinesisSource(ctx context.Context, i *firehose.CreateDeliveryStreamInput) (Source, error) {
+	if i.KinesisStreamSourceConfiguration == nil {
+		return nil, &types.InvalidArgumentException{Message: aws.String("KinesisStreamSourceConfiguration is required")}
+	}
+	// Kinesis stream positions are in real time, so the start is not taken from the virtual clock.
+	consumer, err := newKinesisConsumer(ctx, s.awsConf, i.KinesisStreamSourceConfiguration, s.kinesisInjectedConf, *i.DeliveryStreamName, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	consumer.deliveryName = *i.DeliveryStreamName
+	consumer.metrics = s.metrics
+	consumer.ledger = s.ledger
+	consumer.tail = s.tail
+	consumer.clock = s.clock
+	consumer.ids = s.ids
+	return consumer, nil
+}
+
 // Delete provides deleting DeliveryStream resource operation.
-func (s *DeliveryStreamService) Delete(ctx context.Context, input []byte) (*firehose.DeleteDeliveryStreamOutput, error) {
-	i := &firehose.DeleteDeliveryStreamInput{}
-	if err := json.Unmarshal(input, i); err != nil {
-		return nil, fmt.Errorf("unmarshal error: %w", err)
+// It returns after destination delivers records accepted so far, or ctx is done.
+// In the latter case records not delivered yet are spilled or dropped, and deletion still succeeds.
+func (s *DeliveryStreamService) Delete(ctx context.Context, i *firehose.DeleteDeliveryStreamInput) (*firehose.DeleteDeliveryStreamOutput, error) {
+	if i.DeliveryStreamName == nil {
+		return nil, &types.InvalidArgumentException{Message: aws.String("DeliveryStreamName is required")}
 	}
 	arn := s.arnName(*i.DeliveryStreamName)
 	ds := s.pool.Delete(arn)
 	if ds == nil {
-		return nil, &types.ResourceNotFoundException{Message: aws.String(fmt.Sprintf("DeliveryStreamName: %s not found", *i.DeliveryStreamName))}
+		return nil, errStreamNotFound(*i.DeliveryStreamName)
+	}
+	// records accepted before deletion are still delivered, so wait for them.
+	// the stream is gone already, so failing here would make retries of the client fail with ResourceNotFound.
+	if err := ds.shutdown(ctx); err != nil {
+		log.Error().Err(err).Str("delivery_stream", *i.DeliveryStreamName).Msg("deleted before every accepted record is delivered")
 	}
-	ds.Close()
+	s.teardown(ctx, ds)
 	return &firehose.DeleteDeliveryStreamOutput{}, nil
 }
 
+// teardown removes state kept for ds apart from it, once ds is removed from pool and stopped.
+// Unlike shutdown of toyhose, deletion is not resumed later, so a stream created again
+// with the same name starts over.
+func (s *DeliveryStreamService) teardown(ctx context.Context, ds *deliveryStream) {
+	if consumer, ok := ds.source.(*kinesisConsumer); ok {
+		consumer.deregisterConsumer(ctx)
+	}
+	s.ledger.dropStream(ds.deliveryStreamName)
+	if err := newCheckpointStore(s.kinesisInjectedConf.CheckpointDir).remove(ds.deliveryStreamName); err != nil {
+		log.Error().Err(err).Str("delivery_stream", ds.deliveryStreamName).Msg("failed to remove checkpoint")
+	}
+}
+
 // Put provides accepting single record data for sending to DeliveryStream.
-func (s *DeliveryStreamService) Put(ctx context.Context, input []byte) (*firehose.PutRecordOutput, error) {
-	i := &firehose.PutRecordInput{}
-	if err := json.Unmarshal(input, i); err != nil {
-		return nil, fmt.Errorf("unmarshal error: %w", err)
+func (s *DeliveryStreamService) Put(ctx context.Context, i *firehose.PutRecordInput) (*firehose.PutRecordOutput, error) {
+	ds, err := s.find(i.DeliveryStreamName)
+	if err != nil {
+		return nil, err
 	}
-	ds := s.pool.Find(s.arnName(*i.DeliveryStreamName))
-	if ds == nil {
-		return nil, &types.ResourceNotFoundException{Message: aws.String(fmt.Sprintf("DeliveryStreamName: %s not found", *i.DeliveryStreamName))}
+	if i.Record == nil {
+		return nil, &types.InvalidArgumentException{Message: aws.String("Record is required")}
 	}
 	log.Debug().Str("delivery_stream", *i.DeliveryStreamName).Msg("processing PutRecord request")
-	recordIDs := putData(ds, []types.Record{*i.Record})
+	entries, err := s.putData(ctx, ds, []types.Record{*i.Record})
+	if err != nil {
+		return nil, err
+	}
+	if entries[0].ErrorCode != nil {
+		return nil, &types.ServiceUnavailableException{Message: entries[0].ErrorMessage}
+	}
 	output := &firehose.PutRecordOutput{
 		Encrypted: aws.Bool(false),
-		RecordId:  &recordIDs[0],
+		RecordId:  entries[0].RecordId,
 	}
 	return output, nil
 }
 
-func putData(ds *deliveryStream, records []types.Record) []string {
-	recordIDs := make([]string, 0, len(records))
+// errSlowDown is the message of ServiceUnavailableException returned by Firehose when it is out of capacity.
+const errSlowDown = "Slow down."
+
+// putData queues records to ds without blocking.
+// Records which do not fit in the buffer of ds fail with ServiceUnavailableException in their entries,
+// as well as records left when ctx is done or ds starts closing in the middle.
+func (s *DeliveryStreamService) putData(ctx context.Context, ds *deliveryStream, records []types.Record) ([]types.PutRecordBatchResponseEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s.shuttingDown.Load() {
+		return nil, errShuttingDown
+	}
+	if ds.queue.isClosed() {
+		// deleted after it is found.
+		return nil, errStreamNotFound(ds.deliveryStreamName)
+	}
+	entries := make([]types.PutRecordBatchResponseEntry, 0, len(records))
+	accepted, size := 0, 0
 	for _, record := range records {
 		dst, err := base64.StdEncoding.DecodeString(string(record.Data))
 		if err != nil {
 			dst = record.Data
 		}
-		rec := newDeliveryRecord(dst)
-		ds.recordCh <- rec
-		recordIDs = append(recordIDs, rec.id)
+		var rec *DeliveryRecord
+		if ctx.Err() != nil || s.budget.exhausted() || !ds.queue.push(len(dst), func() *DeliveryRecord {
+			rec = s.accept(ctx, ds, dst)
+			return rec
+		}) {
+			entries = append(entries, types.PutRecordBatchResponseEntry{
+				ErrorCode:    aws.String("ServiceUnavailableException"),
+				ErrorMessage: aws.String(errSlowDown),
+			})
+			continue
+		}
+		entries = append(entries, types.PutRecordBatchResponseEntry{
+			RecordId: aws.String(rec.ID),
+		})
+		accepted++
+		size += len(dst)
+	}
+	s.metrics.observeIncoming(ds.deliveryStreamName, accepted, size)
+	if throttled := len(records) - accepted; throttled > 0 {
+		log.Debug().Str("delivery_stream", ds.deliveryStreamName).Msgf("throttled %d records", throttled)
+		s.metrics.observeThrottled(ds.deliveryStreamName, throttled)
 	}
-	return recordIDs
+	return entries, nil
+}
+
+// accept builds a record of data accepted by ds. It is called inside the queue,
+// so the record is tracked before destination can receive it.
+func (s *DeliveryStreamService) accept(ctx context.Context, ds *deliveryStream, data []byte) *DeliveryRecord {
+	rec := newDeliveryRecord(data, s.clock, s.ids)
+	_, span := startSpan(ctx, s.tracer, "Firehose.IngestRecord", trace.WithAttributes(
+		attrDeliveryStreamName.String(ds.deliveryStreamName),
+		attrRecordID.String(rec.ID),
+	))
+	rec.spanContext = span.SpanContext()
+	span.End()
+	s.ledger.buffered(ds.deliveryStreamName, []*DeliveryRecord{rec})
+	s.tail.records(TailStageAccepted, ds.deliveryStreamName, []*DeliveryRecord{rec})
+	return rec
 }
 
 // PutBatch provides accepting multiple record data for sending to DeliveryStream.
-func (s *DeliveryStreamService) PutBatch(ctx context.Context, input []byte) (*firehose.PutRecordBatchOutput, error) {
-	i := &firehose.PutRecordBatchInput{}
-	if err := json.Unmarshal(input, i); err != nil {
-		return nil, fmt.Errorf("unmarshal error: %w", err)
-	}
-	ds := s.pool.Find(s.arnName(*i.DeliveryStreamName))
-	if ds == nil {
-		return nil, &types.ResourceNotFoundException{Message: aws.String(fmt.Sprintf("DeliveryStreamName: %s not found", *i.DeliveryStreamName))}
+func (s *DeliveryStreamService) PutBatch(ctx context.Context, i *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+	ds, err := s.find(i.DeliveryStreamName)
+	if err != nil {
+		return nil, err
 	}
 	log.Debug().Str("delivery_stream", *i.DeliveryStreamName).Msgf("processing PutRecordBatch request for %d records", len(i.Records))
-	recordIDs := putData(ds, i.Records)
-	output := &firehose.PutRecordBatchOutput{
-		FailedPutCount: aws.Int32(0),
-		Encrypted:      aws.Bool(false),
+	entries, err := s.putData(ctx, ds, i.Records)
+	if err != nil {
+		return nil, err
 	}
-	for _, r := range recordIDs {
-		output.RequestResponses = append(output.RequestResponses, types.PutRecordBatchResponseEntry{
-			RecordId: aws.String(r),
-		})
+	failed := int32(0)
+	for _, e := range entries {
+		if e.ErrorCode != nil {
+			failed++
+		}
+	}
+	output := &firehose.PutRecordBatchOutput{
+		FailedPutCount:   aws.Int32(failed),
+		Encrypted:        aws.Bool(false),
+		RequestResponses: entries,
 	}
 	return output, nil
 }
 
 // Listing returns registered deliveryStream names.
-func (s *DeliveryStreamService) Listing(ctx context.Context, input []byte) (*firehose.ListDeliveryStreamsOutput, error) {
-	i := &firehose.ListDeliveryStreamsInput{}
-	if err := json.Unmarshal(input, i); err != nil {
-		return nil, fmt.Errorf("unmarshal error: %w", err)
-	}
-
+func (s *DeliveryStreamService) Listing(ctx context.Context, i *firehose.ListDeliveryStreamsInput) (*firehose.ListDeliveryStreamsOutput, error) {
 	streams, hasNext := s.pool.FindAllBySource(i.DeliveryStreamType, i.ExclusiveStartDeliveryStreamName, i.Limit)
 	responses := make([]string, 0, len(streams))
 	for _, ds := range streams {
@@ -207,26 +422,32 @@ func (s *DeliveryStreamService) Listing(ctx context.Context, input []byte) (*fir
 }
 
 // Describe returns current deliveryStream definitions and statuses by supplied deliveryStreamName.
-func (s *DeliveryStreamService) Describe(ctx context.Context, input []byte) (*DescribeDeliveryStreamOutputForJSON, error) {
-	i := &firehose.DescribeDeliveryStreamInput{}
-	if err := json.Unmarshal(input, i); err != nil {
-		return nil, fmt.Errorf("unmarshal error: %w", err)
-	}
-	ds := s.pool.Find(s.arnName(*i.DeliveryStreamName))
-	if ds == nil {
-		return nil, &types.ResourceNotFoundException{Message: aws.String(fmt.Sprintf("DeliveryStreamName: %s not found", *i.DeliveryStreamName))}
+func (s *DeliveryStreamService) Describe(ctx context.Context, i *firehose.DescribeDeliveryStreamInput) (*firehose.DescribeDeliveryStreamOutput, error) {
+	ds, err := s.find(i.DeliveryStreamName)
+	if err != nil {
+		return nil, err
 	}
 
-	out := &DescribeDeliveryStreamOutputForJSON{
-		DeliveryStreamDescription: DeliveryStreamDescriptionForJSON{
-			CreateTimestamp:      ds.createdAt.Unix(),
+	destDesc := types.DestinationDescription{}
+	if ds.destination != nil {
+		destDesc = ds.destination.Description()
+	}
+	var sourceDesc *types.SourceDescription
+	if ds.source != nil {
+		desc := ds.source.Description()
+		sourceDesc = &desc
+	}
+	out := &firehose.DescribeDeliveryStreamOutput{
+		DeliveryStreamDescription: &types.DeliveryStreamDescription{
+			CreateTimestamp:      aws.Time(ds.createdAt),
 			DeliveryStreamARN:    &ds.arn,
 			DeliveryStreamStatus: types.DeliveryStreamStatusActive,
 			DeliveryStreamName:   &ds.deliveryStreamName,
 			DeliveryStreamType:   ds.deliveryStreamType,
-			Destinations:         []types.DestinationDescription{*ds.destDesc},
-			Source:               ds.sourceDesc,
+			Destinations:         []types.DestinationDescription{destDesc},
+			Source:               sourceDesc,
 			VersionId:            aws.String("1"),
+			HasMoreDestinations:  aws.Bool(false),
 		},
 	}
 
@@ -0,0 +1,92 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestDeliveryStreamServiceInProcess(t *testing.T) {
+	ctx := context.Background()
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		S3InjectedConf: S3InjectedConf{
+			DisableBuffering: true,
+			InMemory:         true,
+		},
+	})
+	svc := d.Service()
+	streamName := "in-process-stream"
+
+	if _, err := svc.Describe(ctx, &firehose.DescribeDeliveryStreamInput{}); err == nil {
+		t.Error("error should exists for missing DeliveryStreamName")
+	} else {
+		var invalidArg *fhtypes.InvalidArgumentException
+		if !errors.As(err, &invalidArg) {
+			t.Errorf("unexpected error type: %v", err)
+		}
+	}
+
+	cout, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+			BucketARN: aws.String("arn:aws:s3:::in-process-bucket"),
+			RoleARN:   aws.String("foo"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dout, err := svc.Describe(ctx, &firehose.DescribeDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := dout.DeliveryStreamDescription
+	if *desc.DeliveryStreamARN != *cout.DeliveryStreamARN {
+		t.Errorf("unexpected DeliveryStreamARN: %s", *desc.DeliveryStreamARN)
+	}
+	if desc.DeliveryStreamType != fhtypes.DeliveryStreamTypeDirectPut {
+		t.Errorf("unexpected DeliveryStreamType: %s", desc.DeliveryStreamType)
+	}
+	if desc.CreateTimestamp == nil || desc.CreateTimestamp.IsZero() {
+		t.Error("CreateTimestamp is missing")
+	}
+
+	pout, err := svc.Put(ctx, &firehose.PutRecordInput{
+		DeliveryStreamName: &streamName,
+		Record:             &fhtypes.Record{Data: []byte("in-process\n")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	deliveries, err := d.WaitForDeliveries(waitCtx, streamName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := deliveries[0].RecordIDs; len(ids) != 1 || ids[0] != *pout.RecordId {
+		t.Errorf("unexpected record ids: %v", ids)
+	}
+
+	if _, err := svc.Delete(ctx, &firehose.DeleteDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var notFound *fhtypes.ResourceNotFoundException
+	if _, err := svc.Put(ctx, &firehose.PutRecordInput{
+		DeliveryStreamName: &streamName,
+		Record:             &fhtypes.Record{Data: []byte("in-process\n")},
+	}); !errors.As(err, &notFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package toyhose
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// Destination represents delivery target which consumes records of a delivery stream.
+type Destination interface {
+	// Run consumes records until recordCh is closed or ctx is done.
+	Run(ctx context.Context, recordCh <-chan *DeliveryRecord)
+	// Description returns destination description for DescribeDeliveryStream.
+	Description() types.DestinationDescription
+}
+
+// Source represents producer of records for a delivery stream which is not DirectPut.
+type Source interface {
+	// Run sends records to recordCh until ctx is done.
+	Run(ctx context.Context, recordCh chan<- *DeliveryRecord)
+	// Description returns source description for DescribeDeliveryStream.
+	Description() types.SourceDescription
+}
+
+// Flusher is implemented by Destination which can deliver buffered records on demand.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Pauser is implemented by Destination which can hold delivery while it keeps buffering records.
+type Pauser interface {
+	Pause(ctx context.Context) error
+	Resume(ctx context.Context) error
+}
+
+// BufferStatus represents current buffer state of Destination.
+type BufferStatus struct {
+	Records     int  `json:"Records"`
+	SizeInBytes int  `json:"SizeInBytes"`
+	Paused      bool `json:"Paused"`
+	// UploadsInFlight is the number of deliveries running apart from the buffer.
+	UploadsInFlight int `json:"UploadsInFlight,omitempty"`
+	// SizeLimitInBytes and IntervalInSeconds are effective BufferingHints. zero means unknown.
+	SizeLimitInBytes  int `json:"SizeLimitInBytes,omitempty"`
+	IntervalInSeconds int `json:"IntervalInSeconds,omitempty"`
+}
+
+// BufferInspector is implemented by Destination which can report its buffer state.
+type BufferInspector interface {
+	BufferStatus(ctx context.Context) (BufferStatus, error)
+}
+
+// deliveryWaiter is implemented by Destination which delivers apart from its buffering loop.
+type deliveryWaiter interface {
+	waitDeliveries(ctx context.Context) error
+}
+
+// deliveryAborter is implemented by Destination whose deliveries in progress can be cut short,
+// so that records not delivered yet are spilled or dropped instead of being retried.
+type deliveryAborter interface {
+	abortDeliveries()
+}
+
+// DestinationFactory builds Destination from CreateDeliveryStream request.
+type DestinationFactory func(ctx context.Context, input *firehose.CreateDeliveryStreamInput) (Destination, error)
+
+// SourceFactory builds Source from CreateDeliveryStream request.
+type SourceFactory func(ctx context.Context, input *firehose.CreateDeliveryStreamInput) (Source, error)
+
+// DestinationType represents name of destination configuration in CreateDeliveryStream request.
+type DestinationType string
+
+// Destination configuration types of CreateDeliveryStream request.
+const (
+	DestinationTypeS3                         DestinationType = "S3DestinationConfiguration"
+	DestinationTypeExtendedS3                 DestinationType = "ExtendedS3DestinationConfiguration"
+	DestinationTypeRedshift                   DestinationType = "RedshiftDestinationConfiguration"
+	DestinationTypeElasticsearch              DestinationType = "ElasticsearchDestinationConfiguration"
+	DestinationTypeAmazonopensearchservice    DestinationType = "AmazonopensearchserviceDestinationConfiguration"
+	DestinationTypeAmazonOpenSearchServerless DestinationType = "AmazonOpenSearchServerlessDestinationConfiguration"
+	DestinationTypeSplunk                     DestinationType = "SplunkDestinationConfiguration"
+	DestinationTypeHTTPEndpoint               DestinationType = "HttpEndpointDestinationConfiguration"
+	DestinationTypeSnowflake                  DestinationType = "SnowflakeDestinationConfiguration"
+	DestinationTypeIceberg                    DestinationType = "IcebergDestinationConfiguration"
+)
+
+// destinationTypesOf returns destination configuration types supplied in input.
+func destinationTypesOf(i *firehose.CreateDeliveryStreamInput) []DestinationType {
+	var dts []DestinationType
+	for _, c := range []struct {
+		dt       DestinationType
+		supplied bool
+	}{
+		{DestinationTypeS3, i.S3DestinationConfiguration != nil},
+		{DestinationTypeExtendedS3, i.ExtendedS3DestinationConfiguration != nil},
+		{DestinationTypeRedshift, i.RedshiftDestinationConfiguration != nil},
+		{DestinationTypeElasticsearch, i.ElasticsearchDestinationConfiguration != nil},
+		{DestinationTypeAmazonopensearchservice, i.AmazonopensearchserviceDestinationConfiguration != nil},
+		{DestinationTypeAmazonOpenSearchServerless, i.AmazonOpenSearchServerlessDestinationConfiguration != nil},
+		{DestinationTypeSplunk, i.SplunkDestinationConfiguration != nil},
+		{DestinationTypeHTTPEndpoint, i.HttpEndpointDestinationConfiguration != nil},
+		{DestinationTypeSnowflake, i.SnowflakeDestinationConfiguration != nil},
+		{DestinationTypeIceberg, i.IcebergDestinationConfiguration != nil},
+	} {
+		if c.supplied {
+			dts = append(dts, c.dt)
+		}
+	}
+	return dts
+}
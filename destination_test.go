@@ -0,0 +1,138 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+type spyDestination struct {
+	url      string
+	received chan *DeliveryRecord
+}
+
+func (d *spyDestination) Run(ctx context.Context, recordCh <-chan *DeliveryRecord) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r, ok := <-recordCh:
+			if !ok {
+				return
+			}
+			d.received <- r
+		}
+	}
+}
+
+func (d *spyDestination) Description() fhtypes.DestinationDescription {
+	return fhtypes.DestinationDescription{
+		HttpEndpointDestinationDescription: &fhtypes.HttpEndpointDestinationDescription{
+			EndpointConfiguration: &fhtypes.HttpEndpointDescription{Url: &d.url},
+		},
+	}
+}
+
+type fixedSource struct {
+	data [][]byte
+}
+
+func (s *fixedSource) Run(ctx context.Context, recordCh chan<- *DeliveryRecord) {
+	for _, d := range s.data {
+		select {
+		case <-ctx.Done():
+			return
+		case recordCh <- NewDeliveryRecord(d):
+		}
+	}
+}
+
+func (s *fixedSource) Description() fhtypes.SourceDescription {
+	return fhtypes.SourceDescription{}
+}
+
+func TestDestinationRegistry(t *testing.T) {
+	ctx := context.Background()
+	spy := &spyDestination{received: make(chan *DeliveryRecord, 10)}
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		Destinations: map[DestinationType]DestinationFactory{
+			DestinationTypeHTTPEndpoint: func(ctx context.Context, i *firehose.CreateDeliveryStreamInput) (Destination, error) {
+				spy.url = *i.HttpEndpointDestinationConfiguration.EndpointConfiguration.Url
+				return spy, nil
+			},
+		},
+		Sources: map[fhtypes.DeliveryStreamType]SourceFactory{
+			fhtypes.DeliveryStreamTypeMSKAsSource: func(ctx context.Context, i *firehose.CreateDeliveryStreamInput) (Source, error) {
+				return &fixedSource{data: [][]byte{[]byte("from-msk")}}, nil
+			},
+		},
+	})
+	svc := d.Service()
+
+	t.Run("unsupported destination", func(t *testing.T) {
+		_, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+			DeliveryStreamName: aws.String("splunk-stream"),
+			SplunkDestinationConfiguration: &fhtypes.SplunkDestinationConfiguration{
+				HECEndpoint: aws.String("http://localhost"),
+			},
+		})
+		var invalidArg *fhtypes.InvalidArgumentException
+		if !errors.As(err, &invalidArg) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("custom destination and source", func(t *testing.T) {
+		streamName := "http-endpoint-stream"
+		if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+			DeliveryStreamName: &streamName,
+			DeliveryStreamType: fhtypes.DeliveryStreamTypeMSKAsSource,
+			HttpEndpointDestinationConfiguration: &fhtypes.HttpEndpointDestinationConfiguration{
+				EndpointConfiguration: &fhtypes.HttpEndpointConfiguration{
+					Url: aws.String("http://localhost:8080"),
+				},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_, _ = svc.Delete(ctx, &firehose.DeleteDeliveryStreamInput{DeliveryStreamName: &streamName})
+		})
+		if _, err := svc.Put(ctx, &firehose.PutRecordInput{
+			DeliveryStreamName: &streamName,
+			Record:             &fhtypes.Record{Data: []byte("from-put")},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		received := map[string]bool{}
+		for len(received) < 2 {
+			select {
+			case r := <-spy.received:
+				received[string(r.Data)] = true
+			case <-time.After(5 * time.Second):
+				t.Fatalf("records not received: %v", received)
+			}
+		}
+		if !received["from-msk"] || !received["from-put"] {
+			t.Errorf("unexpected records received: %v", received)
+		}
+
+		out, err := svc.Describe(ctx, &firehose.DescribeDeliveryStreamInput{DeliveryStreamName: &streamName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := out.DeliveryStreamDescription.Destinations[0].HttpEndpointDestinationDescription
+		if desc == nil || *desc.EndpointConfiguration.Url != "http://localhost:8080" {
+			t.Errorf("unexpected destination description: %#v", out.DeliveryStreamDescription.Destinations[0])
+		}
+		if out.DeliveryStreamDescription.Source == nil {
+			t.Error("source description is missing")
+		}
+	})
+}
@@ -1,22 +1,51 @@
 package toyhose
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
 	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
-	"github.com/google/uuid"
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // DispatcherConfig represents configuration data struct for Dispatcher.
 type DispatcherConfig struct {
 	S3InjectedConf      S3InjectedConf
 	KinesisInjectedConf KinesisInjectedConf
+	CloudWatchConf      CloudWatchConf
+	IngestConf          IngestConf
+	RetryConf           RetryConf
 	AWSConf             aws.Config
+	// Destinations registers custom destinations by configuration type.
+	// Registered factory takes precedence over built-in S3 destination.
+	Destinations map[DestinationType]DestinationFactory
+	// Sources registers custom sources by DeliveryStreamType.
+	// Registered factory takes precedence over built-in Kinesis consumer.
+	Sources map[types.DeliveryStreamType]SourceFactory
+	// TracerProvider receives spans of API calls, ingested records and deliveries.
+	// The global TracerProvider is used when nil.
+	TracerProvider trace.TracerProvider
+	// WebhookURLs receive DeliveryNotification of every stream.
+	WebhookURLs []string
+	// Clock and IDGenerator make toyhose deterministic when supplied,
+	// e.g. VirtualClock and NewSeededIDGenerator. The defaults are real time and random UUIDs.
+	Clock       Clock
+	IDGenerator IDGenerator
+	// LedgerMaxRecords bounds entries of the record ledger. The oldest entries are evicted beyond it.
+	// The default is 100000.
+	LedgerMaxRecords int
 }
 
 // S3InjectedConf represents injection to S3 destination BufferingHints forcely.
@@ -25,25 +54,89 @@ type S3InjectedConf struct {
 	IntervalInSeconds *int
 	EndPoint          *string
 	DisableBuffering  bool
+	// UploadConcurrency bounds uploads which run at once in each stream. The default is 4.
+	UploadConcurrency int
+	// MultipartPartSizeInMBs is the part size of multipart upload, which is used for objects larger than it.
+	// The default is 8, and sizes below 5, the minimum of S3, are raised to 5.
+	MultipartPartSizeInMBs int
+	// InMemory keeps delivered objects in memory instead of writing them to S3.
+	InMemory bool
 }
 
 // KinesisInjectedConf represents configuration of KinesisStream source.
 type KinesisInjectedConf struct {
 	Endpoint *string
+	// CheckpointDir keeps sequence numbers of records delivered from each shard, a file per delivery stream,
+	// so that restarted toyhose resumes after them. Kinesis sources start over on restart when it is empty.
+	CheckpointDir string
+	// ShardDiscoveryInterval is the interval of ListShards which finds shards added by resharding.
+	// Children of a shard read to its end are followed at once. The default is 10 seconds.
+	ShardDiscoveryInterval time.Duration
+	// EnhancedFanOut reads shards by SubscribeToShard through a consumer registered for each delivery stream,
+	// instead of polling GetRecords every second. Shards are polled when the endpoint does not support it.
+	EnhancedFanOut bool
+}
+
+const defaultShardDiscoveryInterval = 10 * time.Second
+
+func (c KinesisInjectedConf) shardDiscoveryInterval() time.Duration {
+	if c.ShardDiscoveryInterval > 0 {
+		return c.ShardDiscoveryInterval
+	}
+	return defaultShardDiscoveryInterval
 }
 
 // NewDispatcher returns Dispatcher object.
 func NewDispatcher(conf *DispatcherConfig) *Dispatcher {
-	return &Dispatcher{
+	d := &Dispatcher{
 		conf:                conf.AWSConf,
 		accountID:           "", // FIXME: Get AccountID from STS or other means if needed.
 		region:              conf.AWSConf.Region,
 		s3InjectedConf:      conf.S3InjectedConf,
 		kinesisInjectedConf: conf.KinesisInjectedConf,
+		cloudWatchConf:      conf.CloudWatchConf,
 		pool: &deliveryStreamPool{
 			pool: map[string]*deliveryStream{},
 		},
+		memory:    newMemoryStore(),
+		metrics:   newMetrics(),
+		errorLogs: newErrorLogger(conf.AWSConf, conf.CloudWatchConf, conf.Clock),
+		tracer:    tracerFrom(conf.TracerProvider),
+		ledger:    newLedger(conf.LedgerMaxRecords),
+		tail:      newTailHub(conf.Clock),
+		webhooks:  newWebhookNotifier(conf.WebhookURLs),
+		clock:     conf.Clock,
+		ids:       conf.IDGenerator,
+	}
+	if d.clock == nil {
+		d.clock = realClock{}
 	}
+	if d.ids == nil {
+		d.ids = randomIDGenerator{}
+	}
+	d.svc = &DeliveryStreamService{
+		awsConf:             d.conf,
+		region:              d.region,
+		accountID:           d.accountID,
+		s3InjectedConf:      d.s3InjectedConf,
+		kinesisInjectedConf: d.kinesisInjectedConf,
+		ingestConf:          conf.IngestConf,
+		budget:              newMemoryBudget(conf.IngestConf.MaxBufferedBytesTotal, d.metrics),
+		retryConf:           conf.RetryConf,
+		pool:                d.pool,
+		memory:              d.memory,
+		destinations:        conf.Destinations,
+		sources:             conf.Sources,
+		metrics:             d.metrics,
+		errorLogs:           d.errorLogs,
+		tracer:              d.tracer,
+		ledger:              d.ledger,
+		tail:                d.tail,
+		webhooks:            d.webhooks,
+		clock:               d.clock,
+		ids:                 d.ids,
+	}
+	return d
 }
 
 // Dispatcher represents firehose API handler.
@@ -53,13 +146,38 @@ type Dispatcher struct {
 	region              string
 	s3InjectedConf      S3InjectedConf
 	kinesisInjectedConf KinesisInjectedConf
+	cloudWatchConf      CloudWatchConf
 	pool                *deliveryStreamPool
+	memory              *memoryStore
+	metrics             *metrics
+	errorLogs           *errorLogger
+	tracer              trace.Tracer
+	ledger              *ledger
+	tail                *tailHub
+	webhooks            *webhookNotifier
+	clock               Clock
+	ids                 IDGenerator
+	svc                 *DeliveryStreamService
+}
+
+// Service returns DeliveryStreamService for driving toyhose in-process without HTTP.
+func (d *Dispatcher) Service() *DeliveryStreamService {
+	return d.svc
 }
 
 // Dispatch handlers HTTP request as http.HandlerFunc interface.
 func (d *Dispatcher) Dispatch(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	reqID := uuid.New().String()
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	// request IDs are kept out of IDGenerator, so that retried or extra requests
+	// do not shift the seeded sequence of record IDs and object keys.
+	reqID := randomIDGenerator{}.NewID()
+	ctx, span := d.tracer.Start(ctx, "Firehose", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("rpc.service", "Firehose"),
+		attrRequestID.String(reqID),
+	))
+	var err error
+	defer func() { endSpan(span, err) }()
 	w.Header().Add("x-amzn-RequestId", reqID)
 	w.Header().Add("Content-Type", r.Header.Get("Content-Type"))
 	op, err := parseTarget(r.Header.Get("X-Amz-Target"))
@@ -67,46 +185,88 @@ func (d *Dispatcher) Dispatch(w http.ResponseWriter, r *http.Request) {
 		outputForJSON(w, nil, err)
 		return
 	}
+	span.SetName("Firehose." + op)
+	span.SetAttributes(attribute.String("rpc.method", op))
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		outputForJSON(w, nil, err)
 		return
 	}
-	if err := verifyV4(ctx, d.conf, r, bodyBytes); err != nil {
+	if err = verifyV4(ctx, d.conf, r, bodyBytes); err != nil {
 		outputForJSON(w, nil, err)
 		return
 	}
-	svc := &DeliveryStreamService{
-		awsConf:             d.conf,
-		region:              d.region,
-		accountID:           d.accountID,
-		s3InjectedConf:      d.s3InjectedConf,
-		kinesisInjectedConf: d.kinesisInjectedConf,
-		pool:                d.pool,
-	}
+	svc := d.svc
 	switch op {
 	case "CreateDeliveryStream":
-		out, err := svc.Create(ctx, bodyBytes)
-		outputForJSON(w, out, err)
+		err = dispatchJSON(ctx, w, bodyBytes, svc.Create)
 	case "DeleteDeliveryStream":
-		out, err := svc.Delete(ctx, bodyBytes)
-		outputForJSON(w, out, err)
+		err = dispatchJSON(ctx, w, bodyBytes, svc.Delete)
 	case "PutRecord":
-		out, err := svc.Put(ctx, bodyBytes)
-		outputForJSON(w, out, err)
+		err = dispatchJSON(ctx, w, bodyBytes, svc.Put)
 	case "PutRecordBatch":
-		out, err := svc.PutBatch(ctx, bodyBytes)
-		outputForJSON(w, out, err)
+		err = dispatchJSON(ctx, w, bodyBytes, svc.PutBatch)
 	case "ListDeliveryStreams":
-		out, err := svc.Listing(ctx, bodyBytes)
-		outputForJSON(w, out, err)
+		err = dispatchJSON(ctx, w, bodyBytes, svc.Listing)
 	case "DescribeDeliveryStream":
 		// Use custom struct for JSON marshaling
-		out, err := svc.Describe(ctx, bodyBytes)
-		outputForJSON(w, out, err)
+		err = dispatchJSON(ctx, w, bodyBytes, func(ctx context.Context, i *firehose.DescribeDeliveryStreamInput) (*DescribeDeliveryStreamOutputForJSON, error) {
+			out, err := svc.Describe(ctx, i)
+			if err != nil {
+				return nil, err
+			}
+			return describeOutputForJSON(out), nil
+		})
 	default:
 		// Consider creating a new error type for v2 or using a generic one
-		outputForJSON(w, nil, errors.New("InvalidAction: invalid action received"))
+		err = errors.New("InvalidAction: invalid action received")
+		outputForJSON(w, nil, err)
+	}
+}
+
+// dispatchJSON unmarshals request body to input of fn and writes its output as JSON.
+// returned error is the one written to w.
+func dispatchJSON[I, O any](ctx context.Context, w http.ResponseWriter, body []byte, fn func(context.Context, *I) (O, error)) error {
+	i := new(I)
+	if err := json.Unmarshal(body, i); err != nil {
+		err = fmt.Errorf("unmarshal error: %w", err)
+		outputForJSON(w, nil, err)
+		return err
+	}
+	out, err := fn(ctx, i)
+	outputForJSON(w, out, err)
+	return err
+}
+
+// Custom type for JSON marshaling
+type DeliveryStreamDescriptionForJSON struct {
+	CreateTimestamp      int64                          `json:"CreateTimestamp"`
+	DeliveryStreamARN    *string                        `json:"DeliveryStreamARN"`
+	DeliveryStreamStatus types.DeliveryStreamStatus     `json:"DeliveryStreamStatus"`
+	DeliveryStreamName   *string                        `json:"DeliveryStreamName"`
+	DeliveryStreamType   types.DeliveryStreamType       `json:"DeliveryStreamType"`
+	Destinations         []types.DestinationDescription `json:"Destinations"`
+	Source               *types.SourceDescription       `json:"Source"`
+	VersionId            *string                        `json:"VersionId"`
+}
+
+type DescribeDeliveryStreamOutputForJSON struct {
+	DeliveryStreamDescription DeliveryStreamDescriptionForJSON `json:"DeliveryStreamDescription"`
+}
+
+func describeOutputForJSON(out *firehose.DescribeDeliveryStreamOutput) *DescribeDeliveryStreamOutputForJSON {
+	desc := out.DeliveryStreamDescription
+	return &DescribeDeliveryStreamOutputForJSON{
+		DeliveryStreamDescription: DeliveryStreamDescriptionForJSON{
+			CreateTimestamp:      desc.CreateTimestamp.Unix(),
+			DeliveryStreamARN:    desc.DeliveryStreamARN,
+			DeliveryStreamStatus: desc.DeliveryStreamStatus,
+			DeliveryStreamName:   desc.DeliveryStreamName,
+			DeliveryStreamType:   desc.DeliveryStreamType,
+			Destinations:         desc.Destinations,
+			Source:               desc.Source,
+			VersionId:            desc.VersionId,
+		},
 	}
 }
 
@@ -125,19 +285,32 @@ func outputForJSON(w http.ResponseWriter, out interface{}, err error) {
 
 	// Simplified error handling for now.
 	// TODO: Implement proper error type checking for v2 SDK errors.
-	var resourceNotFoundException *types.ResourceNotFoundException
-	if errors.As(err, &resourceNotFoundException) {
+	var (
+		resourceNotFoundException   *types.ResourceNotFoundException
+		serviceUnavailableException *types.ServiceUnavailableException
+	)
+	switch {
+	case errors.As(err, &resourceNotFoundException):
 		w.WriteHeader(http.StatusNotFound)
-	} else {
+	case errors.As(err, &serviceUnavailableException):
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
 		w.WriteHeader(http.StatusBadRequest)
 	}
 
 	// Create a serializable error message
 	errMsg := struct {
+		Type    string `json:"__type,omitempty"`
 		Message string `json:"message"`
 	}{
 		Message: err.Error(),
 	}
+	// __type lets AWS SDK clients decode the error into its exception type.
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		errMsg.Type = apiErr.ErrorCode()
+		errMsg.Message = apiErr.ErrorMessage()
+	}
 	if err2 := json.NewEncoder(w).Encode(errMsg); err2 != nil {
 		log.Error().Err(err2).Msg("failed to decode output error json")
 	}
@@ -0,0 +1,198 @@
+package toyhose
+
+import (
+	"context"
+	"sync"
+)
+
+// IngestConf bounds records which are accepted by PutRecord and PutRecordBatch
+// but not yet taken by destination. Puts beyond the bounds fail with ServiceUnavailableException.
+type IngestConf struct {
+	// MaxBufferedBytesPerStream is the byte budget of each stream. The default is 32MiB.
+	MaxBufferedBytesPerStream int
+	// MaxBufferedRecordsPerStream is the record budget of each stream. The default is 10000.
+	MaxBufferedRecordsPerStream int
+	// MaxBufferedBytesTotal is the byte budget of S3 destination buffers and their uploads,
+	// shared by every stream. When it is hit, the largest buffers are flushed before BufferingHints,
+	// and puts fail until uploads finish. The default is 1GiB.
+	MaxBufferedBytesTotal int
+}
+
+const (
+	defaultMaxBufferedBytesPerStream   = 32 * 1024 * 1024
+	defaultMaxBufferedRecordsPerStream = 10000
+)
+
+func (c IngestConf) maxBytes() int {
+	if c.MaxBufferedBytesPerStream > 0 {
+		return c.MaxBufferedBytesPerStream
+	}
+	return defaultMaxBufferedBytesPerStream
+}
+
+func (c IngestConf) maxRecords() int {
+	if c.MaxBufferedRecordsPerStream > 0 {
+		return c.MaxBufferedRecordsPerStream
+	}
+	return defaultMaxBufferedRecordsPerStream
+}
+
+// ingestQueue holds accepted records until destination receives them, so that slow destination
+// makes puts fail fast instead of blocking them.
+// A record takes its room when it is pushed, and releases it once pump hands it to destination.
+type ingestQueue struct {
+	mutex      sync.Mutex
+	records    []*DeliveryRecord
+	bytes      int
+	count      int
+	maxBytes   int
+	maxRecords int
+	// pushed and handed count records, so that sync can wait for records pushed before it.
+	pushed  uint64
+	handed  uint64
+	closed  bool
+	stopped bool
+	ready   chan struct{}
+	// notify is closed and replaced whenever handed advances or pump stops.
+	notify chan struct{}
+}
+
+func newIngestQueue(conf IngestConf) *ingestQueue {
+	return &ingestQueue{
+		maxBytes:   conf.maxBytes(),
+		maxRecords: conf.maxRecords(),
+		ready:      make(chan struct{}, 1),
+		notify:     make(chan struct{}),
+	}
+}
+
+// push takes room for a record of size bytes and enqueues the record built by accept, in one critical section,
+// so that a record is never dropped after it is accepted. It returns false without calling accept
+// when the queue is closed or the budget is exhausted.
+// A record larger than the whole byte budget is accepted only into an empty queue.
+func (q *ingestQueue) push(size int, accept func() *DeliveryRecord) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed || q.count >= q.maxRecords || (q.count > 0 && q.bytes+size > q.maxBytes) {
+		return false
+	}
+	q.count++
+	q.bytes += size
+	q.records = append(q.records, accept())
+	q.pushed++
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (q *ingestQueue) pop(ctx context.Context) *DeliveryRecord {
+	for {
+		q.mutex.Lock()
+		if len(q.records) > 0 {
+			rec := q.records[0]
+			q.records[0] = nil
+			q.records = q.records[1:]
+			q.mutex.Unlock()
+			return rec
+		}
+		closed := q.closed
+		q.mutex.Unlock()
+		if closed {
+			return nil
+		}
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (q *ingestQueue) handOff(rec *DeliveryRecord) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.count--
+	q.bytes -= len(rec.Data)
+	q.handed++
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// close stops accepting records. pump hands remaining records and returns.
+func (q *ingestQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// isClosed reports whether the queue stopped accepting records.
+func (q *ingestQueue) isClosed() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.closed
+}
+
+// pump sends queued records to recordCh until the queue is closed and empty, or ctx is done.
+// records left behind are released.
+func (q *ingestQueue) pump(ctx context.Context, recordCh chan<- *DeliveryRecord) {
+	defer q.stop()
+	for {
+		rec := q.pop(ctx)
+		if rec == nil {
+			return
+		}
+		select {
+		case recordCh <- rec:
+			q.handOff(rec)
+		case <-ctx.Done():
+			q.handOff(rec)
+			return
+		}
+	}
+}
+
+func (q *ingestQueue) stop() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, rec := range q.records {
+		q.count--
+		q.bytes -= len(rec.Data)
+	}
+	q.records = nil
+	q.closed = true
+	q.stopped = true
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// sync waits until records pushed so far are received by destination,
+// so that control commands sent after it see those records.
+func (q *ingestQueue) sync(ctx context.Context) error {
+	q.mutex.Lock()
+	target := q.pushed
+	for q.handed < target && !q.stopped {
+		notify := q.notify
+		q.mutex.Unlock()
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		q.mutex.Lock()
+	}
+	q.mutex.Unlock()
+	return nil
+}
+
+// usage returns reserved bytes and records.
+func (q *ingestQueue) usage() (int, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.bytes, q.count
+}
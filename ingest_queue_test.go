@@ -0,0 +1,193 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// gatedDestination receives nothing until gate is closed.
+type gatedDestination struct {
+	gate chan struct{}
+}
+
+func (d *gatedDestination) Run(ctx context.Context, recordCh <-chan *DeliveryRecord) {
+	select {
+	case <-d.gate:
+	case <-ctx.Done():
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-recordCh:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+func (d *gatedDestination) Description() fhtypes.DestinationDescription {
+	return fhtypes.DestinationDescription{}
+}
+
+func TestIngestQueue(t *testing.T) {
+	ctx := context.Background()
+	q := newIngestQueue(IngestConf{MaxBufferedBytesPerStream: 10, MaxBufferedRecordsPerStream: 3})
+	push := func(size int) bool {
+		return q.push(size, func() *DeliveryRecord {
+			return NewDeliveryRecord(make([]byte, size))
+		})
+	}
+	if !push(20) {
+		t.Error("record larger than budget should be accepted into empty queue")
+	}
+	if push(1) {
+		t.Error("byte budget is exceeded")
+	}
+	q.handOff(q.pop(ctx))
+	for i := 0; i < 3; i++ {
+		if !push(1) {
+			t.Fatalf("record %d should be accepted", i)
+		}
+	}
+	if push(0) {
+		t.Error("record budget is exceeded")
+	}
+	if b, c := q.usage(); b != 3 || c != 3 {
+		t.Errorf("unexpected usage: %d bytes, %d records", b, c)
+	}
+	q.close()
+	q.handOff(q.pop(ctx))
+	if q.push(1, func() *DeliveryRecord {
+		t.Error("record is built for closed queue")
+		return NewDeliveryRecord([]byte("x"))
+	}) {
+		t.Error("closed queue accepts record")
+	}
+}
+
+func TestIngestBackpressure(t *testing.T) {
+	ctx := context.Background()
+	dest := &gatedDestination{gate: make(chan struct{})}
+	awsConf := awsConfig(t)
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConf,
+		IngestConf: IngestConf{
+			MaxBufferedRecordsPerStream: 2,
+		},
+		Destinations: map[DestinationType]DestinationFactory{
+			DestinationTypeHTTPEndpoint: func(ctx context.Context, i *firehose.CreateDeliveryStreamInput) (Destination, error) {
+				return dest, nil
+			},
+		},
+	})
+	testserver := httptest.NewServer(http.HandlerFunc(d.Dispatch))
+	defer testserver.Close()
+
+	svc := d.Service()
+	streamName := "backpressure-stream"
+	if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		HttpEndpointDestinationConfiguration: &fhtypes.HttpEndpointDestinationConfiguration{
+			EndpointConfiguration: &fhtypes.HttpEndpointConfiguration{
+				Url: aws.String("http://localhost:8080"),
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("batch fails per entry", func(t *testing.T) {
+		out, err := svc.PutBatch(ctx, &firehose.PutRecordBatchInput{
+			DeliveryStreamName: &streamName,
+			Records: []fhtypes.Record{
+				{Data: []byte("first!")},
+				{Data: []byte("second!")},
+				{Data: []byte("third!")},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *out.FailedPutCount != 1 {
+			t.Fatalf("unexpected FailedPutCount: %d", *out.FailedPutCount)
+		}
+		for i, e := range out.RequestResponses[:2] {
+			if e.RecordId == nil || e.ErrorCode != nil {
+				t.Errorf("entry %d should be accepted: %#v", i, e)
+			}
+		}
+		if e := out.RequestResponses[2]; e.RecordId != nil || aws.ToString(e.ErrorCode) != "ServiceUnavailableException" {
+			t.Errorf("entry 2 should be throttled: %#v", e)
+		}
+	})
+
+	t.Run("put fails with ServiceUnavailableException", func(t *testing.T) {
+		fh := firehose.NewFromConfig(awsConf, func(o *firehose.Options) {
+			o.BaseEndpoint = aws.String(testserver.URL)
+			o.RetryMaxAttempts = 1
+		})
+		_, err := fh.PutRecord(ctx, &firehose.PutRecordInput{
+			DeliveryStreamName: &streamName,
+			Record:             &fhtypes.Record{Data: []byte("fourth!")},
+		})
+		var unavailable *fhtypes.ServiceUnavailableException
+		if !errors.As(err, &unavailable) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if aws.ToString(unavailable.Message) != errSlowDown {
+			t.Errorf("unexpected message: %s", aws.ToString(unavailable.Message))
+		}
+	})
+
+	t.Run("canceled request", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := svc.Put(canceled, &firehose.PutRecordInput{
+			DeliveryStreamName: &streamName,
+			Record:             &fhtypes.Record{Data: []byte("fifth!")},
+		}); !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("accepts again after destination catches up", func(t *testing.T) {
+		close(dest.gate)
+		ds, err := svc.find(&streamName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ds.sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := svc.Put(ctx, &firehose.PutRecordInput{
+			DeliveryStreamName: &streamName,
+			Record:             &fhtypes.Record{Data: []byte("sixth!")},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	rec := httptest.NewRecorder()
+	d.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	b, _ := io.ReadAll(rec.Body)
+	for _, expected := range []string{
+		`firehose_incoming_records_total{delivery_stream_name="backpressure-stream"} 3`,
+		`firehose_throttled_records_total{delivery_stream_name="backpressure-stream"} 2`,
+	} {
+		if !strings.Contains(string(b), expected) {
+			t.Errorf("metric not found: %s", expected)
+		}
+	}
+}
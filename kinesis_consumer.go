@@ -33,7 +33,9 @@ func getStreamNameFromARN(conf aws.Config, arn string) (string, error) {
 	return matches[3], nil
 }
 
-func newKinesisConsumer(ctx context.Context, conf aws.Config, sourceConf *fhtypes.KinesisStreamSourceConfiguration, injectConf KinesisInjectedConf) (*kinesisConsumer, error) {
+// newKinesisConsumer returns consumer of the stream which starts at startedAt,
+// or resumes from the checkpoint of deliveryName saved under KinesisInjectedConf.CheckpointDir.
+func newKinesisConsumer(ctx context.Context, conf aws.Config, sourceConf *fhtypes.KinesisStreamSourceConfiguration, injectConf KinesisInjectedConf, deliveryName string, startedAt time.Time) (*kinesisConsumer, error) {
 	arn := sourceConf.KinesisStreamARN
 	if arn == nil {
 		return nil, &fhtypes.InvalidArgumentException{Message: aws.String("StreamARN not found")}
@@ -59,71 +61,313 @@ func newKinesisConsumer(ctx context.Context, conf aws.Config, sourceConf *fhtype
 	if desc.StreamStatus != types.StreamStatusActive {
 		return nil, &fhtypes.ServiceUnavailableException{Message: aws.String(fmt.Sprintf("stream status is %s", desc.StreamStatus))}
 	}
-	shardIter := map[string]string{}
-	for _, shard := range desc.Shards {
-		out, err := cli.GetShardIterator(ctx, &kinesis.GetShardIteratorInput{
-			StreamName:        &streamName,
-			ShardId:           shard.ShardId,
-			ShardIteratorType: types.ShardIteratorTypeTrimHorizon,
-		})
-		if err != nil {
-			return nil, &fhtypes.ServiceUnavailableException{Message: aws.String("failed to get shard iterator")}
+	store := newCheckpointStore(injectConf.CheckpointDir)
+	cp, err := store.load(deliveryName)
+	if err != nil {
+		log.Error().Err(err).Str("delivery_stream", deliveryName).Msg("failed to load checkpoint. starting over")
+	}
+	if cp != nil && cp.KinesisStreamARN != *arn {
+		log.Warn().Str("delivery_stream", deliveryName).Str("checkpoint_stream_arn", cp.KinesisStreamARN).Msg("checkpoint is of another stream. starting over")
+		cp = nil
+	}
+	if cp == nil {
+		cp = &kinesisCheckpoint{
+			KinesisStreamARN:       *arn,
+			DeliveryStartTimestamp: startedAt,
+			Shards:                 map[string]string{},
 		}
-		shardIter[*shard.ShardId] = *out.ShardIterator
+		// saved before any delivery, so that restart keeps DeliveryStartTimestamp.
+		if err := store.save(deliveryName, cp); err != nil {
+			log.Error().Err(err).Str("delivery_stream", deliveryName).Msg("failed to save checkpoint")
+		}
+	} else {
+		log.Info().Str("delivery_stream", deliveryName).Int("shards", len(cp.Shards)).Msg("resuming from checkpoint")
+	}
+	c := &kinesisConsumer{
+		streamName:        streamName,
+		cli:               cli,
+		sourceConf:        sourceConf,
+		startedAt:         cp.DeliveryStartTimestamp,
+		checkpoints:       newCheckpointer(store, deliveryName, cp),
+		discoveryInterval: injectConf.shardDiscoveryInterval(),
+		streamARN:         aws.ToString(desc.StreamARN),
+		enhancedFanOut:    injectConf.EnhancedFanOut,
+	}
+	if c.streamARN == "" {
+		c.streamARN = *arn
+	}
+	shards, err := c.listShards(ctx)
+	if err != nil {
+		return nil, &fhtypes.ServiceUnavailableException{Message: aws.String("failed to list shards")}
 	}
-	return &kinesisConsumer{
-		streamName: streamName,
-		cli:        cli,
-		shardIter:  shardIter,
-	}, nil
+	c.shards = shards
+	return c, nil
 }
 
 type kinesisConsumer struct {
 	streamName string
 	cli        *kinesis.Client
-	shardIter  map[string]string
+	sourceConf *fhtypes.KinesisStreamSourceConfiguration
+	startedAt  time.Time
+	// deliveryName, metrics, ledger, tail, clock and ids are supplied by DeliveryStreamService.
+	deliveryName string
+	metrics      *metrics
+	ledger       *ledger
+	tail         *tailHub
+	clock        Clock
+	ids          IDGenerator
+
+	// checkpoints acknowledges delivered records, so that the consumer resumes after them.
+	checkpoints *checkpointer
+	// shards is listed at creation, and discovered again every discoveryInterval while Run.
+	shards            []types.Shard
+	discoveryInterval time.Duration
+	// streamARN is where a consumer of enhanced fan-out is registered, and consumerARN is the registered one.
+	// consumerARN is empty while shards are polled by GetRecords.
+	streamARN      string
+	enhancedFanOut bool
+	consumerARN    string
 }
 
-func (c *kinesisConsumer) Run(ctx context.Context, recordCh chan *deliveryRecord) {
+func (c *kinesisConsumer) Description() fhtypes.SourceDescription {
+	return fhtypes.SourceDescription{
+		KinesisStreamSourceDescription: &fhtypes.KinesisStreamSourceDescription{
+			DeliveryStartTimestamp: &c.startedAt,
+			KinesisStreamARN:       c.sourceConf.KinesisStreamARN,
+			RoleARN:                c.sourceConf.RoleARN,
+		},
+	}
+}
+
+// shardEnd tells Run that a shard is read to its end, with children which continue it.
+type shardEnd struct {
+	shardID  string
+	children []types.ChildShard
+}
+
+func (c *kinesisConsumer) Run(ctx context.Context, recordCh chan<- *DeliveryRecord) {
 	log.Debug().Str("stream_name", c.streamName).Msg("starting to subscribe stream")
 	wg := &sync.WaitGroup{}
-	wg.Add(len(c.shardIter))
-	for shardID, iter := range c.shardIter {
-		go func(shardID, iter string) {
-			defer wg.Done()
-			currentIter := iter
-			for {
+	defer func() {
+		wg.Wait()
+		log.Debug().Str("stream_name", c.streamName).Msg("ended to subscribe stream")
+	}()
+	if c.enhancedFanOut {
+		c.consumerARN = c.registerConsumer(ctx)
+	}
+	lineage := newShardLineage()
+	for _, shard := range c.shards {
+		lineage.add(*shard.ShardId, aws.ToString(shard.ParentShardId), aws.ToString(shard.AdjacentParentShardId))
+	}
+	ended := make(chan shardEnd)
+	start := func() {
+		for _, shardID := range lineage.ready() {
+			wg.Add(1)
+			go func(shardID string) {
+				defer wg.Done()
+				children, ok := c.consumeShard(ctx, shardID, recordCh)
+				if !ok {
+					return
+				}
 				select {
+				case ended <- shardEnd{shardID: shardID, children: children}:
 				case <-ctx.Done():
-					log.Debug().Str("shard_id", shardID).Msg("context canceled")
-					return
-				default:
 				}
+			}(shardID)
+		}
+	}
+	start()
+	// shards change in real time of Kinesis, so discovery does not wait for virtual clock.
+	discovery := newTicker(realClock{}, c.discoveryInterval)
+	defer discovery.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-discovery.C():
+			shards, err := c.listShards(ctx)
+			if err != nil {
+				log.Debug().Str("stream_name", c.streamName).Err(err).Msg("ListShards error")
+				continue
+			}
+			for _, shard := range shards {
+				lineage.add(*shard.ShardId, aws.ToString(shard.ParentShardId), aws.ToString(shard.AdjacentParentShardId))
+			}
+			start()
+		case e := <-ended:
+			log.Debug().Str("shard_id", e.shardID).Int("children", len(e.children)).Msg("shard is closed")
+			lineage.finish(e.shardID)
+			// children are known before next discovery, so that the split or merge is followed at once.
+			for _, child := range e.children {
+				lineage.add(*child.ShardId, child.ParentShards...)
+			}
+			start()
+		}
+	}
+}
 
-				out, err := c.cli.GetRecords(ctx, &kinesis.GetRecordsInput{
-					ShardIterator: &currentIter,
-				})
-				if err != nil {
-					log.Debug().Str("shard_id", shardID).Err(err).Msg("GetRecord error")
-					time.Sleep(time.Second)
-					continue
-				}
-				if l := len(out.Records); l > 0 {
-					log.Debug().Str("shard_id", shardID).Msgf("captured %d records", l)
-				}
-				for _, record := range out.Records {
-					recordCh <- newDeliveryRecord(record.Data)
-				}
-				if out.NextShardIterator == nil {
-					log.Debug().Str("shard_id", shardID).Msg("NextShardIterator is nil, finishing subscription")
-					return
+// listShards returns every shard of the stream, including closed ones within retention.
+func (c *kinesisConsumer) listShards(ctx context.Context) ([]types.Shard, error) {
+	var shards []types.Shard
+	in := &kinesis.ListShardsInput{StreamName: &c.streamName}
+	for {
+		out, err := c.cli.ListShards(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, out.Shards...)
+		if out.NextToken == nil {
+			return shards, nil
+		}
+		// StreamName must not be given with NextToken.
+		in = &kinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+}
+
+// shardCursor is progress of reading a shard in this run.
+type shardCursor struct {
+	shardID string
+	// lastSequence is the last record read, where reading continues after an iterator expires or a subscription ends.
+	lastSequence string
+}
+
+// consumeShard sends records of shardID to recordCh until the shard is closed, and returns its children.
+// It returns false when ctx is done.
+func (c *kinesisConsumer) consumeShard(ctx context.Context, shardID string, recordCh chan<- *DeliveryRecord) ([]types.ChildShard, bool) {
+	cur := &shardCursor{shardID: shardID}
+	if c.consumerARN != "" {
+		children, ok, err := c.subscribeShard(ctx, cur, recordCh)
+		if err == nil {
+			return children, ok
+		}
+		log.Warn().Str("shard_id", shardID).Err(err).Msg("SubscribeToShard is not available. falling back to polling")
+	}
+	return c.readShard(ctx, cur, recordCh)
+}
+
+// startingPosition returns position after the last record read, or after the checkpoint of the shard.
+// A shard without either is read from DeliveryStartTimestamp.
+func (c *kinesisConsumer) startingPosition(cur *shardCursor) *types.StartingPosition {
+	after := cur.lastSequence
+	if after == "" {
+		after, _ = c.checkpoints.sequence(cur.shardID)
+	}
+	if after != "" {
+		return &types.StartingPosition{Type: types.ShardIteratorTypeAfterSequenceNumber, SequenceNumber: &after}
+	}
+	return &types.StartingPosition{Type: types.ShardIteratorTypeAtTimestamp, Timestamp: aws.Time(c.startedAt)}
+}
+
+func (c *kinesisConsumer) shardIterator(ctx context.Context, cur *shardCursor) (string, error) {
+	pos := c.startingPosition(cur)
+	out, err := c.cli.GetShardIterator(ctx, &kinesis.GetShardIteratorInput{
+		StreamName:             &c.streamName,
+		ShardId:                &cur.shardID,
+		ShardIteratorType:      pos.Type,
+		StartingSequenceNumber: pos.SequenceNumber,
+		Timestamp:              pos.Timestamp,
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.ShardIterator), nil
+}
+
+// readShard polls records of the shard by GetRecords.
+func (c *kinesisConsumer) readShard(ctx context.Context, cur *shardCursor, recordCh chan<- *DeliveryRecord) ([]types.ChildShard, bool) {
+	currentIter := ""
+	for {
+		if currentIter == "" {
+			iter, err := c.shardIterator(ctx, cur)
+			if err != nil {
+				log.Debug().Str("shard_id", cur.shardID).Err(err).Msg("GetShardIterator error")
+				if !sleepContext(ctx, time.Second) {
+					return nil, false
 				}
-				currentIter = *out.NextShardIterator
-				time.Sleep(time.Second)
+				continue
 			}
-		}(shardID, iter)
+			currentIter = iter
+		}
+
+		started := time.Now()
+		out, err := c.cli.GetRecords(ctx, &kinesis.GetRecordsInput{
+			ShardIterator: &currentIter,
+		})
+		if ctx.Err() != nil {
+			log.Debug().Str("shard_id", cur.shardID).Msg("context canceled")
+			return nil, false
+		}
+		if err != nil {
+			var expired *types.ExpiredIteratorException
+			if errors.As(err, &expired) {
+				log.Debug().Str("shard_id", cur.shardID).Str("after", cur.lastSequence).Msg("shard iterator expired. acquiring again")
+				currentIter = ""
+				continue
+			}
+			log.Debug().Str("shard_id", cur.shardID).Err(err).Msg("GetRecord error")
+			if !sleepContext(ctx, time.Second) {
+				return nil, false
+			}
+			continue
+		}
+		if !c.send(ctx, cur, out.Records, out.MillisBehindLatest, time.Since(started), recordCh) {
+			return nil, false
+		}
+		if out.NextShardIterator == nil {
+			log.Debug().Str("shard_id", cur.shardID).Msg("NextShardIterator is nil, finishing subscription")
+			return out.ChildShards, true
+		}
+		currentIter = *out.NextShardIterator
+		if !sleepContext(ctx, time.Second) {
+			return nil, false
+		}
+	}
+}
+
+// send sends records read from the shard to recordCh. It returns false when ctx is done.
+// latency is of GetRecords, which is zero for records pushed by SubscribeToShard.
+func (c *kinesisConsumer) send(ctx context.Context, cur *shardCursor, records []types.Record, millisBehindLatest *int64, latency time.Duration, recordCh chan<- *DeliveryRecord) bool {
+	if l := len(records); l > 0 {
+		log.Debug().Str("shard_id", cur.shardID).Msgf("captured %d records", l)
 	}
-	wg.Wait()
+	size := 0
+	for _, record := range records {
+		users, aggregated := deaggregate(record.Data)
+		if !aggregated {
+			users = []userRecord{{data: record.Data, partitionKey: aws.ToString(record.PartitionKey)}}
+		}
+		for i, user := range users {
+			rec := newDeliveryRecord(user.data, c.clock, c.ids)
+			rec.PartitionKey = user.partitionKey
+			rec.ExplicitHashKey = user.explicitHashKey
+			seq := ""
+			if i == len(users)-1 {
+				seq = *record.SequenceNumber
+			}
+			rec.source = c.checkpoints.read(cur.shardID, seq)
+			c.ledger.buffered(c.deliveryName, []*DeliveryRecord{rec})
+			c.tail.records(TailStageAccepted, c.deliveryName, []*DeliveryRecord{rec})
+			select {
+			case recordCh <- rec:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		cur.lastSequence = *record.SequenceNumber
+		size += len(record.Data)
+	}
+	c.metrics.observeKinesisRead(c.deliveryName, len(records), size, millisBehindLatest, latency)
+	return true
+}
 
-	log.Debug().Str("stream_name", c.streamName).Msg("ended to subscribe stream")
+// sleepContext waits for d, and returns false when ctx is done before it.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
@@ -2,7 +2,6 @@ package toyhose
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -51,7 +50,7 @@ func TestKinesisConsumer(t *testing.T) {
 			},
 		} {
 			t.Run(tt.label, func(t *testing.T) {
-				consumer, err := newKinesisConsumer(context.Background(), awsConf, tt.fhConf, tt.kiConf)
+				consumer, err := newKinesisConsumer(context.Background(), awsConf, tt.fhConf, tt.kiConf, "", time.Now())
 				if consumer != nil {
 					t.Fatalf("%#v", consumer)
 				}
@@ -86,7 +85,7 @@ func TestKinesisConsumer(t *testing.T) {
 		var consumer *kinesisConsumer
 		var err error
 		for i := 0; i < 50; i++ {
-			consumer, err = newKinesisConsumer(context.Background(), awsConf, fhConf, kiConf)
+			consumer, err = newKinesisConsumer(context.Background(), awsConf, fhConf, kiConf, "", time.Now())
 			if consumer != nil {
 				break
 			}
@@ -153,7 +152,7 @@ func TestInputFromKinesis(t *testing.T) {
 			pool: map[string]*deliveryStream{},
 		},
 	}
-	createInputBytes, _ := json.Marshal(&firehose.CreateDeliveryStreamInput{
+	createOutput, err := svc.Create(context.Background(), &firehose.CreateDeliveryStreamInput{
 		DeliveryStreamName: &streamName,
 		DeliveryStreamType: fhtypes.DeliveryStreamTypeKinesisStreamAsSource,
 		S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
@@ -170,7 +169,6 @@ func TestInputFromKinesis(t *testing.T) {
 			RoleARN:          aws.String("arn:aws:iam:role:foo-bar"),
 		},
 	})
-	createOutput, err := svc.Create(context.Background(), createInputBytes)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -214,10 +212,9 @@ func TestInputFromKinesis(t *testing.T) {
 		t.Errorf("captured data is wrong: %s", c)
 	}
 
-	deleteInputBytes, _ := json.Marshal(firehose.DeleteDeliveryStreamInput{
+	if _, err := svc.Delete(context.Background(), &firehose.DeleteDeliveryStreamInput{
 		DeliveryStreamName: aws.String(strings.Split(deliveryStreamARN, "/")[1]),
-	})
-	if _, err := svc.Delete(context.Background(), deleteInputBytes); err != nil {
+	}); err != nil {
 		t.Error(err)
 	}
 }
@@ -0,0 +1,150 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// consumerActivationTimeout bounds waiting for a registered consumer to become ACTIVE.
+const consumerActivationTimeout = 30 * time.Second
+
+// consumerName is the name of the enhanced fan-out consumer of the delivery stream,
+// so that the consumer registered before restart is used again.
+func (c *kinesisConsumer) consumerName() string {
+	return "toyhose-" + c.deliveryName
+}
+
+// registerConsumer registers the consumer of enhanced fan-out and waits until it is ACTIVE.
+// It returns empty ARN when the endpoint does not support it or the stream has no room for another consumer,
+// which makes shards polled by GetRecords.
+func (c *kinesisConsumer) registerConsumer(ctx context.Context) string {
+	logger := log.With().Str("stream_name", c.streamName).Str("consumer_name", c.consumerName()).Logger()
+	var consumer *types.Consumer
+	out, err := c.cli.RegisterStreamConsumer(ctx, &kinesis.RegisterStreamConsumerInput{
+		StreamARN:    &c.streamARN,
+		ConsumerName: aws.String(c.consumerName()),
+	})
+	var inUse *types.ResourceInUseException
+	var limitExceeded *types.LimitExceededException
+	switch {
+	case err == nil:
+		consumer = out.Consumer
+	case errors.As(err, &inUse):
+		// registered before restart.
+	case errors.As(err, &limitExceeded):
+		logger.Warn().Err(err).Msg("stream has no room for another enhanced fan-out consumer. falling back to polling")
+		return ""
+	default:
+		logger.Warn().Err(err).Msg("enhanced fan-out is not available. falling back to polling")
+		return ""
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, consumerActivationTimeout)
+	defer cancel()
+	for consumer == nil || consumer.ConsumerStatus != types.ConsumerStatusActive {
+		out, err := c.cli.DescribeStreamConsumer(waitCtx, &kinesis.DescribeStreamConsumerInput{
+			StreamARN:    &c.streamARN,
+			ConsumerName: aws.String(c.consumerName()),
+		})
+		if err != nil {
+			logger.Warn().Err(err).Msg("enhanced fan-out consumer is not active. falling back to polling")
+			return ""
+		}
+		d := out.ConsumerDescription
+		consumer = &types.Consumer{ConsumerARN: d.ConsumerARN, ConsumerStatus: d.ConsumerStatus}
+		if consumer.ConsumerStatus != types.ConsumerStatusActive && !sleepContext(waitCtx, 500*time.Millisecond) {
+			logger.Warn().Msg("enhanced fan-out consumer is not active. falling back to polling")
+			return ""
+		}
+	}
+	logger.Info().Str("consumer_arn", aws.ToString(consumer.ConsumerARN)).Msg("reading shards by enhanced fan-out")
+	return aws.ToString(consumer.ConsumerARN)
+}
+
+// deregisterConsumer removes the consumer of enhanced fan-out when the delivery stream is deleted,
+// since a stream allows only a few consumers.
+func (c *kinesisConsumer) deregisterConsumer(ctx context.Context) {
+	if c.consumerARN == "" {
+		return
+	}
+	if _, err := c.cli.DeregisterStreamConsumer(ctx, &kinesis.DeregisterStreamConsumerInput{
+		ConsumerARN: &c.consumerARN,
+	}); err != nil {
+		log.Error().Err(err).Str("consumer_arn", c.consumerARN).Msg("failed to deregister enhanced fan-out consumer")
+	}
+}
+
+// subscribeShard receives records of the shard pushed by SubscribeToShard, subscribing again
+// whenever a subscription ends. It returns error when the first subscription is refused,
+// so that the caller falls back to polling.
+func (c *kinesisConsumer) subscribeShard(ctx context.Context, cur *shardCursor, recordCh chan<- *DeliveryRecord) ([]types.ChildShard, bool, error) {
+	subscribed := false
+	for {
+		out, err := c.cli.SubscribeToShard(ctx, &kinesis.SubscribeToShardInput{
+			ConsumerARN:      &c.consumerARN,
+			ShardId:          &cur.shardID,
+			StartingPosition: c.startingPosition(cur),
+		})
+		if ctx.Err() != nil {
+			return nil, false, nil
+		}
+		if err != nil {
+			var inUse *types.ResourceInUseException
+			if !subscribed && !errors.As(err, &inUse) {
+				return nil, false, err
+			}
+			// the previous subscription is not closed yet.
+			log.Debug().Str("shard_id", cur.shardID).Err(err).Msg("SubscribeToShard error")
+			if !sleepContext(ctx, time.Second) {
+				return nil, false, nil
+			}
+			continue
+		}
+		subscribed = true
+		children, ended, ok := c.receiveEvents(ctx, cur, out.GetStream(), recordCh)
+		if !ok {
+			return nil, false, nil
+		}
+		if ended {
+			log.Debug().Str("shard_id", cur.shardID).Msg("shard is ended, finishing subscription")
+			return children, true, nil
+		}
+	}
+}
+
+// receiveEvents sends records of events to recordCh until the subscription ends, which lasts 5 minutes at most.
+// ended reports the shard is closed, and ok is false when ctx is done.
+func (c *kinesisConsumer) receiveEvents(ctx context.Context, cur *shardCursor, stream *kinesis.SubscribeToShardEventStream, recordCh chan<- *DeliveryRecord) (children []types.ChildShard, ended, ok bool) {
+	defer stream.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, false, false
+		case ev, open := <-stream.Events():
+			if !open {
+				if err := stream.Err(); err != nil {
+					log.Debug().Str("shard_id", cur.shardID).Err(err).Msg("subscription error")
+					if !sleepContext(ctx, time.Second) {
+						return nil, false, false
+					}
+				}
+				return nil, false, true
+			}
+			e, isEvent := ev.(*types.SubscribeToShardEventStreamMemberSubscribeToShardEvent)
+			if !isEvent {
+				continue
+			}
+			if !c.send(ctx, cur, e.Value.Records, e.Value.MillisBehindLatest, 0, recordCh) {
+				return nil, false, false
+			}
+			if e.Value.ContinuationSequenceNumber == nil {
+				return e.Value.ChildShards, true, true
+			}
+		}
+	}
+}
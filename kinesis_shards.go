@@ -0,0 +1,65 @@
+package toyhose
+
+import "sort"
+
+// shardLineage orders reading of shards, so that records of a parent shard are read
+// before records of its children after a split or merge.
+// It is used only by the goroutine of kinesisConsumer.Run.
+type shardLineage struct {
+	parents  map[string][]string
+	started  map[string]bool
+	finished map[string]bool
+}
+
+func newShardLineage() *shardLineage {
+	return &shardLineage{
+		parents:  map[string][]string{},
+		started:  map[string]bool{},
+		finished: map[string]bool{},
+	}
+}
+
+// add registers shardID and its parents. Shards already known are ignored.
+func (l *shardLineage) add(shardID string, parents ...string) {
+	if _, ok := l.parents[shardID]; ok {
+		return
+	}
+	ps := make([]string, 0, len(parents))
+	for _, p := range parents {
+		if p != "" {
+			ps = append(ps, p)
+		}
+	}
+	l.parents[shardID] = ps
+}
+
+// ready returns shards to start reading, and marks them started.
+// A shard is ready when every parent is read to its end, or is not listed since it is past retention.
+func (l *shardLineage) ready() []string {
+	var ids []string
+	for id, parents := range l.parents {
+		if l.started[id] {
+			continue
+		}
+		ok := true
+		for _, p := range parents {
+			if _, known := l.parents[p]; known && !l.finished[p] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		l.started[id] = true
+	}
+	return ids
+}
+
+// finish marks shardID read to its end.
+func (l *shardLineage) finish(shardID string) {
+	l.finished[shardID] = true
+}
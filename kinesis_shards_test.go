@@ -0,0 +1,309 @@
+package toyhose
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/protocol/eventstream"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestShardLineage(t *testing.T) {
+	l := newShardLineage()
+	l.add("shard-0")
+	l.add("shard-1")
+	// shard-0 is split into shard-2 and shard-3, which are merged into shard-4 with shard-1.
+	l.add("shard-2", "shard-0")
+	l.add("shard-3", "shard-0")
+	l.add("shard-4", "shard-3", "shard-1")
+	// parent is past retention.
+	l.add("shard-5", "shard-trimmed")
+
+	for _, tt := range []struct {
+		finish   string
+		expected []string
+	}{
+		{expected: []string{"shard-0", "shard-1", "shard-5"}},
+		{finish: "shard-1", expected: nil},
+		{finish: "shard-0", expected: []string{"shard-2", "shard-3"}},
+		{finish: "shard-3", expected: []string{"shard-4"}},
+		{finish: "shard-2", expected: nil},
+	} {
+		if tt.finish != "" {
+			l.finish(tt.finish)
+		}
+		if ready := l.ready(); !reflect.DeepEqual(ready, tt.expected) {
+			t.Errorf("finished %q: expected %v, got %v", tt.finish, tt.expected, ready)
+		}
+	}
+}
+
+// fakeKinesis serves a stream whose parent shard is split into two children.
+// Reading of shardId-000000000001 is interrupted once after its first record:
+// the iterator expires, or the subscription of enhanced fan-out ends.
+type fakeKinesis struct {
+	mutex       sync.Mutex
+	fanOut      bool
+	records     map[string][]string
+	children    map[string][]string
+	interrupted bool
+	// starts records where each iterator or subscription starts.
+	starts []string
+	calls  map[string]int
+}
+
+func newFakeKinesis(fanOut bool) *fakeKinesis {
+	return &fakeKinesis{
+		fanOut: fanOut,
+		records: map[string][]string{
+			"shardId-000000000000": {"1", "2"},
+			"shardId-000000000001": {"3", "4"},
+			"shardId-000000000002": {"5"},
+		},
+		children: map[string][]string{
+			"shardId-000000000000": {"shardId-000000000001", "shardId-000000000002"},
+		},
+		calls: map[string]int{},
+	}
+}
+
+func (k *fakeKinesis) callCount(op string) int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.calls[op]
+}
+
+// start returns position of the first record to read.
+func (k *fakeKinesis) start(shardID string, in map[string]any) int {
+	k.starts = append(k.starts, fmt.Sprintf("%s %v %v", shardID, in["Type"], in["SequenceNumber"]))
+	if in["Type"] == "AFTER_SEQUENCE_NUMBER" {
+		for i, seq := range k.records[shardID] {
+			if seq == in["SequenceNumber"] {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// read returns the record at pos, and children when the shard is closed after it.
+func (k *fakeKinesis) read(shardID string, pos int) (records []map[string]any, next int, children []map[string]any, closed bool) {
+	records = []map[string]any{}
+	if seqs := k.records[shardID]; pos < len(seqs) {
+		records = append(records, map[string]any{"SequenceNumber": seqs[pos], "Data": []byte(seqs[pos] + "\n"), "PartitionKey": "key"})
+		pos++
+	}
+	ids, parent := k.children[shardID]
+	if !parent || pos < len(k.records[shardID]) {
+		return records, pos, nil, false
+	}
+	children = []map[string]any{}
+	for _, child := range ids {
+		children = append(children, map[string]any{"ShardId": child, "ParentShards": []string{shardID}})
+	}
+	return records, pos, children, true
+}
+
+func (k *fakeKinesis) interrupt(shardID string, pos int) bool {
+	if shardID == "shardId-000000000001" && pos == 1 && !k.interrupted {
+		k.interrupted = true
+		return true
+	}
+	return false
+}
+
+func (k *fakeKinesis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var in map[string]any
+	_ = json.NewDecoder(r.Body).Decode(&in)
+	op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "Kinesis_20131202.")
+	k.mutex.Lock()
+	k.calls[op]++
+	if op == "SubscribeToShard" && k.fanOut {
+		k.subscribe(w, r, in)
+		return
+	}
+	defer k.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	out := map[string]any{}
+	switch op {
+	case "DescribeStream":
+		out["StreamDescription"] = map[string]any{"StreamStatus": "ACTIVE", "StreamName": in["StreamName"]}
+	case "ListShards":
+		shards := []map[string]any{{"ShardId": "shardId-000000000000"}}
+		for _, child := range k.children["shardId-000000000000"] {
+			shards = append(shards, map[string]any{"ShardId": child, "ParentShardId": "shardId-000000000000"})
+		}
+		out["Shards"] = shards
+	case "GetShardIterator":
+		shardID := in["ShardId"].(string)
+		pos := k.start(shardID, map[string]any{"Type": in["ShardIteratorType"], "SequenceNumber": in["StartingSequenceNumber"]})
+		out["ShardIterator"] = fmt.Sprintf("%s/%d", shardID, pos)
+	case "GetRecords":
+		shardID, p, _ := strings.Cut(in["ShardIterator"].(string), "/")
+		pos, _ := strconv.Atoi(p)
+		if k.interrupt(shardID, pos) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"ExpiredIteratorException","message":"Iterator expired"}`)
+			return
+		}
+		records, next, children, closed := k.read(shardID, pos)
+		out["Records"] = records
+		out["MillisBehindLatest"] = 0
+		if closed {
+			out["ChildShards"] = children
+		} else {
+			out["NextShardIterator"] = fmt.Sprintf("%s/%d", shardID, next)
+		}
+	case "RegisterStreamConsumer", "DescribeStreamConsumer":
+		if !k.fanOut {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"UnknownOperationException"}`)
+			return
+		}
+		consumer := map[string]any{"ConsumerName": in["ConsumerName"], "ConsumerARN": "arn:consumer", "ConsumerStatus": "CREATING"}
+		if op == "DescribeStreamConsumer" {
+			consumer["ConsumerStatus"] = "ACTIVE"
+			out["ConsumerDescription"] = consumer
+		} else {
+			out["Consumer"] = consumer
+		}
+	case "DeregisterStreamConsumer":
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type":"UnknownOperationException"}`)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// subscribe streams events from the starting position. It is called with mutex locked.
+func (k *fakeKinesis) subscribe(w http.ResponseWriter, r *http.Request, in map[string]any) {
+	shardID := in["ShardId"].(string)
+	pos := k.start(shardID, in["StartingPosition"].(map[string]any))
+	var events []map[string]any
+	interrupted, closed := false, false
+	for !closed && pos < len(k.records[shardID]) {
+		if k.interrupt(shardID, pos) {
+			interrupted = true
+			break
+		}
+		var records, children []map[string]any
+		records, pos, children, closed = k.read(shardID, pos)
+		event := map[string]any{"Records": records, "MillisBehindLatest": 0}
+		if closed {
+			event["ChildShards"] = children
+		} else {
+			event["ContinuationSequenceNumber"] = k.records[shardID][pos-1]
+		}
+		events = append(events, event)
+	}
+	k.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+	enc := eventstream.NewEncoder()
+	write := func(eventType string, payload any) {
+		body, _ := json.Marshal(payload)
+		headers := eventstream.Headers{}
+		headers.Set(":message-type", eventstream.StringValue("event"))
+		headers.Set(":event-type", eventstream.StringValue(eventType))
+		headers.Set(":content-type", eventstream.StringValue("application/json"))
+		_ = enc.Encode(w, eventstream.Message{Headers: headers, Payload: body})
+		w.(http.Flusher).Flush()
+	}
+	write("initial-response", map[string]any{})
+	for _, event := range events {
+		write("SubscribeToShardEvent", event)
+	}
+	if interrupted || closed {
+		return
+	}
+	// subscription of open shard lasts until the consumer stops.
+	<-r.Context().Done()
+}
+
+func TestKinesisResharding(t *testing.T) {
+	for _, tt := range []struct {
+		label          string
+		fanOut         bool
+		enhancedFanOut bool
+	}{
+		{label: "polling"},
+		{label: "enhanced fan-out", fanOut: true, enhancedFanOut: true},
+		{label: "fallback to polling", enhancedFanOut: true},
+	} {
+		t.Run(tt.label, func(t *testing.T) {
+			ctx := context.Background()
+			fake := newFakeKinesis(tt.fanOut)
+			kinesisSrv := httptest.NewServer(fake)
+			defer kinesisSrv.Close()
+			d := NewDispatcher(&DispatcherConfig{
+				AWSConf: awsConfig(t),
+				S3InjectedConf: S3InjectedConf{
+					InMemory:         true,
+					DisableBuffering: true,
+				},
+				KinesisInjectedConf: KinesisInjectedConf{
+					Endpoint:       aws.String(kinesisSrv.URL),
+					EnhancedFanOut: tt.enhancedFanOut,
+				},
+			})
+			if _, err := d.Service().Create(ctx, &firehose.CreateDeliveryStreamInput{
+				DeliveryStreamName: aws.String("resharding"),
+				DeliveryStreamType: fhtypes.DeliveryStreamTypeKinesisStreamAsSource,
+				KinesisStreamSourceConfiguration: &fhtypes.KinesisStreamSourceConfiguration{
+					KinesisStreamARN: aws.String("arn:aws:kinesis:us-east-1:XXXXXXXX:stream/resharding"),
+				},
+				S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+					BucketARN: aws.String("arn:aws:s3:::resharding-bucket"),
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			deliveries, err := d.WaitForDeliveries(waitCtx, "resharding", 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var bodies []string
+			for _, dl := range deliveries {
+				bodies = append(bodies, strings.TrimSpace(string(dl.Body)))
+			}
+			if len(bodies) != 5 || bodies[0] != "1" || bodies[1] != "2" {
+				t.Errorf("parent shard should be read first without duplicates: %v", bodies)
+			}
+			fake.mutex.Lock()
+			starts := fake.starts
+			fake.mutex.Unlock()
+			restart := "shardId-000000000001 AFTER_SEQUENCE_NUMBER 3"
+			found := false
+			for _, s := range starts {
+				found = found || s == restart
+			}
+			if !found {
+				t.Errorf("interrupted reading is not started again after the last record: %v", starts)
+			}
+			if polled := fake.callCount("GetRecords") > 0; polled == tt.fanOut {
+				t.Errorf("unexpected GetRecords calls: %d", fake.callCount("GetRecords"))
+			}
+
+			if _, err := d.Service().Delete(ctx, &firehose.DeleteDeliveryStreamInput{DeliveryStreamName: aws.String("resharding")}); err != nil {
+				t.Error(err)
+			}
+			if deregistered := fake.callCount("DeregisterStreamConsumer") == 1; deregistered != tt.fanOut {
+				t.Errorf("unexpected DeregisterStreamConsumer calls: %d", fake.callCount("DeregisterStreamConsumer"))
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package toyhose
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// kplMagic prefixes records aggregated by Kinesis Producer Library.
+// https://github.com/awslabs/amazon-kinesis-producer/blob/master/aggregation-format.md
+var kplMagic = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+var errBrokenAggregatedRecord = errors.New("broken aggregated record")
+
+// userRecord is a record put by KPL user, packed in an aggregated record.
+type userRecord struct {
+	data            []byte
+	partitionKey    string
+	explicitHashKey string
+}
+
+// deaggregate unpacks user records from data aggregated by KPL.
+// It returns false when data is not an aggregated record, or its MD5 does not match,
+// in which case data is delivered as is like KCL does.
+func deaggregate(data []byte) ([]userRecord, bool) {
+	if len(data) < len(kplMagic)+md5.Size || !bytes.HasPrefix(data, kplMagic) {
+		return nil, false
+	}
+	message := data[len(kplMagic) : len(data)-md5.Size]
+	sum := md5.Sum(message)
+	if !bytes.Equal(sum[:], data[len(data)-md5.Size:]) {
+		log.Debug().Msg("MD5 of aggregated record does not match. delivering it as is")
+		return nil, false
+	}
+	records, err := parseAggregatedRecord(message)
+	if err != nil {
+		log.Debug().Err(err).Msg("failed to parse aggregated record. delivering it as is")
+		return nil, false
+	}
+	return records, true
+}
+
+// parseAggregatedRecord decodes protobuf message AggregatedRecord:
+//
+//	message AggregatedRecord {
+//	  repeated string partition_key_table     = 1;
+//	  repeated string explicit_hash_key_table = 2;
+//	  repeated Record records                 = 3;
+//	}
+func parseAggregatedRecord(b []byte) ([]userRecord, error) {
+	var partitionKeys, explicitHashKeys []string
+	var entries []aggregatedEntry
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType || num < 1 || num > 3 {
+			return 0, nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		switch num {
+		case 1:
+			partitionKeys = append(partitionKeys, string(v))
+		case 2:
+			explicitHashKeys = append(explicitHashKeys, string(v))
+		case 3:
+			e, err := parseAggregatedEntry(v)
+			if err != nil {
+				return 0, err
+			}
+			entries = append(entries, e)
+		}
+		return n, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]userRecord, 0, len(entries))
+	for _, e := range entries {
+		if e.partitionKeyIndex >= uint64(len(partitionKeys)) {
+			return nil, errBrokenAggregatedRecord
+		}
+		rec := userRecord{data: e.data, partitionKey: partitionKeys[e.partitionKeyIndex]}
+		if e.explicitHashKeyIndex != nil {
+			if *e.explicitHashKeyIndex >= uint64(len(explicitHashKeys)) {
+				return nil, errBrokenAggregatedRecord
+			}
+			rec.explicitHashKey = explicitHashKeys[*e.explicitHashKeyIndex]
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// aggregatedEntry is protobuf message Record. tags are skipped.
+//
+//	message Record {
+//	  required uint64 partition_key_index     = 1;
+//	  optional uint64 explicit_hash_key_index = 2;
+//	  required bytes  data                    = 3;
+//	  repeated Tag    tags                    = 4;
+//	}
+type aggregatedEntry struct {
+	partitionKeyIndex    uint64
+	explicitHashKeyIndex *uint64
+	data                 []byte
+}
+
+func parseAggregatedEntry(b []byte) (aggregatedEntry, error) {
+	var e aggregatedEntry
+	hasPartitionKey, hasData := false, false
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case (num == 1 || num == 2) && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			if num == 1 {
+				e.partitionKeyIndex = v
+				hasPartitionKey = true
+			} else {
+				e.explicitHashKeyIndex = &v
+			}
+			return n, nil
+		case num == 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			e.data = v
+			hasData = true
+			return n, nil
+		}
+		return 0, nil
+	})
+	if err != nil {
+		return e, err
+	}
+	if !hasPartitionKey || !hasData {
+		return e, errBrokenAggregatedRecord
+	}
+	return e, nil
+}
+
+// consumeFields calls fn for each field of protobuf message b with bytes after its tag.
+// fn returns length of the value it consumed, or 0 to skip the field.
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := fn(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+		}
+		b = b[n:]
+	}
+	return nil
+}
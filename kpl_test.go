@@ -0,0 +1,86 @@
+package toyhose
+
+import (
+	"crypto/md5"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// aggregate packs records like KPL does. Records without explicit hash key are given empty one.
+func aggregate(records []userRecord) []byte {
+	var msg []byte
+	partitionKeys, explicitHashKeys := map[string]uint64{}, map[string]uint64{}
+	index := func(table map[string]uint64, num protowire.Number, key string) uint64 {
+		if i, ok := table[key]; ok {
+			return i
+		}
+		table[key] = uint64(len(table))
+		msg = protowire.AppendTag(msg, num, protowire.BytesType)
+		msg = protowire.AppendString(msg, key)
+		return table[key]
+	}
+	var entries [][]byte
+	for _, rec := range records {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.VarintType)
+		entry = protowire.AppendVarint(entry, index(partitionKeys, 1, rec.partitionKey))
+		if rec.explicitHashKey != "" {
+			entry = protowire.AppendTag(entry, 2, protowire.VarintType)
+			entry = protowire.AppendVarint(entry, index(explicitHashKeys, 2, rec.explicitHashKey))
+		}
+		entry = protowire.AppendTag(entry, 3, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, rec.data)
+		// tags are skipped.
+		entry = protowire.AppendTag(entry, 4, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, []byte{0x0a, 0x01, 'k'})
+		entries = append(entries, entry)
+	}
+	for _, entry := range entries {
+		msg = protowire.AppendTag(msg, 3, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, entry)
+	}
+	sum := md5.Sum(msg)
+	data := append(append([]byte{}, kplMagic...), msg...)
+	return append(data, sum[:]...)
+}
+
+func TestDeaggregate(t *testing.T) {
+	records := []userRecord{
+		{data: []byte("first"), partitionKey: "pk-a", explicitHashKey: "12345"},
+		{data: []byte("second"), partitionKey: "pk-b"},
+		{data: []byte("third"), partitionKey: "pk-a", explicitHashKey: "12345"},
+	}
+	aggregated := aggregate(records)
+
+	t.Run("aggregated record", func(t *testing.T) {
+		got, ok := deaggregate(aggregated)
+		if !ok {
+			t.Fatal("aggregated record is not detected")
+		}
+		if !reflect.DeepEqual(got, records) {
+			t.Errorf("unexpected user records: %#v", got)
+		}
+	})
+
+	broken := append([]byte{}, aggregated...)
+	broken[len(kplMagic)+1] ^= 0xff
+	truncated := append(append([]byte{}, kplMagic...), 0x1a, 0x05, 0x08)
+	truncatedSum := md5.Sum(truncated[len(kplMagic):])
+	for _, tt := range []struct {
+		label string
+		data  []byte
+	}{
+		{label: "plain record", data: []byte("plain data")},
+		{label: "magic only", data: kplMagic},
+		{label: "MD5 mismatch", data: broken},
+		{label: "broken protobuf", data: append(truncated, truncatedSum[:]...)},
+	} {
+		t.Run(tt.label, func(t *testing.T) {
+			if got, ok := deaggregate(tt.data); ok {
+				t.Errorf("should be delivered as is: %#v", got)
+			}
+		})
+	}
+}
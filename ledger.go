@@ -0,0 +1,279 @@
+package toyhose
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// RecordState represents where a record is in delivery.
+type RecordState string
+
+// RecordState values.
+const (
+	RecordStateBuffered  RecordState = "buffered"
+	RecordStateDelivered RecordState = "delivered"
+	RecordStateFailed    RecordState = "failed"
+	// RecordStateRetrying is for records whose delivery failed once and is being retried.
+	RecordStateRetrying RecordState = "retrying"
+	// RecordStateSpilled is for records which are not delivered within retry duration
+	// and are waiting for redelivery in spill directory.
+	RecordStateSpilled RecordState = "spilled"
+)
+
+// LedgerEntry represents the latest state of a record.
+type LedgerEntry struct {
+	RecordID           string      `json:"recordId"`
+	DeliveryStreamName string      `json:"deliveryStreamName"`
+	State              RecordState `json:"state"`
+	ArrivedAt          time.Time   `json:"arrivedAt"`
+	UpdatedAt          time.Time   `json:"updatedAt"`
+	Bucket             string      `json:"bucket,omitempty"`
+	Key                string      `json:"key,omitempty"`
+	// Offset is byte offset of the record in the object before compression.
+	Offset int    `json:"offset"`
+	Size   int    `json:"size"`
+	Error  string `json:"error,omitempty"`
+}
+
+// defaultLedgerMaxRecords is the number of entries kept by ledger when it is not configured.
+const defaultLedgerMaxRecords = 100000
+
+// ledger tracks state of records by record ID. It keeps the latest maxRecords entries,
+// and forgets entries of a stream when the stream is deleted.
+// recording methods are nil-safe, so components built without ledger keep working.
+type ledger struct {
+	mutex      sync.RWMutex
+	maxRecords int
+	entries    map[string]*LedgerEntry
+	// streams indexes entries by stream, so that listing a stream does not scan the others.
+	streams map[string]map[string]*LedgerEntry
+	// order is record IDs oldest first, to evict entries beyond maxRecords.
+	order []string
+}
+
+func newLedger(maxRecords int) *ledger {
+	if maxRecords <= 0 {
+		maxRecords = defaultLedgerMaxRecords
+	}
+	return &ledger{
+		maxRecords: maxRecords,
+		entries:    map[string]*LedgerEntry{},
+		streams:    map[string]map[string]*LedgerEntry{},
+	}
+}
+
+// add stores e, evicting the oldest entries beyond maxRecords.
+func (l *ledger) add(e *LedgerEntry) {
+	if _, ok := l.entries[e.RecordID]; !ok {
+		l.order = append(l.order, e.RecordID)
+	}
+	l.entries[e.RecordID] = e
+	stream, ok := l.streams[e.DeliveryStreamName]
+	if !ok {
+		stream = map[string]*LedgerEntry{}
+		l.streams[e.DeliveryStreamName] = stream
+	}
+	stream[e.RecordID] = e
+	for len(l.entries) > l.maxRecords {
+		l.remove(l.order[0])
+		l.order[0] = ""
+		l.order = l.order[1:]
+	}
+}
+
+func (l *ledger) remove(recordID string) {
+	e, ok := l.entries[recordID]
+	if !ok {
+		return
+	}
+	delete(l.entries, recordID)
+	stream := l.streams[e.DeliveryStreamName]
+	delete(stream, recordID)
+	if len(stream) == 0 {
+		delete(l.streams, e.DeliveryStreamName)
+	}
+}
+
+func (l *ledger) buffered(streamName string, records []*DeliveryRecord) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, rec := range records {
+		l.add(&LedgerEntry{
+			RecordID:           rec.ID,
+			DeliveryStreamName: streamName,
+			State:              RecordStateBuffered,
+			ArrivedAt:          rec.ArrivedAt,
+			UpdatedAt:          rec.ArrivedAt,
+			Size:               len(rec.Data),
+		})
+	}
+}
+
+// entry returns entry of rec, creating it when records bypassed buffered.
+func (l *ledger) entry(streamName string, rec *DeliveryRecord) *LedgerEntry {
+	e, ok := l.entries[rec.ID]
+	if !ok {
+		e = &LedgerEntry{
+			RecordID:           rec.ID,
+			DeliveryStreamName: streamName,
+			ArrivedAt:          rec.ArrivedAt,
+			Size:               len(rec.Data),
+		}
+		l.add(e)
+	}
+	return e
+}
+
+func (l *ledger) delivered(streamName, bucket, key string, records []*DeliveryRecord, ts time.Time) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	offset := 0
+	for _, rec := range records {
+		e := l.entry(streamName, rec)
+		e.State = RecordStateDelivered
+		e.UpdatedAt = ts
+		e.Bucket = bucket
+		e.Key = key
+		e.Offset = offset
+		e.Error = ""
+		offset += len(rec.Data)
+	}
+}
+
+func (l *ledger) failed(streamName string, records []*DeliveryRecord, ts time.Time, err error) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, rec := range records {
+		e := l.entry(streamName, rec)
+		e.State = RecordStateFailed
+		e.UpdatedAt = ts
+		e.Error = err.Error()
+	}
+}
+
+func (l *ledger) retrying(streamName, key string, records []*DeliveryRecord, ts time.Time, err error) {
+	l.undelivered(streamName, key, records, ts, RecordStateRetrying, err)
+}
+
+func (l *ledger) spilled(streamName, key string, records []*DeliveryRecord, ts time.Time, err error) {
+	l.undelivered(streamName, key, records, ts, RecordStateSpilled, err)
+}
+
+func (l *ledger) undelivered(streamName, key string, records []*DeliveryRecord, ts time.Time, state RecordState, err error) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, rec := range records {
+		e := l.entry(streamName, rec)
+		e.State = state
+		e.UpdatedAt = ts
+		e.Key = key
+		e.Error = err.Error()
+	}
+}
+
+func (l *ledger) Find(recordID string) (LedgerEntry, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	e, ok := l.entries[recordID]
+	if !ok {
+		return LedgerEntry{}, false
+	}
+	return *e, true
+}
+
+// List returns entries of streamName arrived in [from, to), ordered by arrival.
+// zero from or to means unbounded.
+func (l *ledger) List(streamName string, from, to time.Time) []LedgerEntry {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	list := []LedgerEntry{}
+	for _, e := range l.streams[streamName] {
+		if !from.IsZero() && e.ArrivedAt.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !e.ArrivedAt.Before(to) {
+			continue
+		}
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ArrivedAt.Before(list[j].ArrivedAt)
+	})
+	return list
+}
+
+// dropStream forgets entries of deleted streamName.
+func (l *ledger) dropStream(streamName string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.streams[streamName]; !ok {
+		return
+	}
+	for recordID := range l.streams[streamName] {
+		delete(l.entries, recordID)
+	}
+	delete(l.streams, streamName)
+	order := make([]string, 0, len(l.entries))
+	for _, recordID := range l.order {
+		if _, ok := l.entries[recordID]; ok {
+			order = append(order, recordID)
+		}
+	}
+	l.order = order
+}
+
+func (l *ledger) Clear() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = map[string]*LedgerEntry{}
+	l.streams = map[string]map[string]*LedgerEntry{}
+	l.order = nil
+}
+
+// LookupRecord returns ledger entry of supplied record ID.
+func (d *Dispatcher) LookupRecord(recordID string) (LedgerEntry, error) {
+	e, ok := d.ledger.Find(recordID)
+	if !ok {
+		return LedgerEntry{}, &types.ResourceNotFoundException{Message: aws.String(fmt.Sprintf("RecordId: %s not found", recordID))}
+	}
+	return e, nil
+}
+
+// Records returns ledger entries of supplied deliveryStreamName arrived in [from, to).
+// zero from or to means unbounded.
+func (d *Dispatcher) Records(streamName string, from, to time.Time) []LedgerEntry {
+	return d.ledger.List(streamName, from, to)
+}
+
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	ts, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, &types.InvalidArgumentException{Message: aws.String(fmt.Sprintf("%s must be RFC3339 timestamp", name))}
+	}
+	return ts, nil
+}
@@ -0,0 +1,176 @@
+package toyhose
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestRecordLedger(t *testing.T) {
+	ctx := context.Background()
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		S3InjectedConf: S3InjectedConf{
+			InMemory: true,
+		},
+	})
+	testserver := httptest.NewServer(d.AdminHandler())
+	defer testserver.Close()
+
+	svc := d.Service()
+	streamName := "ledger-stream"
+	if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+			BucketARN: aws.String("arn:aws:s3:::ledger-bucket"),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	startedAt := time.Now()
+	out, err := svc.PutBatch(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: &streamName,
+		Records: []fhtypes.Record{
+			{Data: []byte("hello!\n")},
+			{Data: []byte("world!!\n")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstID, secondID := *out.RequestResponses[0].RecordId, *out.RequestResponses[1].RecordId
+
+	get := func(t *testing.T, path string, expectedStatus int, v any) {
+		t.Helper()
+		res, err := http.Get(testserver.URL + AdminPathPrefix + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != expectedStatus {
+			t.Fatalf("unexpected status for %s: %d", path, res.StatusCode)
+		}
+		if v != nil {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("buffered", func(t *testing.T) {
+		var e LedgerEntry
+		get(t, "records/"+firstID, http.StatusOK, &e)
+		if e.State != RecordStateBuffered || e.DeliveryStreamName != streamName || e.Size != 7 {
+			t.Errorf("unexpected entry: %#v", e)
+		}
+	})
+
+	t.Run("delivered", func(t *testing.T) {
+		flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := d.Flush(flushCtx, streamName); err != nil {
+			t.Fatal(err)
+		}
+		deliveries := d.Deliveries(streamName)
+		if len(deliveries) != 1 {
+			t.Fatalf("unexpected deliveries: %d", len(deliveries))
+		}
+		var e LedgerEntry
+		get(t, "records/"+secondID, http.StatusOK, &e)
+		if e.State != RecordStateDelivered || e.Bucket != "ledger-bucket" || e.Key != deliveries[0].Key || e.Offset != 7 {
+			t.Errorf("unexpected entry: %#v", e)
+		}
+		if body := string(deliveries[0].Body[e.Offset : e.Offset+e.Size]); body != "world!!\n" {
+			t.Errorf("offset points unexpected data: %q", body)
+		}
+	})
+
+	t.Run("by time range", func(t *testing.T) {
+		var list []LedgerEntry
+		q := url.Values{"from": {startedAt.Format(time.RFC3339Nano)}}
+		get(t, "streams/"+streamName+"/records?"+q.Encode(), http.StatusOK, &list)
+		if len(list) != 2 || list[0].RecordID != firstID || list[1].RecordID != secondID {
+			t.Errorf("unexpected list: %#v", list)
+		}
+		q = url.Values{"to": {startedAt.Format(time.RFC3339Nano)}}
+		get(t, "streams/"+streamName+"/records?"+q.Encode(), http.StatusOK, &list)
+		if len(list) != 0 {
+			t.Errorf("unexpected list: %#v", list)
+		}
+		get(t, "streams/"+streamName+"/records?from=yesterday", http.StatusBadRequest, nil)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		rec := NewDeliveryRecord([]byte("lost"))
+		d.ledger.failed(streamName, []*DeliveryRecord{rec}, time.Now(), errors.New("NoSuchBucket"))
+		var e LedgerEntry
+		get(t, "records/"+rec.ID, http.StatusOK, &e)
+		if e.State != RecordStateFailed || e.Error != "NoSuchBucket" {
+			t.Errorf("unexpected entry: %#v", e)
+		}
+	})
+
+	t.Run("unknown record", func(t *testing.T) {
+		get(t, "records/unknown", http.StatusNotFound, nil)
+	})
+}
+
+func TestLedgerBounds(t *testing.T) {
+	t.Run("oldest entries are evicted", func(t *testing.T) {
+		l := newLedger(2)
+		records := []*DeliveryRecord{NewDeliveryRecord([]byte("1")), NewDeliveryRecord([]byte("2")), NewDeliveryRecord([]byte("3"))}
+		l.buffered("bounded", records)
+		l.delivered("bounded", "bucket", "key", records[1:], time.Now())
+		if _, ok := l.Find(records[0].ID); ok {
+			t.Error("oldest entry is kept")
+		}
+		if list := l.List("bounded", time.Time{}, time.Time{}); len(list) != 2 || list[1].State != RecordStateDelivered {
+			t.Errorf("unexpected entries: %#v", list)
+		}
+	})
+
+	t.Run("entries of deleted stream are dropped", func(t *testing.T) {
+		ctx := context.Background()
+		d := NewDispatcher(&DispatcherConfig{
+			AWSConf: awsConfig(t),
+			S3InjectedConf: S3InjectedConf{
+				InMemory: true,
+			},
+		})
+		svc := d.Service()
+		for _, name := range []string{"ledger-deleted", "ledger-kept"} {
+			if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+				DeliveryStreamName: aws.String(name),
+				S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+					BucketARN: aws.String("arn:aws:s3:::ledger-bucket"),
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.Put(ctx, &firehose.PutRecordInput{
+				DeliveryStreamName: aws.String(name),
+				Record:             &fhtypes.Record{Data: []byte(name)},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := svc.Delete(ctx, &firehose.DeleteDeliveryStreamInput{DeliveryStreamName: aws.String("ledger-deleted")}); err != nil {
+			t.Fatal(err)
+		}
+		if list := d.Records("ledger-deleted", time.Time{}, time.Time{}); len(list) != 0 {
+			t.Errorf("entries of deleted stream are kept: %#v", list)
+		}
+		if list := d.Records("ledger-kept", time.Time{}, time.Time{}); len(list) != 1 {
+			t.Errorf("unexpected entries: %#v", list)
+		}
+	})
+}
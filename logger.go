@@ -24,7 +24,9 @@ func SetupLogger() error {
 	}
 	zerolog.SetGlobalLevel(lvl)
 	zerolog.TimeFieldFormat = time.RFC3339Nano
-	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: "2006-01-02 15:04:05.000000"}
+	// init leaves time.Local nil, which ConsoleWriter can not convert timestamps into.
+	// UTC is what nil time.Local means, so console timestamps are the same as before.
+	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: "2006-01-02 15:04:05.000000", TimeLocation: time.UTC}
 	output.FormatLevel = func(i interface{}) string {
 		return fmt.Sprintf("%-6s", i)
 	}
@@ -0,0 +1,166 @@
+package toyhose
+
+import (
+	"sort"
+	"sync"
+)
+
+// defaultMaxBufferedBytesTotal bounds records held by destinations of every stream.
+const defaultMaxBufferedBytesTotal = 1024 * 1024 * 1024
+
+// memoryBudget bounds bytes of records held by s3Destination across streams,
+// from capture into a buffer until the upload of the buffer finishes.
+// When the budget is hit, the largest buffers are flushed early, and puts are rejected
+// until uploads give memory back. Paused buffers are never flushed early, so they stay charged until resumed.
+// every method is nil-safe, so destinations built without budget are unbounded.
+type memoryBudget struct {
+	mutex   sync.Mutex
+	limit   int
+	used    int
+	holders map[*memoryHolder]struct{}
+	metrics *metrics
+}
+
+// memoryHolder is a buffer of a destination charged to memoryBudget.
+type memoryHolder struct {
+	name     string
+	buffered int
+	paused   bool
+	// pressure asks the destination to flush its buffer early.
+	pressure chan struct{}
+}
+
+func newMemoryBudget(limit int, m *metrics) *memoryBudget {
+	if limit <= 0 {
+		limit = defaultMaxBufferedBytesTotal
+	}
+	m.setMemoryBudget(limit)
+	return &memoryBudget{
+		limit:   limit,
+		holders: map[*memoryHolder]struct{}{},
+		metrics: m,
+	}
+}
+
+func (b *memoryBudget) register(name string) *memoryHolder {
+	if b == nil {
+		return nil
+	}
+	h := &memoryHolder{name: name, pressure: make(chan struct{}, 1)}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.holders[h] = struct{}{}
+	return h
+}
+
+func (b *memoryBudget) unregister(h *memoryHolder) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.holders, h)
+	b.metrics.deleteBufferedBytes(h.name)
+}
+
+// pressureC returns channel which receives when the budget asks h to flush.
+func (h *memoryHolder) pressureC() <-chan struct{} {
+	if h == nil {
+		return nil
+	}
+	return h.pressure
+}
+
+// capture charges size bytes captured into buffer of h.
+func (b *memoryBudget) capture(h *memoryHolder, size int) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	h.buffered += size
+	b.used += size
+	b.metrics.setBufferedBytes(h.name, h.buffered)
+	b.metrics.setMemoryUsed(b.used)
+	if b.used >= b.limit {
+		b.relieve()
+	}
+}
+
+// relieve asks the largest buffers to flush until they cover what exceeds half of the limit.
+// Their bytes are given back when uploads finish.
+func (b *memoryBudget) relieve() {
+	holders := make([]*memoryHolder, 0, len(b.holders))
+	for h := range b.holders {
+		if h.buffered > 0 && !h.paused {
+			holders = append(holders, h)
+		}
+	}
+	sort.Slice(holders, func(i, j int) bool {
+		return holders[i].buffered > holders[j].buffered
+	})
+	excess := b.used - b.limit/2
+	for _, h := range holders {
+		if excess <= 0 {
+			return
+		}
+		select {
+		case h.pressure <- struct{}{}:
+		default:
+			// asked already.
+		}
+		excess -= h.buffered
+	}
+}
+
+// pause excludes buffer of h from early flushes while paused is true.
+func (b *memoryBudget) pause(h *memoryHolder, paused bool) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	h.paused = paused
+}
+
+// handOff moves size bytes of buffer of h to upload. They stay charged until release.
+func (b *memoryBudget) handOff(h *memoryHolder, size int) {
+	if b == nil || size == 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	h.buffered -= size
+	b.metrics.setBufferedBytes(h.name, h.buffered)
+}
+
+// release gives back size bytes when their upload finishes.
+func (b *memoryBudget) release(size int) {
+	if b == nil || size == 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.used -= size
+	b.metrics.setMemoryUsed(b.used)
+}
+
+// exhausted reports whether puts should be rejected.
+func (b *memoryBudget) exhausted() bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.used >= b.limit
+}
+
+// usage returns bytes charged and the limit.
+func (b *memoryBudget) usage() (int, int) {
+	if b == nil {
+		return 0, 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.used, b.limit
+}
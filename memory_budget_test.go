@@ -0,0 +1,172 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := newMemoryBudget(100, nil)
+	small, large := b.register("small"), b.register("large")
+	b.capture(small, 30)
+	b.capture(large, 60)
+	if b.exhausted() || len(small.pressure) != 0 || len(large.pressure) != 0 {
+		t.Fatal("budget is hit too early")
+	}
+	b.capture(small, 20)
+	if !b.exhausted() {
+		t.Error("budget is not exhausted")
+	}
+	// flushing the largest buffer covers what exceeds half of the limit.
+	if len(large.pressure) != 1 || len(small.pressure) != 0 {
+		t.Errorf("unexpected flush requests: large=%d, small=%d", len(large.pressure), len(small.pressure))
+	}
+	b.handOff(large, 60)
+	if !b.exhausted() {
+		t.Error("bytes in upload should stay charged")
+	}
+	b.release(60)
+	if used, limit := b.usage(); b.exhausted() || used != 50 || limit != 100 {
+		t.Errorf("unexpected usage: %d/%d", used, limit)
+	}
+
+	t.Run("paused buffer is not flushed early", func(t *testing.T) {
+		b := newMemoryBudget(100, nil)
+		paused, active := b.register("paused"), b.register("active")
+		b.pause(paused, true)
+		b.capture(paused, 70)
+		b.capture(active, 30)
+		if len(paused.pressure) != 0 || len(active.pressure) != 1 {
+			t.Errorf("unexpected flush requests: paused=%d, active=%d", len(paused.pressure), len(active.pressure))
+		}
+	})
+}
+
+func TestMemoryBudgetEarlyFlush(t *testing.T) {
+	ctx := context.Background()
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		S3InjectedConf: S3InjectedConf{
+			InMemory: true,
+		},
+		IngestConf: IngestConf{
+			MaxBufferedBytesTotal: 100,
+		},
+	})
+	svc := d.Service()
+	for _, name := range []string{"budget-large", "budget-small"} {
+		if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+			DeliveryStreamName: aws.String(name),
+			S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+				BucketARN: aws.String("arn:aws:s3:::budget-bucket"),
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put := func(name string, size int) {
+		t.Helper()
+		if _, err := svc.Put(ctx, &firehose.PutRecordInput{
+			DeliveryStreamName: aws.String(name),
+			Record:             &fhtypes.Record{Data: []byte(strings.Repeat("!", size))},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// wait until destination captures the record.
+		if _, err := d.BufferStatus(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("budget-large", 60)
+	put("budget-small", 50)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := d.WaitForDeliveries(waitCtx, "budget-large", 1); err != nil {
+		t.Fatalf("the largest buffer is not flushed: %v", err)
+	}
+	if st, _ := d.BufferStatus(ctx, "budget-small"); st.SizeInBytes != 50 {
+		t.Errorf("smaller buffer should keep buffering: %#v", st)
+	}
+	rec := httptest.NewRecorder()
+	d.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, expected := range []string{
+		`firehose_early_flushes_total{delivery_stream_name="budget-large"} 1`,
+		`firehose_memory_budget_bytes 100`,
+		`firehose_memory_used_bytes 50`,
+		`firehose_buffered_bytes{delivery_stream_name="budget-small"} 50`,
+	} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("metric not found: %s", expected)
+		}
+	}
+}
+
+func TestMemoryBudgetRejectsPuts(t *testing.T) {
+	ctx := context.Background()
+	fake := &slowS3{
+		gate:     make(chan struct{}),
+		started:  make(chan string, 10),
+		received: map[string]string{},
+	}
+	s3srv := httptest.NewServer(fake)
+	defer s3srv.Close()
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		S3InjectedConf: S3InjectedConf{
+			EndPoint:         aws.String(s3srv.URL),
+			DisableBuffering: true,
+		},
+		IngestConf: IngestConf{
+			MaxBufferedBytesTotal: 100,
+		},
+	})
+	svc := d.Service()
+	streamName := "budget-reject"
+	if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+			BucketARN: aws.String("arn:aws:s3:::budget-bucket"),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	put := func() error {
+		_, err := svc.Put(ctx, &firehose.PutRecordInput{
+			DeliveryStreamName: &streamName,
+			Record:             &fhtypes.Record{Data: []byte(strings.Repeat("!", 120))},
+		})
+		return err
+	}
+	if err := put(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-fake.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload is not started")
+	}
+
+	var unavailable *fhtypes.ServiceUnavailableException
+	if err := put(); !errors.As(err, &unavailable) {
+		t.Errorf("put is accepted while upload holds the budget: %v", err)
+	}
+	close(fake.gate)
+	flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := d.Flush(flushCtx, streamName); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(); err != nil {
+		t.Errorf("put is rejected after upload: %v", err)
+	}
+}
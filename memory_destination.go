@@ -0,0 +1,113 @@
+package toyhose
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Delivery represents an object delivered to in-memory destination.
+type Delivery struct {
+	Bucket      string
+	Key         string
+	Body        []byte
+	RecordIDs   []string
+	DeliveredAt time.Time
+}
+
+type memoryStore struct {
+	mutex      sync.Mutex
+	deliveries map[string][]Delivery
+	notify     chan struct{}
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		deliveries: map[string][]Delivery{},
+		notify:     make(chan struct{}),
+	}
+}
+
+func (m *memoryStore) Put(streamName string, d Delivery) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.deliveries[streamName] = append(m.deliveries[streamName], d)
+	// wake up every waiter and prepare next notification.
+	close(m.notify)
+	m.notify = make(chan struct{})
+}
+
+func (m *memoryStore) List(streamName string) []Delivery {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.list(streamName)
+}
+
+func (m *memoryStore) list(streamName string) []Delivery {
+	stored := m.deliveries[streamName]
+	copied := make([]Delivery, len(stored))
+	copy(copied, stored)
+	return copied
+}
+
+func (m *memoryStore) Find(streamName, key string) (Delivery, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, d := range m.deliveries[streamName] {
+		if d.Key == key {
+			return d, true
+		}
+	}
+	return Delivery{}, false
+}
+
+func (m *memoryStore) Wait(ctx context.Context, streamName string, count int) ([]Delivery, error) {
+	for {
+		m.mutex.Lock()
+		if len(m.deliveries[streamName]) >= count {
+			list := m.list(streamName)
+			m.mutex.Unlock()
+			return list, nil
+		}
+		notify := m.notify
+		m.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+func (m *memoryStore) Clear(streamName string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.deliveries, streamName)
+}
+
+func (m *memoryStore) ClearAll() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.deliveries = map[string][]Delivery{}
+}
+
+// Deliveries returns objects delivered to in-memory destination of supplied deliveryStreamName.
+func (d *Dispatcher) Deliveries(streamName string) []Delivery {
+	return d.memory.List(streamName)
+}
+
+// FindDelivery returns in-memory delivered object by deliveryStreamName and object key.
+func (d *Dispatcher) FindDelivery(streamName, key string) (Delivery, bool) {
+	return d.memory.Find(streamName, key)
+}
+
+// WaitForDeliveries blocks until at least count objects are delivered to supplied deliveryStreamName or ctx is done.
+func (d *Dispatcher) WaitForDeliveries(ctx context.Context, streamName string, count int) ([]Delivery, error) {
+	return d.memory.Wait(ctx, streamName, count)
+}
+
+// ClearDeliveries removes in-memory delivered objects of supplied deliveryStreamName.
+func (d *Dispatcher) ClearDeliveries(streamName string) {
+	d.memory.Clear(streamName)
+}
@@ -0,0 +1,119 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestMemoryStoreWait(t *testing.T) {
+	m := newMemoryStore()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := m.Wait(ctx, "foobar", 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		m.Put("foobar", Delivery{Key: "aaa"})
+		m.Put("foobar", Delivery{Key: "bbb"})
+	}()
+	list, err := m.Wait(context.Background(), "foobar", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Key != "aaa" || list[1].Key != "bbb" {
+		t.Errorf("unexpected deliveries: %#v", list)
+	}
+	if _, ok := m.Find("foobar", "bbb"); !ok {
+		t.Error("delivery not found")
+	}
+	if _, ok := m.Find("barbaz", "bbb"); ok {
+		t.Error("delivery found from wrong stream")
+	}
+	m.Clear("foobar")
+	if l := len(m.List("foobar")); l != 0 {
+		t.Errorf("deliveries remain after clear: %d", l)
+	}
+}
+
+func TestInMemoryDeliveryFromAPI(t *testing.T) {
+	ctx := context.Background()
+	awsConf := awsConfig(t)
+
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConf,
+		S3InjectedConf: S3InjectedConf{
+			DisableBuffering: true,
+			InMemory:         true,
+		},
+	})
+	mux := http.ServeMux{}
+	mux.HandleFunc("/", d.Dispatch)
+	testserver := httptest.NewServer(&mux)
+	defer testserver.Close()
+
+	fh := firehose.NewFromConfig(awsConf, func(o *firehose.Options) {
+		o.BaseEndpoint = aws.String(testserver.URL)
+	})
+	streamName := "in-memory-stream"
+	if _, err := fh.CreateDeliveryStream(ctx, &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+			BucketARN: aws.String("arn:aws:s3:::in-memory-bucket"),
+			Prefix:    aws.String("ccc"),
+			RoleARN:   aws.String("foo"),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := fh.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: &streamName,
+		Records: []fhtypes.Record{
+			{Data: []byte("1111111111\n")},
+			{Data: []byte("2222222222\n")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	deliveries, err := d.WaitForDeliveries(waitCtx, streamName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, dlv := range deliveries {
+		if dlv.Bucket != "in-memory-bucket" {
+			t.Errorf("[%d] unexpected bucket: %s", idx, dlv.Bucket)
+		}
+		if len(dlv.RecordIDs) != 1 || dlv.RecordIDs[0] != *out.RequestResponses[idx].RecordId {
+			t.Errorf("[%d] unexpected record ids: %v", idx, dlv.RecordIDs)
+		}
+		if dlv.DeliveredAt.IsZero() {
+			t.Errorf("[%d] DeliveredAt is missing", idx)
+		}
+		found, ok := d.FindDelivery(streamName, dlv.Key)
+		if !ok || string(found.Body) != string(dlv.Body) {
+			t.Errorf("[%d] delivery not found by key: %s", idx, dlv.Key)
+		}
+	}
+	if body := string(deliveries[0].Body) + string(deliveries[1].Body); body != "1111111111\n2222222222\n" {
+		t.Errorf("unexpected body delivered: %s", body)
+	}
+
+	d.ClearDeliveries(streamName)
+	if l := len(d.Deliveries(streamName)); l != 0 {
+		t.Errorf("deliveries remain after clear: %d", l)
+	}
+}
@@ -0,0 +1,274 @@
+package toyhose
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds per deliveryStream collectors named after Firehose CloudWatch metrics.
+// every method is nil-safe, so components built without metrics keep working.
+type metrics struct {
+	registry                   *prometheus.Registry
+	incomingRecords            *prometheus.CounterVec
+	incomingBytes              *prometheus.CounterVec
+	incomingPutRequests        *prometheus.CounterVec
+	throttledRecords           *prometheus.CounterVec
+	deliveryToS3Records        *prometheus.CounterVec
+	deliveryToS3Bytes          *prometheus.CounterVec
+	deliveryToS3Success        *prometheus.CounterVec
+	deliveryToS3Attempts       *prometheus.CounterVec
+	deliveryToS3DataFreshness  *prometheus.HistogramVec
+	dataReadFromKinesisRecords *prometheus.CounterVec
+	dataReadFromKinesisBytes   *prometheus.CounterVec
+	kinesisMillisBehindLatest  *prometheus.GaugeVec
+	kinesisGetRecordsLatency   *prometheus.HistogramVec
+	deliveryToS3ObjectSize     *prometheus.HistogramVec
+	spilledBatches             *prometheus.GaugeVec
+	redeliveredBatches         *prometheus.CounterVec
+	memoryBudgetBytes          prometheus.Gauge
+	memoryUsedBytes            prometheus.Gauge
+	bufferedBytes              *prometheus.GaugeVec
+	earlyFlushes               *prometheus.CounterVec
+
+	// freshnessRanges keeps minimum and maximum of DataFreshness per stream, which histogram does not,
+	// until metricsPublisher takes them.
+	rangeMutex      sync.Mutex
+	freshnessRanges map[string]valueRange
+}
+
+// valueRange is the minimum and maximum of observed values.
+type valueRange struct {
+	min, max float64
+}
+
+func (r valueRange) merge(o valueRange) valueRange {
+	return valueRange{min: min(r.min, o.min), max: max(r.max, o.max)}
+}
+
+const metricsNamespace = "firehose"
+
+var streamLabel = []string{"delivery_stream_name"}
+
+func newMetrics() *metrics {
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		}, streamLabel)
+	}
+	m := &metrics{
+		registry:             prometheus.NewRegistry(),
+		incomingRecords:      counter("incoming_records_total", "IncomingRecords: number of records ingested by PutRecord and PutRecordBatch."),
+		incomingBytes:        counter("incoming_bytes_total", "IncomingBytes: bytes of records ingested by PutRecord and PutRecordBatch."),
+		incomingPutRequests:  counter("incoming_put_requests_total", "IncomingPutRequests: number of PutRecord and PutRecordBatch requests."),
+		throttledRecords:     counter("throttled_records_total", "ThrottledRecords: number of records rejected because of exhausted capacity."),
+		deliveryToS3Records:  counter("delivery_to_s3_records_total", "DeliveryToS3.Records: number of records delivered to S3."),
+		deliveryToS3Bytes:    counter("delivery_to_s3_bytes_total", "DeliveryToS3.Bytes: bytes of objects delivered to S3."),
+		deliveryToS3Success:  counter("delivery_to_s3_success_total", "DeliveryToS3.Success: number of successful S3 put commands."),
+		deliveryToS3Attempts: counter("delivery_to_s3_attempts_total", "number of S3 put commands. DeliveryToS3.Success is success_total / attempts_total."),
+		deliveryToS3DataFreshness: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "delivery_to_s3_data_freshness_seconds",
+			Help:      "DeliveryToS3.DataFreshness: age of the oldest record in each object delivered to S3.",
+			Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 900},
+		}, streamLabel),
+		deliveryToS3ObjectSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "delivery_to_s3_object_size_bytes",
+			Help:      "size of each object delivered to S3.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+		}, streamLabel),
+		dataReadFromKinesisRecords: counter("data_read_from_kinesis_stream_records_total", "DataReadFromKinesisStream.Records: number of records read from source Kinesis stream."),
+		dataReadFromKinesisBytes:   counter("data_read_from_kinesis_stream_bytes_total", "DataReadFromKinesisStream.Bytes: bytes of records read from source Kinesis stream."),
+		kinesisMillisBehindLatest: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "kinesis_millis_behind_latest",
+			Help:      "KinesisMillisBehindLatest: how far the source Kinesis consumer is behind the tip of the stream.",
+		}, streamLabel),
+		kinesisGetRecordsLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "kinesis_get_records_latency_seconds",
+			Help:      "latency of GetRecords calls against source Kinesis stream.",
+			Buckets:   prometheus.DefBuckets,
+		}, streamLabel),
+		spilledBatches: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "spilled_batches",
+			Help:      "number of batches waiting for redelivery in spill directory.",
+		}, streamLabel),
+		redeliveredBatches: counter("redelivered_batches_total", "number of spilled batches redelivered to S3."),
+		memoryBudgetBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "memory_budget_bytes",
+			Help:      "byte budget of destination buffers and their uploads shared by every stream.",
+		}),
+		memoryUsedBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "memory_used_bytes",
+			Help:      "bytes of records held by destination buffers and their uploads of every stream.",
+		}),
+		bufferedBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "buffered_bytes",
+			Help:      "bytes of records in destination buffer waiting for BufferingHints.",
+		}, streamLabel),
+		earlyFlushes: counter("early_flushes_total", "number of buffers delivered before BufferingHints because memory budget is hit."),
+	}
+	m.registry.MustRegister(
+		m.incomingRecords,
+		m.incomingBytes,
+		m.incomingPutRequests,
+		m.throttledRecords,
+		m.deliveryToS3Records,
+		m.deliveryToS3Bytes,
+		m.deliveryToS3Success,
+		m.deliveryToS3Attempts,
+		m.deliveryToS3DataFreshness,
+		m.deliveryToS3ObjectSize,
+		m.dataReadFromKinesisRecords,
+		m.dataReadFromKinesisBytes,
+		m.kinesisMillisBehindLatest,
+		m.kinesisGetRecordsLatency,
+		m.spilledBatches,
+		m.redeliveredBatches,
+		m.memoryBudgetBytes,
+		m.memoryUsedBytes,
+		m.bufferedBytes,
+		m.earlyFlushes,
+	)
+	return m
+}
+
+func (m *metrics) observeIncoming(streamName string, records, bytes int) {
+	if m == nil {
+		return
+	}
+	m.incomingPutRequests.WithLabelValues(streamName).Inc()
+	m.incomingRecords.WithLabelValues(streamName).Add(float64(records))
+	m.incomingBytes.WithLabelValues(streamName).Add(float64(bytes))
+}
+
+func (m *metrics) observeThrottled(streamName string, records int) {
+	if m == nil {
+		return
+	}
+	m.throttledRecords.WithLabelValues(streamName).Add(float64(records))
+}
+
+func (m *metrics) observeDeliveryToS3(streamName string, records []*DeliveryRecord, size int, ts time.Time, succeeded bool) {
+	if m == nil {
+		return
+	}
+	m.deliveryToS3Attempts.WithLabelValues(streamName).Inc()
+	if !succeeded {
+		return
+	}
+	m.deliveryToS3Success.WithLabelValues(streamName).Inc()
+	m.deliveryToS3Records.WithLabelValues(streamName).Add(float64(len(records)))
+	m.deliveryToS3Bytes.WithLabelValues(streamName).Add(float64(size))
+	m.deliveryToS3ObjectSize.WithLabelValues(streamName).Observe(float64(size))
+	oldest := ts
+	for _, rec := range records {
+		if rec.ArrivedAt.Before(oldest) {
+			oldest = rec.ArrivedAt
+		}
+	}
+	freshness := ts.Sub(oldest).Seconds()
+	m.deliveryToS3DataFreshness.WithLabelValues(streamName).Observe(freshness)
+	m.restoreFreshnessRange(streamName, valueRange{min: freshness, max: freshness})
+}
+
+// takeFreshnessRanges returns ranges of DataFreshness observed since the last take.
+func (m *metrics) takeFreshnessRanges() map[string]valueRange {
+	m.rangeMutex.Lock()
+	defer m.rangeMutex.Unlock()
+	ranges := m.freshnessRanges
+	m.freshnessRanges = nil
+	return ranges
+}
+
+// restoreFreshnessRange merges r into the range of streamName, so that it is taken next time.
+func (m *metrics) restoreFreshnessRange(streamName string, r valueRange) {
+	m.rangeMutex.Lock()
+	defer m.rangeMutex.Unlock()
+	if m.freshnessRanges == nil {
+		m.freshnessRanges = map[string]valueRange{}
+	}
+	if cur, ok := m.freshnessRanges[streamName]; ok {
+		r = r.merge(cur)
+	}
+	m.freshnessRanges[streamName] = r
+}
+
+func (m *metrics) setSpilledBatches(streamName string, batches int) {
+	if m == nil {
+		return
+	}
+	m.spilledBatches.WithLabelValues(streamName).Set(float64(batches))
+}
+
+func (m *metrics) observeRedelivered(streamName string) {
+	if m == nil {
+		return
+	}
+	m.redeliveredBatches.WithLabelValues(streamName).Inc()
+}
+
+func (m *metrics) setMemoryBudget(limit int) {
+	if m == nil {
+		return
+	}
+	m.memoryBudgetBytes.Set(float64(limit))
+}
+
+func (m *metrics) setMemoryUsed(used int) {
+	if m == nil {
+		return
+	}
+	m.memoryUsedBytes.Set(float64(used))
+}
+
+func (m *metrics) setBufferedBytes(streamName string, size int) {
+	if m == nil {
+		return
+	}
+	m.bufferedBytes.WithLabelValues(streamName).Set(float64(size))
+}
+
+func (m *metrics) deleteBufferedBytes(streamName string) {
+	if m == nil {
+		return
+	}
+	m.bufferedBytes.DeleteLabelValues(streamName)
+}
+
+func (m *metrics) observeEarlyFlush(streamName string) {
+	if m == nil {
+		return
+	}
+	m.earlyFlushes.WithLabelValues(streamName).Inc()
+}
+
+func (m *metrics) observeKinesisRead(streamName string, records, bytes int, millisBehindLatest *int64, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.dataReadFromKinesisRecords.WithLabelValues(streamName).Add(float64(records))
+	m.dataReadFromKinesisBytes.WithLabelValues(streamName).Add(float64(bytes))
+	if latency > 0 {
+		m.kinesisGetRecordsLatency.WithLabelValues(streamName).Observe(latency.Seconds())
+	}
+	if millisBehindLatest != nil {
+		m.kinesisMillisBehindLatest.WithLabelValues(streamName).Set(float64(*millisBehindLatest))
+	}
+}
+
+// MetricsHandler returns http.Handler which exposes metrics in Prometheus text format.
+func (d *Dispatcher) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(d.metrics.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,68 @@
+package toyhose
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	ctx := context.Background()
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		S3InjectedConf: S3InjectedConf{
+			InMemory: true,
+		},
+	})
+	svc := d.Service()
+	streamName := "metrics-stream"
+	if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+			BucketARN: aws.String("arn:aws:s3:::metrics-bucket"),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.PutBatch(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: &streamName,
+		Records: []fhtypes.Record{
+			{Data: []byte("hello!\n")},
+			{Data: []byte("world!\n")},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := d.Flush(flushCtx, streamName); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	d.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	b, _ := io.ReadAll(rec.Body)
+	body := string(b)
+	for _, expected := range []string{
+		`firehose_incoming_put_requests_total{delivery_stream_name="metrics-stream"} 1`,
+		`firehose_incoming_records_total{delivery_stream_name="metrics-stream"} 2`,
+		`firehose_incoming_bytes_total{delivery_stream_name="metrics-stream"} 14`,
+		`firehose_delivery_to_s3_records_total{delivery_stream_name="metrics-stream"} 2`,
+		`firehose_delivery_to_s3_bytes_total{delivery_stream_name="metrics-stream"} 14`,
+		`firehose_delivery_to_s3_success_total{delivery_stream_name="metrics-stream"} 1`,
+		`firehose_delivery_to_s3_attempts_total{delivery_stream_name="metrics-stream"} 1`,
+		`firehose_delivery_to_s3_data_freshness_seconds_count{delivery_stream_name="metrics-stream"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("metric not found: %s", expected)
+		}
+	}
+}
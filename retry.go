@@ -0,0 +1,101 @@
+package toyhose
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// RetryConf represents how deliveries to S3 are retried.
+type RetryConf struct {
+	// Duration bounds retries of each batch, across every S3 command of its upload.
+	// The default is 24 hours, the same as Firehose retries delivery to S3.
+	Duration time.Duration
+	// InitialBackoff and MaxBackoff bound exponential backoff between trials, which is jittered.
+	// The defaults are 100ms and 30s.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// SpillDir keeps batches which are not delivered within Duration, instead of dropping them.
+	// Spilled batches are redelivered every RedeliveryInterval, even after toyhose restarts.
+	SpillDir string
+	// RedeliveryInterval is the interval of redelivery of spilled batches. The default is 1 minute.
+	RedeliveryInterval time.Duration
+}
+
+const (
+	defaultRetryDuration      = 24 * time.Hour
+	defaultInitialBackoff     = 100 * time.Millisecond
+	defaultMaxBackoff         = 30 * time.Second
+	defaultRedeliveryInterval = time.Minute
+)
+
+// retryPolicy is RetryConf with defaults resolved. zero value tries only once.
+type retryPolicy struct {
+	duration       time.Duration
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+func (c RetryConf) policy() retryPolicy {
+	p := retryPolicy{
+		duration:       c.Duration,
+		initialBackoff: c.InitialBackoff,
+		maxBackoff:     c.MaxBackoff,
+	}
+	if p.duration <= 0 {
+		p.duration = defaultRetryDuration
+	}
+	if p.initialBackoff <= 0 {
+		p.initialBackoff = defaultInitialBackoff
+	}
+	if p.maxBackoff <= 0 {
+		p.maxBackoff = defaultMaxBackoff
+	}
+	return p
+}
+
+func (c RetryConf) redeliveryInterval() time.Duration {
+	if c.RedeliveryInterval > 0 {
+		return c.RedeliveryInterval
+	}
+	return defaultRedeliveryInterval
+}
+
+// backoff returns jittered wait before trial of attempt+1.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.maxBackoff
+	if attempt < 32 {
+		if exp := p.initialBackoff << attempt; exp > 0 && exp < d {
+			d = exp
+		}
+	}
+	if d <= 0 {
+		return 0
+	}
+	// full jitter spreads retries of concurrent uploads.
+	return time.Duration(rand.Int63n(int64(d))) + 1
+}
+
+// retryS3 calls fn until it succeeds, deadline passes or ctx is done.
+// Backoff waits in real time even in deterministic mode, since S3 recovers in real time
+// and a retry asleep on virtual clock would hold AdvanceClock until the next advance.
+// onAttempt observes each result when supplied.
+func retryS3(ctx context.Context, deadline time.Time, p retryPolicy, fn func(ctx context.Context) error, onAttempt func(err error)) error {
+	for attempt := 0; ; attempt++ {
+		err := fn(ctx)
+		if onAttempt != nil {
+			onAttempt(err)
+		}
+		if err == nil {
+			return nil
+		}
+		wait := p.backoff(attempt)
+		if wait <= 0 || time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		log.Debug().Err(err).Int("attempt", attempt+1).Dur("backoff", wait).Msg("retrying S3 command")
+		if !sleepContext(ctx, wait) {
+			return err
+		}
+	}
+}
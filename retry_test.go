@@ -0,0 +1,58 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryS3(t *testing.T) {
+	ctx := context.Background()
+	p := retryPolicy{duration: time.Minute, initialBackoff: time.Millisecond, maxBackoff: time.Millisecond}
+	errFailed := errors.New("failed")
+
+	t.Run("retries until success", func(t *testing.T) {
+		calls := 0
+		var observed []error
+		err := retryS3(ctx, time.Now().Add(p.duration), p, func(ctx context.Context) error {
+			calls++
+			if calls < 3 {
+				return errFailed
+			}
+			return nil
+		}, func(err error) {
+			observed = append(observed, err)
+		})
+		if err != nil || calls != 3 || len(observed) != 3 {
+			t.Errorf("unexpected retries: %d calls, %d observed, %v", calls, len(observed), err)
+		}
+	})
+
+	t.Run("deadline is shared by commands", func(t *testing.T) {
+		// the deadline has been used up by commands before.
+		deadline := time.Now()
+		calls := 0
+		err := retryS3(ctx, deadline, p, func(ctx context.Context) error {
+			calls++
+			return errFailed
+		}, nil)
+		if !errors.Is(err, errFailed) || calls != 1 {
+			t.Errorf("command after deadline is retried: %d calls, %v", calls, err)
+		}
+	})
+
+	t.Run("canceled while backing off", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		slow := retryPolicy{duration: time.Hour, initialBackoff: time.Hour, maxBackoff: time.Hour}
+		calls := 0
+		err := retryS3(canceled, time.Now().Add(slow.duration), slow, func(ctx context.Context) error {
+			calls++
+			cancel()
+			return errFailed
+		}, nil)
+		if !errors.Is(err, errFailed) || calls != 1 {
+			t.Errorf("unexpected result: %d calls, %v", calls, err)
+		}
+	})
+}
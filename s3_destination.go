@@ -2,7 +2,6 @@ package toyhose
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
@@ -12,20 +11,45 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type s3Destination struct {
-	deliveryName      string
-	bucketARN         string
-	bufferingHints    *types.BufferingHints
-	compressionFormat types.CompressionFormat
-	errorOutputPrefix *string
-	prefix            *string
-	captured          []*deliveryRecord
-	awsConf           aws.Config
-	injectedConf      S3InjectedConf
-	capturedSize      int
+	deliveryName             string
+	bucketARN                string
+	bufferingHints           *types.BufferingHints
+	compressionFormat        types.CompressionFormat
+	encryptionConfiguration  *types.EncryptionConfiguration
+	errorOutputPrefix        *string
+	prefix                   *string
+	roleARN                  *string
+	cloudWatchLoggingOptions *types.CloudWatchLoggingOptions
+	errorLog                 *streamErrorLogger
+	tracer                   trace.Tracer
+	ledger                   *ledger
+	tail                     *tailHub
+	webhooks                 *webhookNotifier
+	clock                    Clock
+	ids                      IDGenerator
+	captured                 []*DeliveryRecord
+	awsConf                  aws.Config
+	injectedConf             S3InjectedConf
+	retryConf                RetryConf
+	budget                   *memoryBudget
+	capturedSize             int
+	memory                   *memoryStore
+	metrics                  *metrics
+	conf                     s3StoreConfig
+	uploader                 *s3Uploader
+	ctrlCh                   chan func(ctx context.Context)
+	ticker                   Ticker
+	paused                   bool
+
+	// stopped is closed when Run returns, so that commands to deleted stream do not block.
+	stopped chan struct{}
+	// holder charges buffer to budget shared by streams.
+	holder *memoryHolder
 }
 
 func s3Client(conf aws.Config, endpoint string) *s3.Client {
@@ -41,45 +65,150 @@ type s3StoreConfig struct {
 	prefix             string
 	shouldGZipCompress bool
 	s3cli              *s3.Client
+	memory             *memoryStore
+	metrics            *metrics
+	errorLog           *streamErrorLogger
+	tracer             trace.Tracer
+	ledger             *ledger
+	tail               *tailHub
+	webhooks           *webhookNotifier
+	clock              Clock
+	ids                IDGenerator
 	bufferSize         int // byte
 	tickDuration       time.Duration
+	partSize           int // byte
+	retry              retryPolicy
+	spill              *spillStore
+	budget             *memoryBudget
 }
 
-func storeToS3(ctx context.Context, conf s3StoreConfig, ts time.Time, records []*deliveryRecord) {
-	data := make([]byte, 0, 1024*1024)
+func storeToS3(ctx context.Context, conf s3StoreConfig, ts time.Time, records []*DeliveryRecord) {
+	size := 0
 	for _, rec := range records {
-		data = append(data, rec.data...)
+		size += len(rec.Data)
 	}
-	if len(data) < 1 {
+	if size < 1 {
+		acknowledge(records)
 		return
 	}
-	var seekable []byte
-	if conf.shouldGZipCompress {
-		b := bytes.NewBuffer([]byte{})
-		w := gzip.NewWriter(b)
-		_, _ = w.Write(data)
-		w.Close()
-		seekable = b.Bytes()
-	} else {
-		seekable = data
-	}
-	pref := strings.TrimSuffix(keyPrefix(conf.prefix, ts), "/")
-	key := fmt.Sprintf("%s/%s-1-%s-%s", pref, conf.deliveryName, ts.Format("2006-01-02-15-04-05"), uuid.New())
-	input := &s3.PutObjectInput{
-		Bucket: &conf.bucketName,
-		Body:   bytes.NewReader(seekable),
-		Key:    &key,
-	}
-	log.Debug().Str("key", key).Int("size", len(seekable)).Msg("PutObject start")
-	cli := conf.s3cli
-	for i := 0; i < 30; i++ {
-		if _, err := cli.PutObject(ctx, input); err == nil {
-			log.Debug().Str("key", key).Msgf("PutObject succeeded. trial count: %d", i+1)
+	pref := strings.TrimSuffix(keyPrefix(conf.prefix, ts, conf.ids), "/")
+	key := fmt.Sprintf("%s/%s-1-%s-%s", pref, conf.deliveryName, ts.Format("2006-01-02-15-04-05"), newID(conf.ids))
+	err := putBatch(ctx, conf, conf.retry, key, ts, records)
+	if err == nil {
+		return
+	}
+	conf.errorLog.deliveryFailed(ctx, "S3", err)
+	failedAt := clockNow(conf.clock)
+	notification := deliveryNotification(conf, key, ts, records)
+	notification.Timestamp = failedAt
+	notification.Error = err.Error()
+	if conf.spill != nil {
+		serr := spill(conf, key, ts, records, err)
+		if serr == nil {
+			log.Error().Err(err).Str("key", key).Msg("upload failed. the batch is spilled for redelivery")
+			conf.ledger.spilled(conf.deliveryName, key, records, failedAt, err)
+			// the spilled file keeps records from now, so their source need not read them again.
+			acknowledge(records)
+			notification.Status = DeliveryStatusSpilled
+			conf.webhooks.notify(notification)
 			return
 		}
-		time.Sleep(100 * time.Millisecond)
+		log.Error().Err(serr).Str("key", key).Msg("failed to spill the batch")
+	}
+	log.Error().Err(err).Str("key", key).Msg("upload failed. the batch is dropped")
+	conf.ledger.failed(conf.deliveryName, records, failedAt, err)
+	abandon(records)
+	notification.Status = DeliveryStatusFailed
+	conf.webhooks.notify(notification)
+}
+
+func deliveryNotification(conf s3StoreConfig, key string, ts time.Time, records []*DeliveryRecord) DeliveryNotification {
+	recordIDs := make([]string, 0, len(records))
+	for _, rec := range records {
+		recordIDs = append(recordIDs, rec.ID)
+	}
+	return DeliveryNotification{
+		Status:             DeliveryStatusSucceeded,
+		DeliveryStreamName: conf.deliveryName,
+		Bucket:             conf.bucketName,
+		Key:                key,
+		RecordCount:        len(records),
+		Compression:        conf.compression(),
+		RecordIDs:          recordIDs,
+		Timestamp:          ts,
+	}
+}
+
+// putBatch delivers records as key, retrying by retry, and records the success.
+// The caller handles failure, since a failed batch may be spilled or dropped.
+func putBatch(ctx context.Context, conf s3StoreConfig, retry retryPolicy, key string, ts time.Time, records []*DeliveryRecord) (err error) {
+	notification := deliveryNotification(conf, key, ts, records)
+	// delivery runs apart from any request, so the span is a root linked to ingest spans of its records.
+	ctx, span := startSpan(ctx, conf.tracer, "S3.PutObject",
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithLinks(recordLinks(records)...),
+		trace.WithAttributes(
+			attrDeliveryStreamName.String(conf.deliveryName),
+			attribute.String("aws.s3.bucket", conf.bucketName),
+			attribute.String("aws.s3.key", key),
+			attrRecordIDs.StringSlice(notification.RecordIDs),
+		),
+	)
+	defer func() { endSpan(span, err) }()
+	if conf.memory != nil {
+		// body is kept by the memory store, so it is encoded into a buffer of its own instead of a pooled one.
+		buf := &bytes.Buffer{}
+		_ = encodeRecords(buf, records, conf.shouldGZipCompress)
+		body := buf.Bytes()
+		conf.memory.Put(conf.deliveryName, Delivery{
+			Bucket:      conf.bucketName,
+			Key:         key,
+			Body:        body,
+			RecordIDs:   notification.RecordIDs,
+			DeliveredAt: ts,
+		})
+		log.Debug().Str("key", key).Int("size", len(body)).Msg("stored to memory")
+		notification.SizeInBytes = len(body)
+		conf.ledger.delivered(conf.deliveryName, conf.bucketName, key, records, ts)
+		acknowledge(records)
+		conf.tail.delivered(conf.deliveryName, conf.bucketName, key, records, len(body), ts)
+		conf.webhooks.notify(notification)
+		conf.metrics.observeDeliveryToS3(conf.deliveryName, records, len(body), ts, true)
+		return nil
+	}
+	log.Debug().Str("key", key).Int("records", len(records)).Msg("upload start")
+	// records are compressed into parts while they are uploaded, so the object size is known at the end.
+	// attempts of the final command, PutObject or CompleteMultipartUpload, are observed as delivery attempts.
+	var attempts []error
+	w := newObjectWriter(ctx, conf, retry, time.Now().Add(retry.duration), key, func(err error) {
+		if err != nil && len(attempts) == 0 {
+			conf.ledger.retrying(conf.deliveryName, key, records, clockNow(conf.clock), err)
+		}
+		attempts = append(attempts, err)
+	})
+	if err = encodeRecords(w, records, conf.shouldGZipCompress); err != nil {
+		_, _ = w.Close()
+	} else {
+		notification.SizeInBytes, err = w.Close()
+	}
+	for _, e := range attempts {
+		conf.metrics.observeDeliveryToS3(conf.deliveryName, records, notification.SizeInBytes, ts, e == nil)
 	}
-	log.Debug().Str("key", key).Msg("PutObject failed")
+	if err != nil {
+		log.Debug().Str("key", key).Err(err).Msg("upload failed")
+		if len(attempts) == 0 {
+			// parts failed before the final command.
+			conf.metrics.observeDeliveryToS3(conf.deliveryName, records, notification.SizeInBytes, ts, false)
+		}
+		return err
+	}
+	log.Debug().Str("key", key).Msgf("upload succeeded. trial count: %d", len(attempts))
+	conf.ledger.delivered(conf.deliveryName, conf.bucketName, key, records, ts)
+	acknowledge(records)
+	conf.tail.delivered(conf.deliveryName, conf.bucketName, key, records, notification.SizeInBytes, ts)
+	conf.webhooks.notify(notification)
+	return nil
 }
 
 func (c *s3Destination) bufferSizeInMBs() int32 {
@@ -108,16 +237,23 @@ func (c *s3Destination) bufferIntervalSeconds() int32 {
 	return dur
 }
 
-func (c *s3Destination) Setup(ctx context.Context) (s3StoreConfig, error) {
-	s3cli := s3Client(c.awsConf, *c.injectedConf.EndPoint)
+// partSize returns the part size of multipart upload, raised to the minimum of S3.
+func (c *s3Destination) partSize() int {
+	if c.injectedConf.MultipartPartSizeInMBs <= 0 {
+		return defaultPartSize
+	}
+	size := c.injectedConf.MultipartPartSizeInMBs * 1024 * 1024
+	if size < minPartSize {
+		log.Warn().Int("part_size_in_mbs", c.injectedConf.MultipartPartSizeInMBs).Msg("multipart part size is smaller than 5MiB which S3 requires. 5MiB is used instead")
+		return minPartSize
+	}
+	return size
+}
+
+func (c *s3Destination) Setup(ctx context.Context) error {
 	bucketName := strings.ReplaceAll(c.bucketARN, "arn:aws:s3:::", "")
 	if bucketName == "" {
-		return s3StoreConfig{}, errors.New("required bucket_name")
-	}
-	if _, err := s3cli.HeadBucket(ctx, &s3.HeadBucketInput{
-		Bucket: &bucketName,
-	}); err != nil {
-		return s3StoreConfig{}, err
+		return errors.New("required bucket_name")
 	}
 	prefix := ""
 	if c.prefix != nil {
@@ -128,50 +264,242 @@ func (c *s3Destination) Setup(ctx context.Context) (s3StoreConfig, error) {
 		bucketName:         bucketName,
 		prefix:             prefix,
 		shouldGZipCompress: c.compressionFormat == types.CompressionFormatGzip,
-		s3cli:              s3cli,
+		metrics:            c.metrics,
+		errorLog:           c.errorLog,
+		tracer:             c.tracer,
+		ledger:             c.ledger,
+		tail:               c.tail,
+		webhooks:           c.webhooks,
+		clock:              c.clock,
+		ids:                c.ids,
 		bufferSize:         int(c.bufferSizeInMBs()) * 1024 * 1024,
 		tickDuration:       time.Duration(c.bufferIntervalSeconds()) * time.Second,
+		partSize:           c.partSize(),
+		retry:              c.retryConf.policy(),
+		spill:              newSpillStore(c.retryConf.SpillDir),
+		budget:             c.budget,
+	}
+	c.ctrlCh = make(chan func(ctx context.Context))
+	c.stopped = make(chan struct{})
+	if c.injectedConf.InMemory {
+		conf.memory = c.memory
+		c.conf = conf
+		c.uploader = newS3Uploader(conf, c.injectedConf.UploadConcurrency)
+		return nil
+	}
+	s3cli := s3Client(c.awsConf, *c.injectedConf.EndPoint)
+	if _, err := s3cli.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: &bucketName,
+	}); err != nil {
+		return err
+	}
+	conf.s3cli = s3cli
+	c.conf = conf
+	c.uploader = newS3Uploader(conf, c.injectedConf.UploadConcurrency)
+	return nil
+}
+
+func (c *s3Destination) Description() types.DestinationDescription {
+	return types.DestinationDescription{
+		S3DestinationDescription: &types.S3DestinationDescription{
+			BucketARN:                &c.bucketARN,
+			BufferingHints:           c.bufferingHints,
+			CloudWatchLoggingOptions: c.cloudWatchLoggingOptions,
+			CompressionFormat:        c.compressionFormat,
+			EncryptionConfiguration:  c.encryptionConfiguration,
+			ErrorOutputPrefix:        c.errorOutputPrefix,
+			Prefix:                   c.prefix,
+			RoleARN:                  c.roleARN,
+		},
 	}
-	return conf, nil
 }
 
 func (c *s3Destination) reset() {
-	c.captured = make([]*deliveryRecord, 0, 2048)
+	c.captured = make([]*DeliveryRecord, 0, 2048)
 	c.capturedSize = 0
 }
 
-func (c *s3Destination) finalize(conf s3StoreConfig) {
-	newCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	storeToS3(newCtx, conf, time.Now(), c.captured)
+// deliver hands buffered records to uploader and empties the buffer.
+func (c *s3Destination) deliver(ctx context.Context) {
+	c.budget.handOff(c.holder, c.capturedSize)
+	c.uploader.upload(clockNow(c.clock), c.captured)
+	c.reset()
+}
+
+func (c *s3Destination) flush(ctx context.Context) {
+	c.deliver(ctx)
+	c.ticker.Reset(c.conf.tickDuration)
+}
+
+func (c *s3Destination) shouldFlush() bool {
+	if c.paused || len(c.captured) == 0 {
+		return false
+	}
+	return c.injectedConf.DisableBuffering || c.capturedSize >= c.conf.bufferSize
+}
+
+// do runs fn inside Run loop, so that fn can touch buffer safely.
+func (c *s3Destination) do(ctx context.Context, fn func(ctx context.Context)) error {
+	done := make(chan struct{})
+	select {
+	case c.ctrlCh <- func(runCtx context.Context) {
+		defer close(done)
+		fn(runCtx)
+	}:
+	case <-c.stopped:
+		return errStreamNotFound(c.deliveryName)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush delivers buffered records immediately even if delivery is paused.
+// It returns after uploads in flight finish.
+func (c *s3Destination) Flush(ctx context.Context) error {
+	if err := c.do(ctx, func(runCtx context.Context) {
+		c.flush(runCtx)
+	}); err != nil {
+		return err
+	}
+	return c.uploader.wait(ctx)
+}
+
+func (c *s3Destination) waitDeliveries(ctx context.Context) error {
+	return c.uploader.wait(ctx)
+}
+
+// Pause holds delivery by size and interval. Records keep buffering.
+func (c *s3Destination) Pause(ctx context.Context) error {
+	return c.do(ctx, func(runCtx context.Context) {
+		c.paused = true
+		c.budget.pause(c.holder, true)
+	})
+}
+
+// Resume restarts delivery held by Pause.
+func (c *s3Destination) Resume(ctx context.Context) error {
+	return c.do(ctx, func(runCtx context.Context) {
+		c.paused = false
+		c.budget.pause(c.holder, false)
+		if c.shouldFlush() {
+			c.flush(runCtx)
+		}
+	})
+}
+
+// BufferStatus returns current size and count of buffered records.
+func (c *s3Destination) BufferStatus(ctx context.Context) (BufferStatus, error) {
+	var st BufferStatus
+	err := c.do(ctx, func(runCtx context.Context) {
+		st = BufferStatus{
+			Records:           len(c.captured),
+			SizeInBytes:       c.capturedSize,
+			Paused:            c.paused,
+			UploadsInFlight:   c.uploader.inFlight(),
+			SizeLimitInBytes:  c.conf.bufferSize,
+			IntervalInSeconds: int(c.conf.tickDuration / time.Second),
+		}
+	})
+	return st, err
 }
 
-func (c *s3Destination) Run(ctx context.Context, conf s3StoreConfig, recordCh chan *deliveryRecord) {
+// finalize delivers remaining records and waits for every upload,
+// so that deleted stream finishes after what it has accepted is delivered.
+// Uploads are bounded by abortDeliveries, which the caller calls when it stops waiting.
+func (c *s3Destination) finalize() {
+	c.budget.handOff(c.holder, c.capturedSize)
+	c.uploader.upload(clockNow(c.clock), c.captured)
+	_ = c.uploader.wait(context.Background())
+}
+
+// abortDeliveries cuts retries of uploads short, so that batches not delivered yet are spilled or dropped.
+func (c *s3Destination) abortDeliveries() {
+	if c.uploader != nil {
+		c.uploader.abort()
+	}
+}
+
+func (c *s3Destination) capture(ctx context.Context, r *DeliveryRecord) {
+	// records pass through unchanged, since data transformation is not supported yet.
+	c.tail.records(TailStageTransformed, c.deliveryName, []*DeliveryRecord{r})
+	c.captured = append(c.captured, r)
+	c.capturedSize += len(r.Data)
+	c.budget.capture(c.holder, len(r.Data))
+	log.Debug().Int("current", c.capturedSize).Int("limit", c.conf.bufferSize).Msgf("data captured. size: %d", len(r.Data))
+	if c.shouldFlush() {
+		c.flush(ctx)
+	}
+}
+
+func (c *s3Destination) drain(ctx context.Context, recordCh <-chan *DeliveryRecord) {
+	for {
+		select {
+		case r, ok := <-recordCh:
+			if !ok {
+				return
+			}
+			c.capture(ctx, r)
+		default:
+			return
+		}
+	}
+}
+
+func (c *s3Destination) Run(ctx context.Context, recordCh <-chan *DeliveryRecord) {
+	defer close(c.stopped)
+	conf := c.conf
+	c.holder = c.budget.register(c.deliveryName)
+	defer c.budget.unregister(c.holder)
 	c.reset()
-	ticker := time.NewTicker(conf.tickDuration)
+	c.ticker = newTicker(c.clock, conf.tickDuration)
+	defer c.ticker.Stop()
+	// batches spilled before restart are redelivered too.
+	var redeliveryC <-chan time.Time
+	if conf.spill != nil {
+		updateSpilledBatches(conf)
+		redelivery := newTicker(c.clock, c.retryConf.redeliveryInterval())
+		defer redelivery.Stop()
+		redeliveryC = redelivery.C()
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			log.Debug().Msgf("finish S3Destination in deliveryStream:%s", conf.deliveryName)
-			c.finalize(conf)
+			c.finalize()
 			return
 		case r, ok := <-recordCh:
 			if !ok {
 				log.Debug().Msgf("deliveryStream:%s is deleted", conf.deliveryName)
-				c.finalize(conf)
+				c.finalize()
 				return
 			}
-			c.captured = append(c.captured, r)
-			c.capturedSize += len(r.data)
-			log.Debug().Int("current", c.capturedSize).Int("limit", conf.bufferSize).Msgf("data captured. size: %d", len(r.data))
-			if c.injectedConf.DisableBuffering || c.capturedSize >= conf.bufferSize {
-				storeToS3(ctx, conf, time.Now(), c.captured)
-				c.reset()
-				ticker.Reset(conf.tickDuration)
+			c.capture(ctx, r)
+		case fn := <-c.ctrlCh:
+			// records accepted before the command should be handled by it.
+			c.drain(ctx, recordCh)
+			fn(ctx)
+		case <-c.ticker.C():
+			if c.paused {
+				continue
+			}
+			c.deliver(ctx)
+		case <-redeliveryC:
+			c.uploader.redeliver()
+		case <-c.holder.pressureC():
+			// memory shared by streams runs short, so buffer is delivered before BufferingHints.
+			// paused buffer is kept, since it is asked to hold records until resumed.
+			if c.paused || len(c.captured) == 0 {
+				continue
 			}
-		case <-ticker.C:
-			storeToS3(ctx, conf, time.Now(), c.captured)
-			c.reset()
+			log.Debug().Int("size", c.capturedSize).Msgf("early flush of deliveryStream:%s", conf.deliveryName)
+			c.metrics.observeEarlyFlush(conf.deliveryName)
+			c.flush(ctx)
 		}
 	}
 }
@@ -25,7 +25,7 @@ func TestS3DestinationForExceededDataSize(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	ch := make(chan *deliveryRecord, 128)
+	ch := make(chan *DeliveryRecord, 128)
 	dst := &s3Destination{
 		awsConf: awsConf,
 		injectedConf: S3InjectedConf{
@@ -41,11 +41,10 @@ func TestS3DestinationForExceededDataSize(t *testing.T) {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	conf, err := dst.Setup(ctx)
-	if err != nil {
+	if err := dst.Setup(ctx); err != nil {
 		t.Fatal(err)
 	}
-	go dst.Run(ctx, conf, ch)
+	go dst.Run(ctx, ch)
 
 	b, err := os.ReadFile(filepath.Join("testdata", "dummy.json"))
 	if err != nil {
@@ -55,7 +54,7 @@ func TestS3DestinationForExceededDataSize(t *testing.T) {
 	sent := 0
 	oneMB := 1 * 1024 * 1024
 	for sent < oneMB {
-		ch <- newDeliveryRecord(b)
+		ch <- NewDeliveryRecord(b)
 		sent += len(b)
 	}
 	var obj s3types.Object
@@ -100,7 +99,7 @@ func TestS3DestinationForExceededInterval(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	ch := make(chan *deliveryRecord, 128)
+	ch := make(chan *DeliveryRecord, 128)
 	dst := &s3Destination{
 		awsConf: awsConf,
 		injectedConf: S3InjectedConf{
@@ -116,11 +115,10 @@ func TestS3DestinationForExceededInterval(t *testing.T) {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	conf, err := dst.Setup(ctx)
-	if err != nil {
+	if err := dst.Setup(ctx); err != nil {
 		t.Fatal(err)
 	}
-	go dst.Run(ctx, conf, ch)
+	go dst.Run(ctx, ch)
 
 	b, err := os.ReadFile(filepath.Join("testdata", "dummy.json"))
 	if err != nil {
@@ -128,7 +126,7 @@ func TestS3DestinationForExceededInterval(t *testing.T) {
 	}
 	b = append(b, []byte("\n")...)
 	for i := 0; i < 3; i++ {
-		ch <- newDeliveryRecord(b)
+		ch <- NewDeliveryRecord(b)
 		time.Sleep(800 * time.Millisecond)
 	}
 	var objects []s3types.Object
@@ -179,7 +177,7 @@ func TestS3DestinationWithDisableBuffering(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	ch := make(chan *deliveryRecord, 128)
+	ch := make(chan *DeliveryRecord, 128)
 	dst := &s3Destination{
 		awsConf: awsConf,
 		injectedConf: S3InjectedConf{
@@ -192,11 +190,10 @@ func TestS3DestinationWithDisableBuffering(t *testing.T) {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	conf, err := dst.Setup(ctx)
-	if err != nil {
+	if err := dst.Setup(ctx); err != nil {
 		t.Fatal(err)
 	}
-	go dst.Run(ctx, conf, ch)
+	go dst.Run(ctx, ch)
 
 	b, err := os.ReadFile(filepath.Join("testdata", "dummy.json"))
 	if err != nil {
@@ -204,7 +201,7 @@ func TestS3DestinationWithDisableBuffering(t *testing.T) {
 	}
 	b = append(b, byte('\n'))
 	for i := 0; i < 5; i++ {
-		ch <- newDeliveryRecord(append(b, []byte(fmt.Sprint(i))...))
+		ch <- NewDeliveryRecord(append(b, []byte(fmt.Sprint(i))...))
 	}
 	var objects []s3types.Object
 	for i := 0; i < 20; i++ {
@@ -241,3 +238,20 @@ func TestS3DestinationWithDisableBuffering(t *testing.T) {
 		}
 	}
 }
+
+func TestS3DestinationPartSize(t *testing.T) {
+	for _, tt := range []struct {
+		sizeInMBs int
+		expected  int
+	}{
+		{sizeInMBs: 0, expected: defaultPartSize},
+		{sizeInMBs: 1, expected: minPartSize},
+		{sizeInMBs: 5, expected: minPartSize},
+		{sizeInMBs: 32, expected: 32 * 1024 * 1024},
+	} {
+		dst := &s3Destination{injectedConf: S3InjectedConf{MultipartPartSizeInMBs: tt.sizeInMBs}}
+		if size := dst.partSize(); size != tt.expected {
+			t.Errorf("%dMB: expected %d, got %d", tt.sizeInMBs, tt.expected, size)
+		}
+	}
+}
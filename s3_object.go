@@ -0,0 +1,202 @@
+package toyhose
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// defaultPartSize is the size of each part of multipart upload.
+	// objects up to this size are put at once.
+	defaultPartSize = 8 * 1024 * 1024
+	// minPartSize is the smallest size S3 accepts for parts but the last.
+	minPartSize = 5 * 1024 * 1024
+)
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns b to pool unless it has grown beyond twice partSize,
+// so that buffers grown by large objects do not stay in pool.
+func putBuffer(b *bytes.Buffer, partSize int) {
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	if b.Cap() > 2*partSize {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+var gzipPool = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// encodeRecords streams data of records into w, through gzip when compress is true.
+func encodeRecords(w io.Writer, records []*DeliveryRecord, compress bool) error {
+	if !compress {
+		for _, rec := range records {
+			if _, err := w.Write(rec.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	zw := gzipPool.Get().(*gzip.Writer)
+	defer gzipPool.Put(zw)
+	zw.Reset(w)
+	for _, rec := range records {
+		if _, err := zw.Write(rec.Data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// objectWriter uploads what is written to it as an object.
+// It holds at most one part in a pooled buffer: an object which fits in a part is put at once,
+// and a larger one is sent by multipart upload part by part.
+type objectWriter struct {
+	ctx       context.Context
+	cli       *s3.Client
+	bucket    string
+	key       string
+	partSize  int
+	retry     retryPolicy
+	deadline  time.Time
+	buf       *bytes.Buffer
+	uploadID  *string
+	parts     []s3types.CompletedPart
+	size      int
+	err       error
+	onAttempt func(err error)
+}
+
+// newObjectWriter returns objectWriter whose S3 commands are retried by retry until deadline,
+// which is shared by every command of the object.
+func newObjectWriter(ctx context.Context, conf s3StoreConfig, retry retryPolicy, deadline time.Time, key string, onAttempt func(err error)) *objectWriter {
+	partSize := conf.partSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	return &objectWriter{
+		ctx:       ctx,
+		cli:       conf.s3cli,
+		bucket:    conf.bucketName,
+		key:       key,
+		partSize:  partSize,
+		retry:     retry,
+		deadline:  deadline,
+		buf:       getBuffer(),
+		onAttempt: onAttempt,
+	}
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, _ := w.buf.Write(p)
+	w.size += n
+	if w.buf.Len() >= w.partSize {
+		w.err = w.uploadPart()
+	}
+	return n, w.err
+}
+
+func (w *objectWriter) uploadPart() error {
+	if w.uploadID == nil {
+		err := retryS3(w.ctx, w.deadline, w.retry, func(ctx context.Context) error {
+			out, err := w.cli.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+				Bucket: &w.bucket,
+				Key:    &w.key,
+			})
+			if err == nil {
+				w.uploadID = out.UploadId
+			}
+			return err
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	partNumber := int32(len(w.parts) + 1)
+	body := w.buf.Bytes()
+	err := retryS3(w.ctx, w.deadline, w.retry, func(ctx context.Context) error {
+		out, err := w.cli.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     &w.bucket,
+			Key:        &w.key,
+			UploadId:   w.uploadID,
+			PartNumber: &partNumber,
+			Body:       bytes.NewReader(body),
+		})
+		if err == nil {
+			w.parts = append(w.parts, s3types.CompletedPart{ETag: out.ETag, PartNumber: &partNumber})
+		}
+		return err
+	}, nil)
+	w.buf.Reset()
+	return err
+}
+
+// Close finishes the object and returns its size.
+// Multipart upload is aborted on failure, so that no part is left in the bucket.
+func (w *objectWriter) Close() (int, error) {
+	defer putBuffer(w.buf, w.partSize)
+	if w.err == nil {
+		w.err = w.finish()
+	}
+	if w.err != nil && w.uploadID != nil {
+		_, _ = w.cli.AbortMultipartUpload(context.WithoutCancel(w.ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   &w.bucket,
+			Key:      &w.key,
+			UploadId: w.uploadID,
+		})
+	}
+	return w.size, w.err
+}
+
+func (w *objectWriter) finish() error {
+	if w.uploadID == nil {
+		body := w.buf.Bytes()
+		return retryS3(w.ctx, w.deadline, w.retry, func(ctx context.Context) error {
+			_, err := w.cli.PutObject(ctx, &s3.PutObjectInput{
+				Bucket: &w.bucket,
+				Key:    &w.key,
+				Body:   bytes.NewReader(body),
+			})
+			return err
+		}, w.onAttempt)
+	}
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(); err != nil {
+			return err
+		}
+	}
+	return retryS3(w.ctx, w.deadline, w.retry, func(ctx context.Context) error {
+		_, err := w.cli.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          &w.bucket,
+			Key:             &w.key,
+			UploadId:        w.uploadID,
+			MultipartUpload: &s3types.CompletedMultipartUpload{Parts: w.parts},
+		})
+		return err
+	}, w.onAttempt)
+}
@@ -0,0 +1,294 @@
+package toyhose
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// multipartS3 is a fake S3 which supports PutObject and multipart upload.
+type multipartS3 struct {
+	mutex     sync.Mutex
+	objects   map[string][]byte
+	parts     map[string]map[int][]byte
+	aborted   int
+	failParts bool
+	discard   bool
+}
+
+func newMultipartS3() *multipartS3 {
+	return &multipartS3{
+		objects: map[string][]byte{},
+		parts:   map[string]map[int][]byte{},
+	}
+}
+
+func (s *multipartS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	q := r.URL.Query()
+	uploadID := q.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		uploadID = strconv.Itoa(len(s.parts) + 1)
+		s.parts[uploadID] = map[int][]byte{}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, uploadID)
+	case r.Method == http.MethodPut && uploadID != "":
+		if s.failParts {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>AccessDenied</Code></Error>`)
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		body, _ := io.ReadAll(r.Body)
+		if s.discard {
+			body = nil
+		}
+		s.parts[uploadID][n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, uploadID, n))
+	case r.Method == http.MethodPost && uploadID != "":
+		parts := s.parts[uploadID]
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var body []byte
+		for _, n := range numbers {
+			body = append(body, parts[n]...)
+		}
+		s.objects[r.URL.Path] = body
+		delete(s.parts, uploadID)
+		fmt.Fprint(w, `<CompleteMultipartUploadResult></CompleteMultipartUploadResult>`)
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(s.parts, uploadID)
+		s.aborted++
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		if s.discard {
+			body = nil
+		}
+		s.objects[r.URL.Path] = body
+	}
+}
+
+func (s *multipartS3) object(t *testing.T) []byte {
+	t.Helper()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.objects) != 1 {
+		t.Fatalf("unexpected objects: %d", len(s.objects))
+	}
+	for _, body := range s.objects {
+		return body
+	}
+	return nil
+}
+
+func testRecords(count, size int) []*DeliveryRecord {
+	records := make([]*DeliveryRecord, 0, count)
+	for i := 0; i < count; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i%26)}, size-1)
+		records = append(records, NewDeliveryRecord(append(data, '\n')))
+	}
+	return records
+}
+
+func joinRecords(records []*DeliveryRecord) string {
+	var sb strings.Builder
+	for _, rec := range records {
+		sb.Write(rec.Data)
+	}
+	return sb.String()
+}
+
+func TestStoreToS3Multipart(t *testing.T) {
+	ctx := context.Background()
+	awsConf := awsConfig(t)
+	newConf := func(t *testing.T, fake *multipartS3, compress bool) s3StoreConfig {
+		t.Helper()
+		srv := httptest.NewServer(fake)
+		t.Cleanup(srv.Close)
+		return s3StoreConfig{
+			deliveryName:       "multipart",
+			bucketName:         "multipart-bucket",
+			shouldGZipCompress: compress,
+			s3cli:              s3Client(awsConf, srv.URL),
+			partSize:           1024,
+			ledger:             newLedger(0),
+		}
+	}
+
+	t.Run("small object is put at once", func(t *testing.T) {
+		fake := newMultipartS3()
+		records := testRecords(3, 100)
+		storeToS3(ctx, newConf(t, fake, false), time.Now(), records)
+		if body := fake.object(t); string(body) != joinRecords(records) {
+			t.Errorf("unexpected body: %s", body)
+		}
+		if len(fake.parts) != 0 {
+			t.Errorf("multipart upload is used: %v", fake.parts)
+		}
+	})
+
+	t.Run("large object is uploaded in parts", func(t *testing.T) {
+		fake := newMultipartS3()
+		records := testRecords(50, 100)
+		conf := newConf(t, fake, false)
+		storeToS3(ctx, conf, time.Now(), records)
+		if body := fake.object(t); string(body) != joinRecords(records) {
+			t.Errorf("unexpected body: %d bytes", len(body))
+		}
+		e, ok := conf.ledger.Find(records[49].ID)
+		if !ok || e.State != RecordStateDelivered || e.Offset != 4900 {
+			t.Errorf("unexpected ledger entry: %#v", e)
+		}
+	})
+
+	t.Run("compressed parts", func(t *testing.T) {
+		fake := newMultipartS3()
+		// random data does not shrink by compression, so that it spans parts.
+		rnd := rand.New(rand.NewSource(1))
+		records := make([]*DeliveryRecord, 0, 10)
+		for i := 0; i < 10; i++ {
+			data := make([]byte, 1000)
+			rnd.Read(data)
+			records = append(records, NewDeliveryRecord(data))
+		}
+		storeToS3(ctx, newConf(t, fake, true), time.Now(), records)
+		zr, err := gzip.NewReader(bytes.NewReader(fake.object(t)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != joinRecords(records) {
+			t.Errorf("unexpected body: %d bytes", len(body))
+		}
+	})
+
+	t.Run("failed upload is aborted", func(t *testing.T) {
+		fake := newMultipartS3()
+		fake.failParts = true
+		records := testRecords(50, 100)
+		conf := newConf(t, fake, false)
+		conf.retry = retryPolicy{duration: 10 * time.Millisecond, initialBackoff: time.Millisecond, maxBackoff: time.Millisecond}
+		checkpoints := newCheckpointer(nil, "multipart", &kinesisCheckpoint{Shards: map[string]string{}})
+		for i, rec := range records {
+			rec.source = checkpoints.read("shard-0", strconv.Itoa(i))
+		}
+		storeToS3(ctx, conf, time.Now(), records)
+		if fake.aborted != 1 || len(fake.objects) != 0 {
+			t.Errorf("upload is not aborted: aborted=%d, objects=%d", fake.aborted, len(fake.objects))
+		}
+		if e, _ := conf.ledger.Find(records[0].ID); e.State != RecordStateFailed {
+			t.Errorf("unexpected ledger entry: %#v", e)
+		}
+		if p := checkpoints.shards["shard-0"]; p.dropped == nil || *p.dropped != 0 {
+			t.Error("source of dropped records is not told")
+		}
+	})
+}
+
+// concatRecords is how objects were assembled before streaming: whole data is copied,
+// then compressed into another buffer.
+func concatRecords(records []*DeliveryRecord, compress bool) []byte {
+	data := make([]byte, 0, 1024*1024)
+	for _, rec := range records {
+		data = append(data, rec.Data...)
+	}
+	if !compress {
+		return data
+	}
+	b := bytes.NewBuffer([]byte{})
+	w := gzip.NewWriter(b)
+	_, _ = w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+func reportPerRecord(b *testing.B, records int) {
+	b.ReportMetric(float64(b.N*records)/b.Elapsed().Seconds(), "records/s")
+}
+
+func BenchmarkEncodeRecords(b *testing.B) {
+	for _, count := range []int{1000, 10000} {
+		records := testRecords(count, 512)
+		size := int64(len(joinRecords(records)))
+		for _, compress := range []bool{false, true} {
+			name := fmt.Sprintf("records=%d/gzip=%t", count, compress)
+			b.Run("concat/"+name, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(size)
+				for i := 0; i < b.N; i++ {
+					_ = concatRecords(records, compress)
+				}
+				reportPerRecord(b, count)
+			})
+			b.Run("stream/"+name, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(size)
+				for i := 0; i < b.N; i++ {
+					buf := getBuffer()
+					_ = encodeRecords(buf, records, compress)
+					putBuffer(buf, defaultPartSize)
+				}
+				reportPerRecord(b, count)
+			})
+		}
+	}
+}
+
+func BenchmarkStoreToS3(b *testing.B) {
+	// records span two parts of each size.
+	records := testRecords(20000, 512)
+	size := int64(len(joinRecords(records)))
+	b.Run("memory", func(b *testing.B) {
+		conf := s3StoreConfig{
+			deliveryName:       "bench",
+			bucketName:         "bench-bucket",
+			shouldGZipCompress: true,
+			memory:             newMemoryStore(),
+		}
+		b.ReportAllocs()
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			storeToS3(context.Background(), conf, time.Now(), records)
+			conf.memory.ClearAll()
+		}
+		reportPerRecord(b, len(records))
+	})
+	for _, partSize := range []int{defaultPartSize, minPartSize} {
+		b.Run(fmt.Sprintf("s3/partSize=%d", partSize), func(b *testing.B) {
+			fake := newMultipartS3()
+			fake.discard = true
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+			conf := s3StoreConfig{
+				deliveryName: "bench",
+				bucketName:   "bench-bucket",
+				s3cli:        s3Client(awsConfig(b), srv.URL),
+				partSize:     partSize,
+			}
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				storeToS3(context.Background(), conf, time.Now(), records)
+			}
+			reportPerRecord(b, len(records))
+		})
+	}
+}
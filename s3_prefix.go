@@ -3,10 +3,8 @@ package toyhose
 import (
 	"fmt"
 	"regexp"
-	"strings"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/vjeantet/jodaTime"
 )
 
@@ -23,11 +21,11 @@ var (
 	fhTimeStampRE     = regexp.MustCompile("\\!\\{timestamp:(.+?)\\}")
 )
 
-func extractNamespace(b []byte, ts time.Time) ([]byte, bool) {
+func extractNamespace(b []byte, ts time.Time, ids IDGenerator) ([]byte, bool) {
 	processed := false
 	if fhRandStrRE.Match(b) {
 		b = fhRandStrRE.ReplaceAllFunc(b, func(s []byte) []byte {
-			return []byte(strings.ReplaceAll(uuid.New().String(), "-", "")[:11])
+			return []byte(randomString(ids))
 		})
 		processed = true
 	}
@@ -41,18 +39,18 @@ func extractNamespace(b []byte, ts time.Time) ([]byte, bool) {
 	return b, processed
 }
 
-func keyPrefix(pref string, ts time.Time) string {
+func keyPrefix(pref string, ts time.Time, ids IDGenerator) string {
 	if pref == "" {
 		return ts.Format("2006/01/02/15/")
 	}
-	b, processed := extractNamespace([]byte(pref), ts)
+	b, processed := extractNamespace([]byte(pref), ts, ids)
 	if processed {
 		return string(b)
 	}
 	return fmt.Sprintf("%s/%s", string(b), ts.Format("2006/01/02/15/"))
 }
 
-func keyErrPrefix(pref string, ts time.Time, errType firehoseErrorType) string {
+func keyErrPrefix(pref string, ts time.Time, errType firehoseErrorType, ids IDGenerator) string {
 	if pref == "" {
 		return ""
 	}
@@ -60,6 +58,6 @@ func keyErrPrefix(pref string, ts time.Time, errType firehoseErrorType) string {
 	if fhErrOutputTypeRE.Match(b) {
 		b = fhErrOutputTypeRE.ReplaceAll(b, []byte(errType))
 	}
-	b, _ = extractNamespace(b, ts)
+	b, _ = extractNamespace(b, ts, ids)
 	return string(b)
 }
@@ -54,8 +54,8 @@ func TestS3Prefix(t *testing.T) {
 		},
 	} {
 		t.Run(tt.label, func(t *testing.T) {
-			pref := keyPrefix(tt.prefix, ts)
-			errPref := keyErrPrefix(tt.errPrefix, ts, processingFailed)
+			pref := keyPrefix(tt.prefix, ts, randomIDGenerator{})
+			errPref := keyErrPrefix(tt.errPrefix, ts, processingFailed, randomIDGenerator{})
 			if m, _ := regexp.Match(tt.expected[0], []byte(pref)); !m {
 				t.Errorf("wrong prefix captured. expected:%s, actual:%s", tt.expected[0], pref)
 			}
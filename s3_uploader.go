@@ -0,0 +1,142 @@
+package toyhose
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultUploadConcurrency is the number of uploads which run at once in each stream.
+const defaultUploadConcurrency = 4
+
+// s3Uploader runs storeToS3 apart from the buffering loop of s3Destination with bounded concurrency,
+// and tracks uploads in flight so that they can be waited.
+// in-memory delivery has nothing to wait for, so it runs inline and keeps delivery order.
+type s3Uploader struct {
+	conf    s3StoreConfig
+	sem     chan struct{}
+	ctx     context.Context
+	abort   context.CancelFunc
+	mutex   sync.Mutex
+	pending map[chan struct{}]struct{}
+	// queued is the number of pending uploads which wait for a slot.
+	queued       int
+	redelivering atomic.Bool
+}
+
+func newS3Uploader(conf s3StoreConfig, concurrency int) *s3Uploader {
+	if concurrency <= 0 {
+		concurrency = defaultUploadConcurrency
+	}
+	// uploads outlive the buffering loop, because deleted stream still delivers what it has accepted,
+	// until abort cuts them short.
+	ctx, abort := context.WithCancel(context.Background())
+	return &s3Uploader{
+		conf:    conf,
+		sem:     make(chan struct{}, concurrency),
+		ctx:     ctx,
+		abort:   abort,
+		pending: map[chan struct{}]struct{}{},
+	}
+}
+
+// upload starts delivering records. It never blocks: while every slot is busy, the batch waits
+// for a slot in the background, so that buffering loop keeps serving commands and its ticker.
+// Waiting batches stay charged to memoryBudget, which throttles puts when they pile up.
+func (u *s3Uploader) upload(ts time.Time, records []*DeliveryRecord) {
+	if len(records) == 0 {
+		return
+	}
+	size := 0
+	for _, rec := range records {
+		size += len(rec.Data)
+	}
+	ctx := u.ctx
+	if u.conf.memory != nil {
+		storeToS3(ctx, u.conf, ts, records)
+		u.conf.budget.release(size)
+		return
+	}
+	done := u.track()
+	u.mutex.Lock()
+	u.queued++
+	u.mutex.Unlock()
+	go func() {
+		defer func() {
+			u.conf.budget.release(size)
+			u.untrack(done)
+		}()
+		select {
+		case u.sem <- struct{}{}:
+			defer func() { <-u.sem }()
+		case <-ctx.Done():
+			// aborted batch does not need a slot, since it is spilled or dropped at once.
+		}
+		u.mutex.Lock()
+		u.queued--
+		u.mutex.Unlock()
+		storeToS3(ctx, u.conf, ts, records)
+	}()
+}
+
+// redeliver starts redelivery of spilled batches unless the previous round is still running.
+func (u *s3Uploader) redeliver() {
+	if u.conf.spill == nil || !u.redelivering.CompareAndSwap(false, true) {
+		return
+	}
+	ctx := u.ctx
+	if u.conf.memory != nil {
+		defer u.redelivering.Store(false)
+		redeliver(ctx, u.conf)
+		return
+	}
+	done := u.track()
+	go func() {
+		defer func() {
+			u.redelivering.Store(false)
+			u.untrack(done)
+		}()
+		redeliver(ctx, u.conf)
+	}()
+}
+
+func (u *s3Uploader) track() chan struct{} {
+	done := make(chan struct{})
+	u.mutex.Lock()
+	u.pending[done] = struct{}{}
+	u.mutex.Unlock()
+	return done
+}
+
+func (u *s3Uploader) untrack(done chan struct{}) {
+	u.mutex.Lock()
+	delete(u.pending, done)
+	u.mutex.Unlock()
+	close(done)
+}
+
+// inFlight returns the number of running uploads, excluding ones waiting for a slot.
+func (u *s3Uploader) inFlight() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return len(u.pending) - u.queued
+}
+
+// wait blocks until uploads started so far finish.
+func (u *s3Uploader) wait(ctx context.Context) error {
+	u.mutex.Lock()
+	pending := make([]chan struct{}, 0, len(u.pending))
+	for done := range u.pending {
+		pending = append(pending, done)
+	}
+	u.mutex.Unlock()
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// slowS3 accepts HeadBucket at once and holds PutObject until gate is closed.
+type slowS3 struct {
+	gate     chan struct{}
+	started  chan string
+	mutex    sync.Mutex
+	received map[string]string
+}
+
+func (s *slowS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	s.started <- r.URL.Path
+	<-s.gate
+	s.mutex.Lock()
+	s.received[r.URL.Path] = string(body)
+	s.mutex.Unlock()
+}
+
+func TestS3Uploader(t *testing.T) {
+	ctx := context.Background()
+	fake := &slowS3{
+		gate:     make(chan struct{}),
+		started:  make(chan string, 10),
+		received: map[string]string{},
+	}
+	s3srv := httptest.NewServer(fake)
+	defer s3srv.Close()
+
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		S3InjectedConf: S3InjectedConf{
+			EndPoint:          aws.String(s3srv.URL),
+			DisableBuffering:  true,
+			UploadConcurrency: 2,
+		},
+	})
+	svc := d.Service()
+	streamName := "uploader-stream"
+	if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+			BucketARN: aws.String("arn:aws:s3:::uploader-bucket"),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"first!", "second!"} {
+		if _, err := svc.Put(ctx, &firehose.PutRecordInput{
+			DeliveryStreamName: &streamName,
+			Record:             &fhtypes.Record{Data: []byte(data)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-fake.started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("uploads are not started concurrently")
+		}
+	}
+
+	t.Run("buffer keeps working during uploads", func(t *testing.T) {
+		if err := d.Pause(ctx, streamName); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := svc.Put(ctx, &firehose.PutRecordInput{
+			DeliveryStreamName: &streamName,
+			Record:             &fhtypes.Record{Data: []byte("third!")},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		st, err := d.BufferStatus(ctx, streamName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.UploadsInFlight != 2 || st.Records != 1 {
+			t.Errorf("unexpected buffer status: %#v", st)
+		}
+	})
+
+	t.Run("loop serves commands while every slot is busy", func(t *testing.T) {
+		cmdCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		// the third record is delivered, and its upload waits for a slot.
+		if err := d.Resume(cmdCtx, streamName); err != nil {
+			t.Fatal(err)
+		}
+		st, err := d.BufferStatus(cmdCtx, streamName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.UploadsInFlight != 2 || st.Records != 0 {
+			t.Errorf("unexpected buffer status: %#v", st)
+		}
+	})
+
+	t.Run("delete waits for uploads", func(t *testing.T) {
+		deleted := make(chan error)
+		go func() {
+			_, err := svc.Delete(ctx, &firehose.DeleteDeliveryStreamInput{DeliveryStreamName: &streamName})
+			deleted <- err
+		}()
+		select {
+		case err := <-deleted:
+			t.Fatalf("delete returned during uploads: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		close(fake.gate)
+		select {
+		case err := <-deleted:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("delete does not return")
+		}
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		bodies := map[string]bool{}
+		for _, b := range fake.received {
+			bodies[b] = true
+		}
+		if len(bodies) != 3 || !bodies["first!"] || !bodies["second!"] || !bodies["third!"] {
+			t.Errorf("unexpected objects: %v", fake.received)
+		}
+	})
+}
+
+func TestDeleteWhileS3IsDown(t *testing.T) {
+	ctx := context.Background()
+	fake := &flakyS3{failing: true, received: map[string]string{}}
+	s3srv := httptest.NewServer(fake)
+	defer s3srv.Close()
+	spillDir := t.TempDir()
+
+	// the retry duration is the default 24 hours.
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		S3InjectedConf: S3InjectedConf{
+			EndPoint: aws.String(s3srv.URL),
+		},
+		RetryConf: RetryConf{
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     10 * time.Millisecond,
+			SpillDir:       spillDir,
+		},
+	})
+	svc := d.Service()
+	streamName := "down-stream"
+	if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+			BucketARN: aws.String("arn:aws:s3:::down-bucket"),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Put(ctx, &firehose.PutRecordInput{
+		DeliveryStreamName: &streamName,
+		Record:             &fhtypes.Record{Data: []byte("undeliverable!")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	deleteCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if _, err := svc.Delete(deleteCtx, &firehose.DeleteDeliveryStreamInput{DeliveryStreamName: &streamName}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("delete is not bounded by its context: %s", elapsed)
+	}
+	files, _ := filepath.Glob(filepath.Join(spillDir, streamName, "*.json"))
+	if len(files) != 1 {
+		t.Errorf("undelivered batch is not spilled: %v", files)
+	}
+	_, err := svc.Delete(ctx, &firehose.DeleteDeliveryStreamInput{DeliveryStreamName: &streamName})
+	var notFound *fhtypes.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ShutdownResult reports how a deliveryStream finished in Dispatcher.Shutdown.
+type ShutdownResult struct {
+	DeliveryStreamName string
+	// Err is non-nil when records accepted by the stream may be left undelivered.
+	Err error
+}
+
+// Shutdown refuses new deliveryStreams and puts, stops Kinesis consumers, and then delivers
+// records accepted so far in every deliveryStream, waiting for destinations until ctx is done.
+// Then deliveries in progress are aborted, and their batches are spilled or dropped.
+// Streams are shut down concurrently and removed from the Dispatcher.
+// Results are sorted by deliveryStream name, and the error joins errors of every result.
+func (d *Dispatcher) Shutdown(ctx context.Context) ([]ShutdownResult, error) {
+	d.svc.shuttingDown.Store(true)
+	streams := d.pool.close()
+	results := make([]ShutdownResult, len(streams))
+	wg := &sync.WaitGroup{}
+	for i, ds := range streams {
+		results[i].DeliveryStreamName = ds.deliveryStreamName
+		if d.pool.Delete(ds.arn) == nil {
+			// deleted by someone else in the meantime.
+			continue
+		}
+		wg.Add(1)
+		go func(i int, ds *deliveryStream) {
+			defer wg.Done()
+			results[i].Err = ds.shutdown(ctx)
+		}(i, ds)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].DeliveryStreamName < results[j].DeliveryStreamName
+	})
+	errs := make([]error, 0, len(results))
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("failed to shut down %s: %w", r.DeliveryStreamName, r.Err))
+		}
+	}
+	return results, errors.Join(errs...)
+}
@@ -0,0 +1,154 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// endlessSource sends records until ctx is done, counting what destination has received.
+type endlessSource struct {
+	sent atomic.Int64
+}
+
+func (s *endlessSource) Run(ctx context.Context, recordCh chan<- *DeliveryRecord) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case recordCh <- NewDeliveryRecord([]byte("endless\n")):
+			s.sent.Add(1)
+		}
+	}
+}
+
+func (s *endlessSource) Description() fhtypes.SourceDescription {
+	return fhtypes.SourceDescription{}
+}
+
+func TestShutdown(t *testing.T) {
+	ctx := context.Background()
+	src := &endlessSource{}
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		S3InjectedConf: S3InjectedConf{
+			InMemory: true,
+		},
+		Sources: map[fhtypes.DeliveryStreamType]SourceFactory{
+			fhtypes.DeliveryStreamTypeMSKAsSource: func(ctx context.Context, i *firehose.CreateDeliveryStreamInput) (Source, error) {
+				return src, nil
+			},
+		},
+	})
+	svc := d.Service()
+	for _, in := range []*firehose.CreateDeliveryStreamInput{
+		{DeliveryStreamName: aws.String("shutdown-put")},
+		{DeliveryStreamName: aws.String("shutdown-source"), DeliveryStreamType: fhtypes.DeliveryStreamTypeMSKAsSource},
+	} {
+		in.S3DestinationConfiguration = &fhtypes.S3DestinationConfiguration{
+			BucketARN: aws.String("arn:aws:s3:::shutdown-bucket"),
+		}
+		if _, err := svc.Create(ctx, in); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := svc.PutBatch(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String("shutdown-put"),
+		Records: []fhtypes.Record{
+			{Data: []byte("hello!\n")},
+			{Data: []byte("world!\n")},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for src.sent.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	sdCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	results, err := d.Shutdown(sdCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].DeliveryStreamName != "shutdown-put" || results[1].DeliveryStreamName != "shutdown-source" {
+		t.Errorf("unexpected results: %#v", results)
+	}
+
+	t.Run("buffered records are delivered", func(t *testing.T) {
+		deliveries := d.Deliveries("shutdown-put")
+		if len(deliveries) != 1 || string(deliveries[0].Body) != "hello!\nworld!\n" {
+			t.Errorf("unexpected deliveries: %#v", deliveries)
+		}
+	})
+
+	t.Run("records read by source are delivered", func(t *testing.T) {
+		received := 0
+		for _, dl := range d.Deliveries("shutdown-source") {
+			received += len(dl.RecordIDs)
+		}
+		if sent := src.sent.Load(); int64(received) != sent {
+			t.Errorf("unexpected records: sent=%d, delivered=%d", sent, received)
+		}
+	})
+
+	t.Run("new streams are refused", func(t *testing.T) {
+		_, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+			DeliveryStreamName: aws.String("shutdown-late"),
+			S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+				BucketARN: aws.String("arn:aws:s3:::shutdown-bucket"),
+			},
+		})
+		var unavailable *fhtypes.ServiceUnavailableException
+		if !errors.As(err, &unavailable) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		// a Create which passed the check before Shutdown started can not add its stream either.
+		if err := d.pool.Add(&deliveryStream{arn: "late", deliveryStreamName: "late"}); !errors.As(err, &unavailable) {
+			t.Errorf("stream is added after shutdown: %v", err)
+		}
+	})
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	ctx := context.Background()
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		Destinations: map[DestinationType]DestinationFactory{
+			DestinationTypeHTTPEndpoint: func(ctx context.Context, i *firehose.CreateDeliveryStreamInput) (Destination, error) {
+				return &gatedDestination{gate: make(chan struct{})}, nil
+			},
+		},
+	})
+	svc := d.Service()
+	streamName := "stuck-stream"
+	if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		HttpEndpointDestinationConfiguration: &fhtypes.HttpEndpointDestinationConfiguration{
+			EndpointConfiguration: &fhtypes.HttpEndpointConfiguration{Url: aws.String("http://localhost")},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Put(ctx, &firehose.PutRecordInput{
+		DeliveryStreamName: &streamName,
+		Record:             &fhtypes.Record{Data: []byte("stuck!")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sdCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	results, err := d.Shutdown(sdCtx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(results) != 1 || !errors.Is(results[0].Err, context.DeadlineExceeded) {
+		t.Errorf("unexpected results: %#v", results)
+	}
+}
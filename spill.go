@@ -0,0 +1,166 @@
+package toyhose
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// spilledBatch is a batch which is not delivered within retry duration, kept as a file until redelivery.
+type spilledBatch struct {
+	DeliveryStreamName string          `json:"deliveryStreamName"`
+	Bucket             string          `json:"bucket"`
+	Key                string          `json:"key"`
+	Timestamp          time.Time       `json:"timestamp"`
+	Error              string          `json:"error"`
+	Records            []spilledRecord `json:"records"`
+}
+
+type spilledRecord struct {
+	ID        string    `json:"id"`
+	Data      []byte    `json:"data"`
+	ArrivedAt time.Time `json:"arrivedAt"`
+}
+
+func (b spilledBatch) deliveryRecords() []*DeliveryRecord {
+	records := make([]*DeliveryRecord, 0, len(b.Records))
+	for _, r := range b.Records {
+		records = append(records, &DeliveryRecord{ID: r.ID, Data: r.Data, ArrivedAt: r.ArrivedAt})
+	}
+	return records
+}
+
+// spillStore keeps spilled batches under dir, a directory per stream and a JSON file per batch.
+type spillStore struct {
+	dir string
+}
+
+// newSpillStore returns nil when dir is empty, which means undeliverable batches are dropped.
+func newSpillStore(dir string) *spillStore {
+	if dir == "" {
+		return nil
+	}
+	return &spillStore{dir: dir}
+}
+
+func (s *spillStore) streamDir(streamName string) string {
+	return filepath.Join(s.dir, streamName)
+}
+
+// write stores b atomically, so that redelivery never reads a partial file.
+func (s *spillStore) write(b spilledBatch) error {
+	dir := s.streamDir(b.DeliveryStreamName)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	// base of key ends with unique ID and sorts by timestamp.
+	name := filepath.Join(dir, path.Base(b.Key)+".json")
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// list returns files of spilled batches of streamName, oldest first.
+func (s *spillStore) list(streamName string) ([]string, error) {
+	entries, err := os.ReadDir(s.streamDir(streamName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		files = append(files, filepath.Join(s.streamDir(streamName), e.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s *spillStore) read(file string) (spilledBatch, error) {
+	var b spilledBatch
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return b, err
+	}
+	if err := json.Unmarshal(data, &b); err != nil {
+		return b, fmt.Errorf("broken spilled batch %s: %w", file, err)
+	}
+	return b, nil
+}
+
+// spill keeps records which failed to be delivered as key.
+func spill(conf s3StoreConfig, key string, ts time.Time, records []*DeliveryRecord, cause error) error {
+	b := spilledBatch{
+		DeliveryStreamName: conf.deliveryName,
+		Bucket:             conf.bucketName,
+		Key:                key,
+		Timestamp:          ts,
+		Error:              cause.Error(),
+		Records:            make([]spilledRecord, 0, len(records)),
+	}
+	for _, rec := range records {
+		b.Records = append(b.Records, spilledRecord{ID: rec.ID, Data: rec.Data, ArrivedAt: rec.ArrivedAt})
+	}
+	if err := conf.spill.write(b); err != nil {
+		return err
+	}
+	updateSpilledBatches(conf)
+	return nil
+}
+
+func updateSpilledBatches(conf s3StoreConfig) {
+	files, err := conf.spill.list(conf.deliveryName)
+	if err != nil {
+		log.Error().Err(err).Str("delivery_stream", conf.deliveryName).Msg("failed to list spilled batches")
+		return
+	}
+	conf.metrics.setSpilledBatches(conf.deliveryName, len(files))
+}
+
+// redeliver uploads spilled batches of the stream, oldest first, trying each once.
+// It stops at the first failure, since S3 has not recovered yet.
+func redeliver(ctx context.Context, conf s3StoreConfig) {
+	files, err := conf.spill.list(conf.deliveryName)
+	if err != nil {
+		log.Error().Err(err).Str("delivery_stream", conf.deliveryName).Msg("failed to list spilled batches")
+		return
+	}
+	if len(files) == 0 {
+		return
+	}
+	defer updateSpilledBatches(conf)
+	for _, file := range files {
+		b, err := conf.spill.read(file)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to read spilled batch")
+			continue
+		}
+		batchConf := conf
+		batchConf.bucketName = b.Bucket
+		if err := putBatch(ctx, batchConf, retryPolicy{}, b.Key, b.Timestamp, b.deliveryRecords()); err != nil {
+			log.Debug().Err(err).Str("key", b.Key).Msg("redelivery failed")
+			return
+		}
+		if err := os.Remove(file); err != nil {
+			log.Error().Err(err).Str("file", file).Msg("failed to remove redelivered batch")
+		}
+		conf.metrics.observeRedelivered(conf.deliveryName)
+		log.Info().Str("key", b.Key).Int("records", len(b.Records)).Msg("spilled batch is redelivered")
+	}
+}
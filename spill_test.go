@@ -0,0 +1,157 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// flakyS3 rejects PutObject while failing is true.
+type flakyS3 struct {
+	mutex    sync.Mutex
+	failing  bool
+	received map[string]string
+}
+
+func (s *flakyS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failing {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<Error><Code>AccessDenied</Code></Error>`)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	s.received[r.URL.Path] = string(body)
+}
+
+func (s *flakyS3) setFailing(failing bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failing = failing
+}
+
+func TestSpillAndRedelivery(t *testing.T) {
+	ctx := context.Background()
+	fake := &flakyS3{failing: true, received: map[string]string{}}
+	s3srv := httptest.NewServer(fake)
+	defer s3srv.Close()
+	spillDir := t.TempDir()
+
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		S3InjectedConf: S3InjectedConf{
+			EndPoint: aws.String(s3srv.URL),
+		},
+		RetryConf: RetryConf{
+			Duration:           10 * time.Millisecond,
+			InitialBackoff:     time.Millisecond,
+			MaxBackoff:         time.Millisecond,
+			SpillDir:           spillDir,
+			RedeliveryInterval: 10 * time.Millisecond,
+		},
+	})
+	svc := d.Service()
+	streamName := "spill-stream"
+	if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+			BucketARN: aws.String("arn:aws:s3:::spill-bucket"),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := svc.Put(ctx, &firehose.PutRecordInput{
+		DeliveryStreamName: &streamName,
+		Record:             &fhtypes.Record{Data: []byte("spilled!")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := func(name string) string {
+		rec := httptest.NewRecorder()
+		d.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if strings.HasPrefix(line, name+"{") {
+				return line[strings.LastIndex(line, " ")+1:]
+			}
+		}
+		return ""
+	}
+
+	t.Run("undeliverable batch is spilled", func(t *testing.T) {
+		flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := d.Flush(flushCtx, streamName); err != nil {
+			t.Fatal(err)
+		}
+		e, _ := d.LookupRecord(*out.RecordId)
+		if e.State != RecordStateSpilled || e.Key == "" || !strings.Contains(e.Error, "AccessDenied") {
+			t.Errorf("unexpected ledger entry: %#v", e)
+		}
+		files, _ := filepath.Glob(filepath.Join(spillDir, streamName, "*.json"))
+		if len(files) != 1 {
+			t.Errorf("unexpected spilled files: %v", files)
+		}
+		if v := metric("firehose_spilled_batches"); v != "1" {
+			t.Errorf("unexpected spilled batches: %s", v)
+		}
+	})
+
+	t.Run("spilled batch is redelivered after S3 recovers", func(t *testing.T) {
+		fake.setFailing(false)
+		// the ledger is updated before the spilled file is removed and counted.
+		redelivered := func() bool {
+			e, _ := d.LookupRecord(*out.RecordId)
+			entries, _ := os.ReadDir(filepath.Join(spillDir, streamName))
+			return e.State == RecordStateDelivered && len(entries) == 0 && metric("firehose_redelivered_batches_total") == "1"
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if redelivered() {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("spilled batch is not redelivered")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		e, _ := d.LookupRecord(*out.RecordId)
+		fake.mutex.Lock()
+		body := fake.received["/spill-bucket/"+e.Key]
+		fake.mutex.Unlock()
+		if body != "spilled!" {
+			t.Errorf("unexpected object: %q", body)
+		}
+	})
+	t.Run("stream name can not escape spill directory", func(t *testing.T) {
+		for _, name := range []string{"../escaped", "nested/stream", ".."} {
+			_, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+				DeliveryStreamName: aws.String(name),
+				S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+					BucketARN: aws.String("arn:aws:s3:::spill-bucket"),
+				},
+			})
+			var invalidArg *fhtypes.InvalidArgumentException
+			if !errors.As(err, &invalidArg) {
+				t.Errorf("unexpected error for %q: %v", name, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package toyhose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// TestStreamLifecycleStress races every operation against a few streams.
+// Run it with -race: it passes when nothing panics, deadlocks or races,
+// and every failure is one the API documents for a stream which comes and goes.
+func TestStreamLifecycleStress(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		S3InjectedConf: S3InjectedConf{
+			InMemory:         true,
+			DisableBuffering: true,
+		},
+		IngestConf: IngestConf{
+			MaxBufferedRecordsPerStream: 16,
+		},
+		Sources: map[fhtypes.DeliveryStreamType]SourceFactory{
+			fhtypes.DeliveryStreamTypeMSKAsSource: func(ctx context.Context, i *firehose.CreateDeliveryStreamInput) (Source, error) {
+				return &endlessSource{}, nil
+			},
+		},
+	})
+	svc := d.Service()
+	names := []string{"stress-0", "stress-1", "stress-2"}
+	ops := map[string]func(rnd *rand.Rand, name string) error{
+		"create": func(rnd *rand.Rand, name string) error {
+			in := &firehose.CreateDeliveryStreamInput{
+				DeliveryStreamName: &name,
+				S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+					BucketARN: aws.String("arn:aws:s3:::stress-bucket"),
+				},
+			}
+			if rnd.Intn(2) == 0 {
+				in.DeliveryStreamType = fhtypes.DeliveryStreamTypeMSKAsSource
+			}
+			_, err := svc.Create(ctx, in)
+			return err
+		},
+		"delete": func(rnd *rand.Rand, name string) error {
+			_, err := svc.Delete(ctx, &firehose.DeleteDeliveryStreamInput{DeliveryStreamName: &name})
+			return err
+		},
+		"put": func(rnd *rand.Rand, name string) error {
+			_, err := svc.Put(ctx, &firehose.PutRecordInput{
+				DeliveryStreamName: &name,
+				Record:             &fhtypes.Record{Data: []byte("put!\n")},
+			})
+			return err
+		},
+		"putBatch": func(rnd *rand.Rand, name string) error {
+			records := make([]fhtypes.Record, rnd.Intn(8)+1)
+			for i := range records {
+				records[i].Data = []byte("batch!\n")
+			}
+			_, err := svc.PutBatch(ctx, &firehose.PutRecordBatchInput{DeliveryStreamName: &name, Records: records})
+			return err
+		},
+		"describe": func(rnd *rand.Rand, name string) error {
+			_, err := svc.Describe(ctx, &firehose.DescribeDeliveryStreamInput{DeliveryStreamName: &name})
+			return err
+		},
+		"list": func(rnd *rand.Rand, name string) error {
+			_, err := svc.Listing(ctx, &firehose.ListDeliveryStreamsInput{DeliveryStreamType: fhtypes.DeliveryStreamTypeDirectPut})
+			return err
+		},
+		"flush": func(rnd *rand.Rand, name string) error {
+			return d.Flush(ctx, name)
+		},
+		"flushAll": func(rnd *rand.Rand, name string) error {
+			return d.FlushAll(ctx)
+		},
+		"pause": func(rnd *rand.Rand, name string) error {
+			if rnd.Intn(2) == 0 {
+				return d.Pause(ctx, name)
+			}
+			return d.Resume(ctx, name)
+		},
+		"bufferStatus": func(rnd *rand.Rand, name string) error {
+			_, err := d.BufferStatus(ctx, name)
+			return err
+		},
+		"streams": func(rnd *rand.Rand, name string) error {
+			// streams deleted concurrently are skipped instead of failing the listing.
+			if _, err := d.Streams(ctx); err != nil {
+				return fmt.Errorf("Streams failed: %v", err)
+			}
+			return nil
+		},
+	}
+	opNames := make([]string, 0, len(ops))
+	for name := range ops {
+		opNames = append(opNames, name)
+	}
+
+	expected := func(err error) bool {
+		var (
+			notFound    *fhtypes.ResourceNotFoundException
+			inUse       *fhtypes.ResourceInUseException
+			unavailable *fhtypes.ServiceUnavailableException
+		)
+		return err == nil || errors.As(err, &notFound) || errors.As(err, &inUse) || errors.As(err, &unavailable)
+	}
+
+	const workers, iterations = 8, 300
+	wg := &sync.WaitGroup{}
+	errCh := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < iterations; i++ {
+				op := opNames[rnd.Intn(len(opNames))]
+				name := names[rnd.Intn(len(names))]
+				if err := ops[op](rnd, name); !expected(err) {
+					errCh <- fmt.Errorf("%s %s: %w", op, name, err)
+					return
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+
+	if _, err := d.Shutdown(ctx); err != nil {
+		t.Errorf("failed to shut down: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package toyhose
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// TailStage represents the point of the pipeline which TailEvent is observed at.
+type TailStage string
+
+// TailStage values.
+const (
+	// TailStageAccepted is for records accepted by PutRecord, PutRecordBatch or Kinesis source.
+	TailStageAccepted TailStage = "accepted"
+	// TailStageTransformed is for records handed to destination after data transformation.
+	TailStageTransformed TailStage = "transformed"
+	// TailStageDelivered is for objects written by destination.
+	TailStageDelivered TailStage = "delivered"
+)
+
+// TailEvent represents a record or a delivered object flowing through a deliveryStream.
+type TailEvent struct {
+	Stage              TailStage `json:"stage"`
+	DeliveryStreamName string    `json:"deliveryStreamName"`
+	Timestamp          time.Time `json:"timestamp"`
+	// RecordID, Data and Encoding are set for accepted and transformed stages.
+	// Encoding is "text" when Data is printable, otherwise "base64".
+	RecordID string `json:"recordId,omitempty"`
+	Data     string `json:"data,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	// PartitionKey and ExplicitHashKey are set for records read from Kinesis stream.
+	PartitionKey    string `json:"partitionKey,omitempty"`
+	ExplicitHashKey string `json:"explicitHashKey,omitempty"`
+	// Bucket, Key, RecordIDs and Size are set for delivered stage.
+	Bucket    string   `json:"bucket,omitempty"`
+	Key       string   `json:"key,omitempty"`
+	RecordIDs []string `json:"recordIds,omitempty"`
+	Size      int      `json:"size,omitempty"`
+}
+
+// TailFilter narrows TailEvent sent by Tail. empty fields match everything,
+// except that Stages defaults to accepted stage only.
+type TailFilter struct {
+	Streams []string
+	Stages  []TailStage
+}
+
+func (f TailFilter) match(ev TailEvent) bool {
+	if len(f.Streams) > 0 && !slices.Contains(f.Streams, ev.DeliveryStreamName) {
+		return false
+	}
+	return slices.Contains(f.Stages, ev.Stage)
+}
+
+// tailBufferSize is the number of events kept for slow subscriber. overflowed events are dropped.
+const tailBufferSize = 256
+
+type tailSubscriber struct {
+	filter TailFilter
+	ch     chan TailEvent
+}
+
+// tailHub fans out TailEvent to subscribers. publishing methods are nil-safe.
+type tailHub struct {
+	mutex       sync.RWMutex
+	subscribers map[*tailSubscriber]struct{}
+	clock       Clock
+	// done is closed by close to end every subscription.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newTailHub(clock Clock) *tailHub {
+	return &tailHub{
+		subscribers: map[*tailSubscriber]struct{}{},
+		clock:       clock,
+		done:        make(chan struct{}),
+	}
+}
+
+// close ends every subscription, including ones made afterwards.
+func (h *tailHub) close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+func (h *tailHub) subscribe(ctx context.Context, filter TailFilter) <-chan TailEvent {
+	if len(filter.Stages) == 0 {
+		filter.Stages = []TailStage{TailStageAccepted}
+	}
+	s := &tailSubscriber{
+		filter: filter,
+		ch:     make(chan TailEvent, tailBufferSize),
+	}
+	h.mutex.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mutex.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-h.done:
+		}
+		h.mutex.Lock()
+		delete(h.subscribers, s)
+		h.mutex.Unlock()
+		close(s.ch)
+	}()
+	return s.ch
+}
+
+func (h *tailHub) active() bool {
+	if h == nil {
+		return false
+	}
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.subscribers) > 0
+}
+
+func (h *tailHub) publish(ev TailEvent) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for s := range h.subscribers {
+		if !s.filter.match(ev) {
+			continue
+		}
+		select {
+		case s.ch <- ev:
+		default:
+		}
+	}
+}
+
+func (h *tailHub) records(stage TailStage, streamName string, records []*DeliveryRecord) {
+	if !h.active() {
+		return
+	}
+	for _, rec := range records {
+		data, encoding := encodeTailData(rec.Data)
+		h.publish(TailEvent{
+			Stage:              stage,
+			DeliveryStreamName: streamName,
+			Timestamp:          clockNow(h.clock),
+			RecordID:           rec.ID,
+			Data:               data,
+			Encoding:           encoding,
+			PartitionKey:       rec.PartitionKey,
+			ExplicitHashKey:    rec.ExplicitHashKey,
+		})
+	}
+}
+
+func (h *tailHub) delivered(streamName, bucket, key string, records []*DeliveryRecord, size int, ts time.Time) {
+	if !h.active() {
+		return
+	}
+	recordIDs := make([]string, 0, len(records))
+	for _, rec := range records {
+		recordIDs = append(recordIDs, rec.ID)
+	}
+	h.publish(TailEvent{
+		Stage:              TailStageDelivered,
+		DeliveryStreamName: streamName,
+		Timestamp:          ts,
+		Bucket:             bucket,
+		Key:                key,
+		RecordIDs:          recordIDs,
+		Size:               size,
+	})
+}
+
+func encodeTailData(data []byte) (string, string) {
+	if !utf8.Valid(data) {
+		return base64.StdEncoding.EncodeToString(data), "base64"
+	}
+	for _, r := range string(data) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return base64.StdEncoding.EncodeToString(data), "base64"
+		}
+	}
+	return string(data), "text"
+}
+
+// Tail returns channel which receives TailEvent matching filter until ctx is done or CloseTail is called.
+// Events are dropped when the receiver falls behind.
+func (d *Dispatcher) Tail(ctx context.Context, filter TailFilter) <-chan TailEvent {
+	return d.tail.subscribe(ctx, filter)
+}
+
+// CloseTail ends every Tail subscription and the /_toyhose/tail streams served from them.
+// Register it by http.Server.RegisterOnShutdown, since those streams never become idle.
+func (d *Dispatcher) CloseTail() {
+	d.tail.close()
+}
+
+func parseTailFilter(r *http.Request) (TailFilter, error) {
+	q := r.URL.Query()
+	var filter TailFilter
+	for _, v := range q["stream"] {
+		filter.Streams = append(filter.Streams, strings.Split(v, ",")...)
+	}
+	for _, v := range q["stage"] {
+		for _, stage := range strings.Split(v, ",") {
+			switch s := TailStage(stage); s {
+			case TailStageAccepted, TailStageTransformed, TailStageDelivered:
+				filter.Stages = append(filter.Stages, s)
+			default:
+				return TailFilter{}, &types.InvalidArgumentException{Message: aws.String(fmt.Sprintf("stage: %s is not supported", stage))}
+			}
+		}
+	}
+	return filter, nil
+}
+
+// serveTail streams TailEvent as Server-Sent Events until the client disconnects.
+func (d *Dispatcher) serveTail(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseTailFilter(r)
+	if err != nil {
+		outputForJSON(w, nil, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		outputForJSON(w, nil, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	events := d.Tail(r.Context(), filter)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for ev := range events {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Stage, b); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
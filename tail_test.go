@@ -0,0 +1,123 @@
+package toyhose
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestTail(t *testing.T) {
+	ctx := context.Background()
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		S3InjectedConf: S3InjectedConf{
+			InMemory: true,
+		},
+	})
+	testserver := httptest.NewServer(d.AdminHandler())
+	defer testserver.Close()
+
+	svc := d.Service()
+	for _, name := range []string{"tail-stream", "other-stream"} {
+		if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+			DeliveryStreamName: aws.String(name),
+			S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+				BucketARN: aws.String("arn:aws:s3:::tail-bucket"),
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("invalid stage", func(t *testing.T) {
+		res, err := http.Get(testserver.URL + AdminPathPrefix + "tail?stage=unknown")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("unexpected status: %d", res.StatusCode)
+		}
+	})
+
+	tailCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(tailCtx, http.MethodGet, testserver.URL+AdminPathPrefix+"tail?stream=tail-stream&stage=accepted,delivered", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected Content-Type: %s", ct)
+	}
+
+	binary := []byte{0xff, 0x00, '!'}
+	for _, name := range []string{"other-stream", "tail-stream"} {
+		if _, err := svc.PutBatch(ctx, &firehose.PutRecordBatchInput{
+			DeliveryStreamName: aws.String(name),
+			Records: []fhtypes.Record{
+				{Data: []byte("hello!\n")},
+				{Data: binary},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(tailCtx, "tail-stream"); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []TailEvent
+	scanner := bufio.NewScanner(res.Body)
+	for len(events) < 3 && scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ev TailEvent
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	if len(events) != 3 {
+		t.Fatalf("unexpected events: %#v, err: %v", events, scanner.Err())
+	}
+	for _, ev := range events {
+		if ev.DeliveryStreamName != "tail-stream" {
+			t.Errorf("event of other stream: %#v", ev)
+		}
+	}
+	if ev := events[0]; ev.Stage != TailStageAccepted || ev.Encoding != "text" || ev.Data != "hello!\n" {
+		t.Errorf("unexpected text event: %#v", ev)
+	}
+	if ev := events[1]; ev.Stage != TailStageAccepted || ev.Encoding != "base64" || ev.Data != base64.StdEncoding.EncodeToString(binary) {
+		t.Errorf("unexpected binary event: %#v", ev)
+	}
+	if ev := events[2]; ev.Stage != TailStageDelivered || ev.Bucket != "tail-bucket" || len(ev.RecordIDs) != 2 || ev.Size != 10 {
+		t.Errorf("unexpected delivered event: %#v", ev)
+	}
+
+	t.Run("closed by CloseTail", func(t *testing.T) {
+		d.CloseTail()
+		for scanner.Scan() {
+		}
+		if err := scanner.Err(); err != nil {
+			t.Errorf("stream is not ended by CloseTail: %v", err)
+		}
+		if _, ok := <-d.Tail(ctx, TailFilter{}); ok {
+			t.Error("subscription after CloseTail receives event")
+		}
+	})
+}
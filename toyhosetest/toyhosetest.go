@@ -0,0 +1,180 @@
+// Package toyhosetest provides embedded toyhose server for Go integration tests.
+package toyhosetest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/taiyoh/toyhose"
+)
+
+// Server represents toyhose Dispatcher running on httptest.Server.
+type Server struct {
+	// URL is base URL of the server, used as firehose endpoint.
+	// Admin API is served under URL + toyhose.AdminPathPrefix.
+	URL string
+	// Client is firehose client which is configured to send requests to the server.
+	Client *firehose.Client
+	// Dispatcher is the toyhose instance behind the server.
+	Dispatcher *toyhose.Dispatcher
+	// AWSConfig is shared by Client and Dispatcher.
+	AWSConfig aws.Config
+}
+
+type options struct {
+	region         string
+	s3InjectedConf toyhose.S3InjectedConf
+	kinesisConf    toyhose.KinesisInjectedConf
+	streams        []*firehose.CreateDeliveryStreamInput
+	clock          toyhose.Clock
+	ids            toyhose.IDGenerator
+}
+
+// Option represents optional setting for NewServer.
+type Option func(*options)
+
+// WithRegion sets AWS region of the server and Client. The default is us-east-1.
+func WithRegion(region string) Option {
+	return func(o *options) {
+		o.region = region
+	}
+}
+
+// WithS3Endpoint makes S3 destination write objects to supplied S3 compatible endpoint
+// instead of keeping them in memory.
+func WithS3Endpoint(endpoint string) Option {
+	return func(o *options) {
+		o.s3InjectedConf.EndPoint = &endpoint
+		o.s3InjectedConf.InMemory = false
+	}
+}
+
+// WithKinesisEndpoint sets Kinesis compatible endpoint for KinesisStreamAsSource delivery streams.
+func WithKinesisEndpoint(endpoint string) Option {
+	return func(o *options) {
+		o.kinesisConf.Endpoint = &endpoint
+	}
+}
+
+// WithBufferingHints overrides BufferingHints of every S3 destination.
+func WithBufferingHints(sizeInMBs, intervalInSeconds int) Option {
+	return func(o *options) {
+		o.s3InjectedConf.SizeInMBs = &sizeInMBs
+		o.s3InjectedConf.IntervalInSeconds = &intervalInSeconds
+	}
+}
+
+// WithDisableBuffering makes S3 destination deliver every record immediately.
+func WithDisableBuffering() Option {
+	return func(o *options) {
+		o.s3InjectedConf.DisableBuffering = true
+	}
+}
+
+// WithDeterministic makes the server run on toyhose.VirtualClock starting at start,
+// and generate record IDs and object keys from seed.
+// Use Dispatcher.AdvanceClock to elapse buffering intervals.
+func WithDeterministic(start time.Time, seed int64) Option {
+	return func(o *options) {
+		o.clock = toyhose.NewVirtualClock(start)
+		o.ids = toyhose.NewSeededIDGenerator(seed)
+	}
+}
+
+// WithStreams creates supplied delivery streams when the server starts.
+func WithStreams(inputs ...*firehose.CreateDeliveryStreamInput) Option {
+	return func(o *options) {
+		o.streams = append(o.streams, inputs...)
+	}
+}
+
+// shutdownTimeout bounds the deletion of each stream and the shutdown of the Dispatcher on cleanup.
+var shutdownTimeout = 10 * time.Second
+
+// NewServer starts toyhose server and returns it.
+// Delivered objects are kept in memory unless WithS3Endpoint is supplied.
+// The server and every supplied stream are torn down by t.Cleanup, and then the Dispatcher
+// is shut down within shutdownTimeout, so that no delivery outlives the test.
+func NewServer(t testing.TB, opts ...Option) *Server {
+	t.Helper()
+	o := &options{
+		region: "us-east-1",
+		s3InjectedConf: toyhose.S3InjectedConf{
+			InMemory: true,
+		},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	ctx := context.Background()
+	awsConf, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(o.region),
+		config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider("toyhosetest", "toyhosetest", ""),
+		),
+	)
+	if err != nil {
+		t.Fatalf("failed to load aws config: %v", err)
+	}
+
+	d := toyhose.NewDispatcher(&toyhose.DispatcherConfig{
+		AWSConf:             awsConf,
+		S3InjectedConf:      o.s3InjectedConf,
+		KinesisInjectedConf: o.kinesisConf,
+		Clock:               o.clock,
+		IDGenerator:         o.ids,
+	})
+	// cleanups run in reverse order, so this runs after the server is closed.
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if _, err := d.Shutdown(ctx); err != nil {
+			t.Logf("failed to shut down toyhose: %v", err)
+		}
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.Dispatch)
+	mux.Handle(toyhose.AdminPathPrefix, d.AdminHandler())
+	mux.Handle("/metrics", d.MetricsHandler())
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	cli := firehose.NewFromConfig(awsConf, func(fo *firehose.Options) {
+		fo.BaseEndpoint = aws.String(srv.URL)
+	})
+	s := &Server{
+		URL:        srv.URL,
+		Client:     cli,
+		Dispatcher: d,
+		AWSConfig:  awsConf,
+	}
+	for _, input := range o.streams {
+		s.CreateStream(t, input)
+	}
+	return s
+}
+
+// CreateStream creates delivery stream and registers its deletion to t.Cleanup.
+func (s *Server) CreateStream(t testing.TB, input *firehose.CreateDeliveryStreamInput) {
+	t.Helper()
+	if _, err := s.Client.CreateDeliveryStream(context.Background(), input); err != nil {
+		t.Fatalf("failed to create delivery stream: %v", err)
+	}
+	name := input.DeliveryStreamName
+	t.Cleanup(func() {
+		// deletion waits for deliveries, which never finish while S3 is down.
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_, _ = s.Client.DeleteDeliveryStream(ctx, &firehose.DeleteDeliveryStreamInput{
+			DeliveryStreamName: name,
+		})
+	})
+}
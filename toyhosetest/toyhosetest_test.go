@@ -0,0 +1,118 @@
+package toyhosetest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestNewServer(t *testing.T) {
+	ctx := context.Background()
+	streamName := "toyhosetest-stream"
+	srv := NewServer(t,
+		WithDisableBuffering(),
+		WithStreams(&firehose.CreateDeliveryStreamInput{
+			DeliveryStreamName: &streamName,
+			S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+				BucketARN: aws.String("arn:aws:s3:::toyhosetest-bucket"),
+				RoleARN:   aws.String("foo"),
+			},
+		}),
+	)
+
+	out, err := srv.Client.ListDeliveryStreams(ctx, &firehose.ListDeliveryStreamsInput{
+		DeliveryStreamType: fhtypes.DeliveryStreamTypeDirectPut,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.DeliveryStreamNames) != 1 || out.DeliveryStreamNames[0] != streamName {
+		t.Errorf("unexpected delivery streams: %v", out.DeliveryStreamNames)
+	}
+
+	dout, err := srv.Client.DescribeDeliveryStream(ctx, &firehose.DescribeDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc := dout.DeliveryStreamDescription; desc.CreateTimestamp == nil || *desc.DeliveryStreamName != streamName {
+		t.Errorf("unexpected description: %#v", desc)
+	}
+
+	pout, err := srv.Client.PutRecord(ctx, &firehose.PutRecordInput{
+		DeliveryStreamName: &streamName,
+		Record:             &fhtypes.Record{Data: []byte("hello toyhosetest\n")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	deliveries, err := srv.Dispatcher.WaitForDeliveries(waitCtx, streamName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := string(deliveries[0].Body); body != "hello toyhosetest\n" {
+		t.Errorf("unexpected body delivered: %s", body)
+	}
+	if ids := deliveries[0].RecordIDs; len(ids) != 1 || ids[0] != *pout.RecordId {
+		t.Errorf("unexpected record ids: %v", ids)
+	}
+}
+
+func TestNewServerCleanup(t *testing.T) {
+	var srv *Server
+	t.Run("server", func(t *testing.T) {
+		srv = NewServer(t)
+	})
+	streamName := "toyhosetest-after-cleanup"
+	if _, err := srv.Dispatcher.Service().Create(context.Background(), &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+			BucketARN: aws.String("arn:aws:s3:::toyhosetest-bucket"),
+		},
+	}); err == nil {
+		t.Error("Dispatcher is not shut down by cleanup")
+	}
+}
+
+func TestCleanupWhileS3IsDown(t *testing.T) {
+	// HeadBucket succeeds, and every upload fails.
+	s3srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer s3srv.Close()
+	defer func(d time.Duration) { shutdownTimeout = d }(shutdownTimeout)
+	shutdownTimeout = 200 * time.Millisecond
+
+	streamName := "toyhosetest-s3-down"
+	started := time.Now()
+	t.Run("server", func(t *testing.T) {
+		srv := NewServer(t, WithS3Endpoint(s3srv.URL), WithDisableBuffering(), WithStreams(&firehose.CreateDeliveryStreamInput{
+			DeliveryStreamName: &streamName,
+			S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+				BucketARN: aws.String("arn:aws:s3:::toyhosetest-bucket"),
+				RoleARN:   aws.String("foo"),
+			},
+		}))
+		if _, err := srv.Client.PutRecord(context.Background(), &firehose.PutRecordInput{
+			DeliveryStreamName: &streamName,
+			Record:             &fhtypes.Record{Data: []byte("never delivered\n")},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("cleanup waits for S3: %s", elapsed)
+	}
+}
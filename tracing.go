@@ -0,0 +1,82 @@
+package toyhose
+
+import (
+	"context"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/taiyoh/toyhose"
+
+// span attribute keys.
+const (
+	attrRequestID          = attribute.Key("aws.request_id")
+	attrRecordID           = attribute.Key("firehose.record_id")
+	attrRecordIDs          = attribute.Key("firehose.record_ids")
+	attrDeliveryStreamName = attribute.Key("firehose.delivery_stream_name")
+)
+
+// NewOTLPTracerProvider returns TracerProvider exporting spans to OTLP/HTTP collector at endpoint.
+// /v1/traces is used as the path when endpoint has no path.
+// Callers should Shutdown the provider to flush remaining spans.
+func NewOTLPTracerProvider(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	// a delivered object links every record in it, which easily exceeds the default limit of links.
+	limits := sdktrace.NewSpanLimits()
+	limits.LinkCountLimit = -1
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithRawSpanLimits(limits),
+	)
+	return tp, nil
+}
+
+func tracerFrom(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// startSpan is nil-safe shorthand of tracer.Start for components built without tracer.
+func startSpan(ctx context.Context, tracer trace.Tracer, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if tracer == nil {
+		tracer = tracerFrom(nil)
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// recordLinks returns links to ingest spans of records. records without span, e.g. from Kinesis, are skipped.
+func recordLinks(records []*DeliveryRecord) []trace.Link {
+	links := make([]trace.Link, 0, len(records))
+	for _, rec := range records {
+		if rec.spanContext.IsValid() {
+			links = append(links, trace.Link{SpanContext: rec.spanContext})
+		}
+	}
+	return links
+}
@@ -0,0 +1,129 @@
+package toyhose
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	awsConf := awsConfig(t)
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConf,
+		S3InjectedConf: S3InjectedConf{
+			InMemory: true,
+		},
+		TracerProvider: tp,
+	})
+	testserver := httptest.NewServer(http.HandlerFunc(d.Dispatch))
+	defer testserver.Close()
+
+	fh := firehose.NewFromConfig(awsConf, func(o *firehose.Options) {
+		o.BaseEndpoint = aws.String(testserver.URL)
+	})
+	streamName := "tracing-stream"
+	if _, err := fh.CreateDeliveryStream(ctx, &firehose.CreateDeliveryStreamInput{
+		DeliveryStreamName: &streamName,
+		S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+			BucketARN: aws.String("arn:aws:s3:::tracing-bucket"),
+			RoleARN:   aws.String("foo"),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var reqID string
+	out, err := fh.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: &streamName,
+		Records: []fhtypes.Record{
+			{Data: []byte("hello!\n")},
+			{Data: []byte("world!\n")},
+		},
+	}, func(o *firehose.Options) {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("captureRequestID", func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+				out, md, err := next.HandleDeserialize(ctx, in)
+				if res, ok := out.RawResponse.(*smithyhttp.Response); ok {
+					reqID = res.Header.Get("x-amzn-RequestId")
+				}
+				return out, md, err
+			}), middleware.After)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := d.Flush(flushCtx, streamName); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		requestSpan  sdktrace.ReadOnlySpan
+		ingestSpans  = map[string]sdktrace.ReadOnlySpan{}
+		deliverySpan sdktrace.ReadOnlySpan
+	)
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "Firehose.PutRecordBatch":
+			requestSpan = span
+		case "Firehose.IngestRecord":
+			v, _ := spanAttribute(span, attrRecordID)
+			ingestSpans[v.AsString()] = span
+		case "S3.PutObject":
+			deliverySpan = span
+		}
+	}
+	if requestSpan == nil || deliverySpan == nil {
+		t.Fatalf("spans not found: request=%v delivery=%v", requestSpan, deliverySpan)
+	}
+	if v, _ := spanAttribute(requestSpan, attrRequestID); reqID == "" || v.AsString() != reqID {
+		t.Errorf("unexpected request ID: %q, expected: %q", v.AsString(), reqID)
+	}
+	if len(ingestSpans) != len(out.RequestResponses) {
+		t.Fatalf("unexpected ingest spans: %d", len(ingestSpans))
+	}
+	links := map[string]bool{}
+	for _, l := range deliverySpan.Links() {
+		links[l.SpanContext.SpanID().String()] = true
+	}
+	for _, res := range out.RequestResponses {
+		span, ok := ingestSpans[*res.RecordId]
+		if !ok {
+			t.Errorf("ingest span of %s not found", *res.RecordId)
+			continue
+		}
+		if span.Parent().SpanID() != requestSpan.SpanContext().SpanID() {
+			t.Errorf("ingest span of %s is not a child of request span", *res.RecordId)
+		}
+		if !links[span.SpanContext().SpanID().String()] {
+			t.Errorf("delivery span does not link ingest span of %s", *res.RecordId)
+		}
+	}
+	if v, _ := spanAttribute(deliverySpan, attrRecordIDs); len(v.AsStringSlice()) != 2 {
+		t.Errorf("unexpected record IDs of delivery span: %v", v.AsStringSlice())
+	}
+}
@@ -0,0 +1,198 @@
+package toyhose
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/google/uuid"
+)
+
+// Webhook represents URL which receives DeliveryNotification.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// DeliveryStreamName limits notifications to the stream. empty means every stream.
+	DeliveryStreamName string `json:"deliveryStreamName,omitempty"`
+}
+
+// DeliveryStatus represents result of a delivery.
+type DeliveryStatus string
+
+// DeliveryStatus values.
+const (
+	DeliveryStatusSucceeded DeliveryStatus = "succeeded"
+	DeliveryStatusFailed    DeliveryStatus = "failed"
+	// DeliveryStatusSpilled is for a batch kept in spill directory for redelivery after retries failed.
+	DeliveryStatusSpilled DeliveryStatus = "spilled"
+)
+
+// DeliveryNotification is posted to webhooks after each delivery.
+type DeliveryNotification struct {
+	Status             DeliveryStatus `json:"status"`
+	DeliveryStreamName string         `json:"deliveryStreamName"`
+	Bucket             string         `json:"bucket"`
+	Key                string         `json:"key"`
+	RecordCount        int            `json:"recordCount"`
+	// SizeInBytes is the size of the object, after compression.
+	SizeInBytes int                     `json:"sizeInBytes"`
+	Compression types.CompressionFormat `json:"compression"`
+	RecordIDs   []string                `json:"recordIds"`
+	Timestamp   time.Time               `json:"timestamp"`
+	Error       string                  `json:"error,omitempty"`
+}
+
+// webhookTimeout bounds each POST, so that unresponsive webhook does not pile up goroutines.
+const webhookTimeout = 5 * time.Second
+
+// webhookNotifier posts DeliveryNotification to registered webhooks. notify is nil-safe.
+type webhookNotifier struct {
+	mutex    sync.RWMutex
+	webhooks map[string]Webhook
+	cli      *http.Client
+}
+
+func newWebhookNotifier(urls []string) *webhookNotifier {
+	n := &webhookNotifier{
+		webhooks: map[string]Webhook{},
+		cli:      &http.Client{Timeout: webhookTimeout},
+	}
+	for _, u := range urls {
+		n.add(Webhook{URL: u})
+	}
+	return n
+}
+
+func (n *webhookNotifier) add(w Webhook) Webhook {
+	w.ID = uuid.New().String()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.webhooks[w.ID] = w
+	return w
+}
+
+func (n *webhookNotifier) remove(id string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	_, ok := n.webhooks[id]
+	delete(n.webhooks, id)
+	return ok
+}
+
+func (n *webhookNotifier) list() []Webhook {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	list := make([]Webhook, 0, len(n.webhooks))
+	for _, w := range n.webhooks {
+		list = append(list, w)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].URL < list[j].URL
+	})
+	return list
+}
+
+func (n *webhookNotifier) targets(streamName string) []string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	var urls []string
+	for _, w := range n.webhooks {
+		if w.DeliveryStreamName == "" || w.DeliveryStreamName == streamName {
+			urls = append(urls, w.URL)
+		}
+	}
+	return urls
+}
+
+// notify posts notification to webhooks in background. failures are only logged.
+func (n *webhookNotifier) notify(notification DeliveryNotification) {
+	if n == nil {
+		return
+	}
+	urls := n.targets(notification.DeliveryStreamName)
+	if len(urls) == 0 {
+		return
+	}
+	b, err := json.Marshal(notification)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode delivery notification")
+		return
+	}
+	for _, u := range urls {
+		go func(u string) {
+			ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+			if err != nil {
+				log.Debug().Err(err).Str("url", u).Msg("invalid webhook")
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			res, err := n.cli.Do(req)
+			if err != nil {
+				log.Debug().Err(err).Str("url", u).Msg("webhook failed")
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode >= 300 {
+				log.Debug().Int("status", res.StatusCode).Str("url", u).Msg("webhook returned error status")
+			}
+		}(u)
+	}
+}
+
+func (c s3StoreConfig) compression() types.CompressionFormat {
+	if c.shouldGZipCompress {
+		return types.CompressionFormatGzip
+	}
+	return types.CompressionFormatUncompressed
+}
+
+// AddWebhook registers webhook which receives DeliveryNotification of streamName,
+// or of every stream when streamName is empty.
+func (d *Dispatcher) AddWebhook(rawURL, streamName string) (Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, &types.InvalidArgumentException{Message: aws.String(fmt.Sprintf("url: %q must be absolute http(s) URL", rawURL))}
+	}
+	return d.webhooks.add(Webhook{URL: rawURL, DeliveryStreamName: streamName}), nil
+}
+
+// RemoveWebhook unregisters webhook by its ID.
+func (d *Dispatcher) RemoveWebhook(id string) error {
+	if !d.webhooks.remove(id) {
+		return &types.ResourceNotFoundException{Message: aws.String(fmt.Sprintf("webhook: %s not found", id))}
+	}
+	return nil
+}
+
+// Webhooks returns registered webhooks.
+func (d *Dispatcher) Webhooks() []Webhook {
+	return d.webhooks.list()
+}
+
+func (d *Dispatcher) registerWebhookHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET "+AdminPathPrefix+"webhooks", func(w http.ResponseWriter, r *http.Request) {
+		outputForJSON(w, d.Webhooks(), nil)
+	})
+	mux.HandleFunc("POST "+AdminPathPrefix+"webhooks", func(w http.ResponseWriter, r *http.Request) {
+		var in Webhook
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			outputForJSON(w, nil, &types.InvalidArgumentException{Message: aws.String(err.Error())})
+			return
+		}
+		wh, err := d.AddWebhook(in.URL, in.DeliveryStreamName)
+		outputForJSON(w, wh, err)
+	})
+	mux.HandleFunc("DELETE "+AdminPathPrefix+"webhooks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		outputForJSON(w, struct{}{}, d.RemoveWebhook(r.PathValue("id")))
+	})
+}
@@ -0,0 +1,151 @@
+package toyhose
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+func TestWebhooks(t *testing.T) {
+	ctx := context.Background()
+	type received struct {
+		path         string
+		notification DeliveryNotification
+	}
+	ch := make(chan received, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n DeliveryNotification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Error(err)
+		}
+		ch <- received{path: r.URL.Path, notification: n}
+	}))
+	defer receiver.Close()
+
+	d := NewDispatcher(&DispatcherConfig{
+		AWSConf: awsConfig(t),
+		S3InjectedConf: S3InjectedConf{
+			InMemory: true,
+		},
+		WebhookURLs: []string{receiver.URL + "/global"},
+	})
+	testserver := httptest.NewServer(d.AdminHandler())
+	defer testserver.Close()
+
+	svc := d.Service()
+	for _, name := range []string{"webhook-stream", "other-stream"} {
+		if _, err := svc.Create(ctx, &firehose.CreateDeliveryStreamInput{
+			DeliveryStreamName: aws.String(name),
+			S3DestinationConfiguration: &fhtypes.S3DestinationConfiguration{
+				BucketARN:         aws.String("arn:aws:s3:::webhook-bucket"),
+				CompressionFormat: fhtypes.CompressionFormatGzip,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body, _ := json.Marshal(Webhook{URL: receiver.URL + "/stream", DeliveryStreamName: "webhook-stream"})
+	res, err := http.Post(testserver.URL+AdminPathPrefix+"webhooks", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var registered Webhook
+	if err := json.NewDecoder(res.Body).Decode(&registered); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if registered.ID == "" || len(d.Webhooks()) != 2 {
+		t.Fatalf("webhook is not registered: %#v", d.Webhooks())
+	}
+
+	receive := func(t *testing.T, n int) map[string]DeliveryNotification {
+		t.Helper()
+		got := map[string]DeliveryNotification{}
+		for i := 0; i < n; i++ {
+			select {
+			case r := <-ch:
+				got[r.path+" "+r.notification.DeliveryStreamName] = r.notification
+			case <-time.After(5 * time.Second):
+				t.Fatalf("notification not received. got: %v", got)
+			}
+		}
+		return got
+	}
+	deliver := func(t *testing.T, streamName string) []string {
+		t.Helper()
+		out, err := svc.PutBatch(ctx, &firehose.PutRecordBatchInput{
+			DeliveryStreamName: aws.String(streamName),
+			Records: []fhtypes.Record{
+				{Data: []byte("hello!\n")},
+				{Data: []byte("world!\n")},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(ctx, streamName); err != nil {
+			t.Fatal(err)
+		}
+		return []string{*out.RequestResponses[0].RecordId, *out.RequestResponses[1].RecordId}
+	}
+
+	t.Run("global and per stream", func(t *testing.T) {
+		recordIDs := deliver(t, "webhook-stream")
+		deliver(t, "other-stream")
+		got := receive(t, 3)
+		n, ok := got["/stream webhook-stream"]
+		if !ok {
+			t.Fatalf("per stream webhook is not notified: %v", got)
+		}
+		delivery := d.Deliveries("webhook-stream")[0]
+		if n.Status != DeliveryStatusSucceeded || n.Bucket != "webhook-bucket" || n.Key != delivery.Key ||
+			n.RecordCount != 2 || n.SizeInBytes != len(delivery.Body) || n.Compression != fhtypes.CompressionFormatGzip {
+			t.Errorf("unexpected notification: %#v", n)
+		}
+		if len(n.RecordIDs) != 2 || n.RecordIDs[0] != recordIDs[0] || n.RecordIDs[1] != recordIDs[1] {
+			t.Errorf("unexpected record IDs: %v", n.RecordIDs)
+		}
+		for _, k := range []string{"/global webhook-stream", "/global other-stream"} {
+			if _, ok := got[k]; !ok {
+				t.Errorf("global webhook is not notified: %s", k)
+			}
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodDelete, testserver.URL+AdminPathPrefix+"webhooks/"+registered.ID, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status: %d", res.StatusCode)
+		}
+		deliver(t, "webhook-stream")
+		got := receive(t, 1)
+		if _, ok := got["/global webhook-stream"]; !ok {
+			t.Errorf("unexpected notifications: %v", got)
+		}
+		select {
+		case r := <-ch:
+			t.Errorf("removed webhook is notified: %#v", r)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("invalid url", func(t *testing.T) {
+		if _, err := d.AddWebhook("localhost:8080", ""); err == nil {
+			t.Error("relative URL is accepted")
+		}
+	})
+}